@@ -0,0 +1,167 @@
+package cluster
+
+//
+// the cluster config file that the daemons in main/ and
+// kvctl share: which addresses the replicas of each
+// service listen on, and which log they agree with.
+//
+// {
+//   "backend": "paxos",
+//   "kvpaxos": [
+//     {"addr": "tcp://a:7001", "dir": "/var/kv"},
+//     {"addr": "tcp://b:7001", "dir": "/var/kv"},
+//     {"addr": "tcp://c:7001", "dir": "/var/kv"}
+//   ],
+//   "shardmasters": [
+//     {"addr": "/tmp/sm-0", "dir": "/tmp/sm-0.d"},
+//     {"addr": "/tmp/sm-1", "dir": "/tmp/sm-1.d"},
+//     {"addr": "/tmp/sm-2", "dir": "/tmp/sm-2.d"}
+//   ],
+//   "groups": {
+//     "100": [
+//       {"addr": "/tmp/g100-0", "dir": "/tmp/g100-0.d"},
+//       ...
+//     ]
+//   }
+// }
+//
+// addresses are as transport takes them, and each replica
+// keeps its log in its dir; see Prepare(). a service can
+// be left out if nobody runs it. a replica can also be
+// given as just its address, for kvctl's and kvhttpd's
+// sake, but the daemons will not start one without a dir.
+//
+// the set of replicas is fixed by this file. replacing a
+// dead one with paxos.Join() and a Reconfig is out of
+// scope: the services do not expose either, so neither the
+// daemons nor kvctl can use them.
+//
+
+import "encoding/json"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+
+const (
+	Paxos  = "paxos"
+	Raft   = "raft"
+	EPaxos = "epaxos"
+)
+
+type Config struct {
+	Backend      string             `json:"backend"` // Paxos (the default), Raft or EPaxos
+	KVPaxos      []Server           `json:"kvpaxos"`
+	ShardMasters []Server           `json:"shardmasters"`
+	Groups       map[int64][]Server `json:"groups"` // shardkv replica groups, by gid
+}
+
+type Server struct {
+	Addr string `json:"addr"`
+	Dir  string `json:"dir"` // "" if none
+}
+
+//
+// a replica may be written as just its address.
+//
+func (s *Server) UnmarshalJSON(data []byte) error {
+	var addr string
+	if json.Unmarshal(data, &addr) == nil {
+		*s = Server{Addr: addr}
+		return nil
+	}
+	type plain Server // without this method
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+//
+// the addresses of servers, as the services take them.
+//
+func Addrs(servers []Server) []string {
+	addrs := make([]string, len(servers))
+	for i, s := range servers {
+		addrs[i] = s.Addr
+	}
+	return addrs
+}
+
+//
+// read and check the config file at path.
+//
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if c.Backend == "" {
+		c.Backend = Paxos
+	}
+	if c.Backend != Paxos && c.Backend != Raft && c.Backend != EPaxos {
+		return nil, fmt.Errorf("%v: unknown backend %q", path, c.Backend)
+	}
+	all := append(append([]Server{}, c.KVPaxos...), c.ShardMasters...)
+	for gid, servers := range c.Groups {
+		if gid == 0 {
+			return nil, fmt.Errorf("%v: gid 0 is reserved for unassigned shards", path)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("%v: group %v has no servers", path, gid)
+		}
+		all = append(all, servers...)
+	}
+	for _, s := range all {
+		if s.Addr == "" {
+			return nil, fmt.Errorf("%v: a server has no addr", path)
+		}
+	}
+	return c, nil
+}
+
+//
+// get s's data dir ready for a replica on backend to start
+// in, or say why it must not. paxos keeps its log there,
+// and so can restart. raft and epaxos keep nothing on disk,
+// so a replica of theirs that crashed must not come back
+// under the same name; the dir only records that it ran.
+// a server with no dir is refused either way, since there
+// would be no telling whether it had run before.
+//
+func Prepare(backend string, s Server) error {
+	if s.Dir == "" {
+		return fmt.Errorf("%v has no dir", s.Addr)
+	}
+	if err := os.MkdirAll(s.Dir, 0777); err != nil {
+		return err
+	}
+	if backend == Paxos {
+		return nil
+	}
+	ran := filepath.Join(s.Dir, "ran")
+	f, err := os.OpenFile(ran, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf("%v has run before, and %v keeps nothing on disk, "+
+			"so it cannot come back", s.Addr, backend)
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+//
+// parse arg as the index of a server in servers, which
+// are service's.
+//
+func Index(service string, servers []Server, arg string) (int, error) {
+	me, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("bad server index %q", arg)
+	}
+	if me < 0 || me >= len(servers) {
+		return 0, fmt.Errorf("%v has %v servers, so no server %v", service, len(servers), me)
+	}
+	return me, nil
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import "testing"
+import "os"
+import "path/filepath"
+import "reflect"
+import "fmt"
+
+func write(t *testing.T, data string) string {
+  path := filepath.Join(t.TempDir(), "cluster.json")
+  if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+    t.Fatalf("write %v: %v", path, err)
+  }
+  return path
+}
+
+func TestLoad(t *testing.T) {
+  fmt.Printf("Test: Load a config ...\n")
+
+  c, err := Load(write(t, `{
+    "kvpaxos": ["a", "b", {"addr": "c", "dir": "c.d"}],
+    "shardmasters": ["sm-0"],
+    "groups": {"100": [{"addr": "g-0", "dir": "g-0.d"}, "g-1"]}
+  }`))
+  if err != nil {
+    t.Fatalf("Load: %v", err)
+  }
+  if c.Backend != Paxos {
+    t.Fatalf("default backend %q, expected %q", c.Backend, Paxos)
+  }
+  if !reflect.DeepEqual(c.KVPaxos, []Server{{"a", ""}, {"b", ""}, {"c", "c.d"}}) {
+    t.Fatalf("kvpaxos %v", c.KVPaxos)
+  }
+  if !reflect.DeepEqual(Addrs(c.KVPaxos), []string{"a", "b", "c"}) {
+    t.Fatalf("Addrs(kvpaxos) %v", Addrs(c.KVPaxos))
+  }
+  if !reflect.DeepEqual(c.Groups[100], []Server{{"g-0", "g-0.d"}, {"g-1", ""}}) {
+    t.Fatalf("groups %v", c.Groups)
+  }
+
+  if me, err := Index("kvpaxos", c.KVPaxos, "2"); err != nil || me != 2 {
+    t.Fatalf("Index(2) -> %v, %v", me, err)
+  }
+  for _, arg := range []string{"3", "-1", "x"} {
+    if _, err := Index("kvpaxos", c.KVPaxos, arg); err == nil {
+      t.Fatalf("Index(%v) succeeded", arg)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Bad configs are rejected ...\n")
+
+  bad := []string{
+    `{"kvpaxos": [`,
+    `{"backend": "zab"}`,
+    `{"groups": {"0": ["g-0"]}}`,
+    `{"groups": {"100": []}}`,
+    `{"kvpaxos": [{"dir": "d"}]}`,
+    `{"shardmasters": [7]}`,
+  }
+  for _, data := range bad {
+    if _, err := Load(write(t, data)); err == nil {
+      t.Fatalf("Load(%v) succeeded", data)
+    }
+  }
+  if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+    t.Fatalf("Load of a missing file succeeded")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPrepare(t *testing.T) {
+  fmt.Printf("Test: Prepare a data dir ...\n")
+
+  if err := Prepare(Paxos, Server{"a", ""}); err == nil {
+    t.Fatalf("Prepare without a dir succeeded")
+  }
+
+  dir := filepath.Join(t.TempDir(), "a")
+  for i := 0; i < 2; i++ {
+    if err := Prepare(Paxos, Server{"a", dir}); err != nil {
+      t.Fatalf("paxos start %v: %v", i, err)
+    }
+  }
+  if _, err := os.Stat(dir); err != nil {
+    t.Fatalf("dir not made: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Raft and EPaxos replicas do not restart ...\n")
+
+  for _, backend := range []string{Raft, EPaxos} {
+    dir := filepath.Join(t.TempDir(), backend)
+    if err := Prepare(backend, Server{"a", dir}); err != nil {
+      t.Fatalf("%v first start: %v", backend, err)
+    }
+    if err := Prepare(backend, Server{"a", dir}); err == nil {
+      t.Fatalf("%v restart succeeded", backend)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
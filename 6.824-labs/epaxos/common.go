@@ -0,0 +1,126 @@
+package epaxos
+
+//
+// RPC definitions for the EPaxos replicas.
+//
+// an instance is named by the replica that owns it (Rep)
+// and its index in that replica's space (Idx). Seq and
+// Deps are its attributes: Deps[q] is the highest instance
+// of replica q that it depends on, or -1.
+//
+// every message carries the sender's Executed vector, so
+// that each replica learns how far the others have got,
+// and can forget what every replica has executed.
+//
+
+const (
+	OK        = "OK"
+	Reject    = "Reject"
+	Forgotten = "Forgotten"
+)
+
+type Err string
+
+//
+// PreAccept: phase 1. the acceptor adds the interfering
+// instances it knows of to Deps, raises Seq past theirs,
+// and sends back the result.
+//
+type PreAcceptArgs struct {
+	Rep      int
+	Idx      int
+	Ballot   int
+	Cmd      interface{}
+	Seq      int
+	Deps     []int
+	From     int
+	Executed []int
+}
+
+type PreAcceptReply struct {
+	Err      Err
+	Ballot   int // the acceptor's promised ballot, if Reject
+	Seq      int
+	Deps     []int
+	Same     bool // Seq and Deps are as sent
+	Executed []int
+}
+
+//
+// Accept: phase 2, when the replies to PreAccept disagree
+// or when a replica recovers somebody else's instance.
+//
+type AcceptArgs struct {
+	Rep      int
+	Idx      int
+	Ballot   int
+	Cmd      interface{}
+	Seq      int
+	Deps     []int
+	From     int
+	Executed []int
+}
+
+type AcceptReply struct {
+	Err      Err
+	Ballot   int
+	Executed []int
+}
+
+//
+// Commit: the instance is decided; no reply is needed.
+//
+type CommitArgs struct {
+	Rep      int
+	Idx      int
+	Cmd      interface{}
+	Seq      int
+	Deps     []int
+	From     int
+	Executed []int
+}
+
+type CommitReply struct {
+	Executed []int
+}
+
+//
+// Prepare: a replica that wants to finish an instance
+// somebody else started asks for a promise and what each
+// acceptor knows of it (see recover.go).
+//
+type PrepareArgs struct {
+	Rep      int
+	Idx      int
+	Ballot   int
+	From     int
+	Executed []int
+}
+
+type PrepareReply struct {
+	Err      Err
+	Ballot   int
+	Status   int
+	VBallot  int // ballot at which Cmd, Seq and Deps were taken
+	Cmd      interface{}
+	Seq      int
+	Deps     []int
+	Same     bool
+	Executed []int
+}
+
+//
+// Sync: sent now and then to every peer, so that replicas
+// hear of instances they missed, and of each other's
+// progress, even when nothing else is going on.
+//
+type SyncArgs struct {
+	Max      []int // highest instance the sender knows of in each space
+	From     int
+	Executed []int
+}
+
+type SyncReply struct {
+	Max      []int
+	Executed []int
+}
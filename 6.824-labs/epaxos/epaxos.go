@@ -0,0 +1,980 @@
+package epaxos
+
+//
+// Egalitarian Paxos, behind the same application interface
+// as paxos (see paxos.Interface), for services whose
+// commands mostly commute.
+//
+// ep = epaxos.Make(peers []string, me int, rpcs *rpc.Server, keys func(interface{}) []string)
+// ep.Submit(v interface{}) -- get v executed
+// ep.Start(seq int, v interface{}) -- the same; seq is ignored
+// ep.Status(seq int) (executed bool, v interface{})
+// ep.Done(seq int) -- ok to forget the commands executed here up to seq
+// ep.Max() int -- the last command executed here, or -1
+// ep.Min() int -- commands before this one have been forgotten
+// ep.WaitDecided(seq int, timeout) (executed bool, v interface{})
+// ep.Decisions() <-chan paxos.Decision -- commands, as executed here
+//
+// there is no leader. every replica owns a space of
+// instances, and puts the commands submitted to it in
+// instances of its own. two commands interfere if keys()
+// gives them a string in common, or gives either of them
+// All. a replica proposing a command sends along, as its
+// dependencies, the interfering commands it knows of; the
+// others add the ones they know of. if a fast quorum adds
+// nothing, the command is committed after that one round
+// trip; otherwise a second round trip, to a majority,
+// accepts the union of what they added. either way, of two
+// interfering commands, at least one depends on the other.
+//
+// a replica executes a command once the commands it depends
+// on are executed, or are in a cycle of dependencies with
+// it, in which case the cycle goes in order of Seq (see
+// execute.go). so interfering commands execute in the same
+// order everywhere, and others in whatever order they
+// commit. there is no log that the replicas share: the seq
+// of the application interface numbers the commands in the
+// order this replica executed them, which is why Start()
+// ignores it. nor are there snapshots or read indexes:
+// Snapshot() does nothing, and Restore() and ReadIndex()
+// always fail.
+//
+// a replica that finds another's instance stuck short of
+// commit finishes it itself (see recover.go). an instance
+// is forgotten once every replica has executed it. nothing
+// is kept on disk.
+//
+
+import "net"
+import "net/rpc"
+import "transport"
+import "paxos"
+import "log"
+import "sync"
+import "fmt"
+import "math/rand"
+import "time"
+
+// the states of an instance.
+const (
+	none = iota
+	preaccepted
+	accepted
+	committed
+	executed
+)
+
+//
+// how long a proposer keeps trying a peer in each phase,
+// and how long it pauses between tries.
+//
+const phaseWait = 300 * time.Millisecond
+const retryWait = 10 * time.Millisecond
+
+//
+// once a majority has answered PreAccept, how much longer
+// to wait for a fast quorum before going on to Accept.
+//
+const fastWait = 20 * time.Millisecond
+
+//
+// an instance that has not moved for between recoverAfter
+// and 2*recoverAfter is recovered, at most maxRecoveries at
+// a time.
+//
+const recoverAfter = 500 * time.Millisecond
+const maxRecoveries = 10
+
+const syncEvery = 100 * time.Millisecond
+
+type instance struct {
+	cmd     interface{} // nil for a no-op
+	keys    []string
+	seq     int
+	deps    []int
+	status  int
+	ballot  int  // highest ballot promised
+	vballot int  // ballot at which cmd, seq and deps were taken
+	same    bool // pre-accepted at the owner's ballot, as the owner sent it
+	touched time.Time
+	wait    time.Duration // from touched, before recovering it
+}
+
+//
+// the name of an instance.
+//
+type iid struct {
+	rep int
+	idx int
+}
+
+type EPaxos struct {
+	mu         sync.Mutex
+	l          net.Listener
+	dead       bool
+	unreliable bool
+	rpcCount   int
+	fast       int // for testing: my commands committed on the fast path
+	slow       int // and on the slow path
+	peers      []string
+	me         int // index into peers[]
+	keys       func(interface{}) []string
+
+	spaces     []map[int]*instance // spaces[q][i] is instance i of replica q
+	next       int                 // my next instance
+	max        []int               // highest instance known of in each space
+	cut        []int               // instances <= cut[q] of replica q are forgotten
+	conflicts  map[string][]int    // by key, the highest instance in each space
+	seqs       map[string]int      // by key, the highest Seq
+	executed   []int               // instances <= executed[q] of replica q are executed here
+	frontiers  [][]int             // each peer's executed, as last heard
+	pending    map[iid]bool        // committed and not yet executed
+	recovering map[iid]bool
+
+	log  []interface{} // log[i] is the command executed base+i'th here
+	base int
+
+	cond      *sync.Cond // on mu; signalled when instances commit or execute
+	decisions chan paxos.Decision
+	killed    chan bool
+}
+
+//
+// call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if call() was not able to contact the server. in particular,
+// the replys contents are only valid if call() returned true.
+//
+func call(srv string, name string, args interface{}, reply interface{}) bool {
+	c, err := transport.Dial(srv)
+	if err != nil {
+		if !transport.IsUnreachable(err) {
+			fmt.Printf("epaxos Dial() failed: %v\n", err)
+		}
+		return false
+	}
+	defer c.Close()
+
+	err = c.Call(name, args, reply)
+	if err == nil {
+		return true
+	}
+	return false
+}
+
+//
+// call() peer p until it answers, for up to phaseWait. the
+// handler is called directly if p is me.
+//
+func (ep *EPaxos) send(p int, name string, args interface{}, reply interface{}) bool {
+	if p == ep.me {
+		switch name {
+		case "EPaxos.PreAccept":
+			ep.PreAccept(args.(*PreAcceptArgs), reply.(*PreAcceptReply))
+		case "EPaxos.Accept":
+			ep.Accept(args.(*AcceptArgs), reply.(*AcceptReply))
+		case "EPaxos.Prepare":
+			ep.Prepare(args.(*PrepareArgs), reply.(*PrepareReply))
+		}
+		return true
+	}
+	deadline := time.Now().Add(phaseWait)
+	for ep.dead == false {
+		if call(ep.peers[p], name, args, reply) {
+			return true
+		}
+		if !time.Now().Add(retryWait).Before(deadline) {
+			break
+		}
+		time.Sleep(retryWait)
+	}
+	return false
+}
+
+func (ep *EPaxos) majority() int {
+	return len(ep.peers)/2 + 1
+}
+
+//
+// 2F of the N = 2F+1 replicas, and never less than a
+// majority.
+//
+func (ep *EPaxos) fastQuorum() int {
+	f := 2 * ((len(ep.peers) - 1) / 2)
+	if f < ep.majority() {
+		return ep.majority()
+	}
+	return f
+}
+
+//
+// ballots are numbered so that each belongs to one replica;
+// an instance starts out at its owner's lowest one.
+//
+func (ep *EPaxos) nextBallot(b int) int {
+	return (b/len(ep.peers)+1)*len(ep.peers) + ep.me
+}
+
+func (ep *EPaxos) initial(b int) bool {
+	return b < len(ep.peers)
+}
+
+func (ep *EPaxos) noDeps() []int {
+	deps := make([]int, len(ep.peers))
+	for q := range deps {
+		deps[q] = -1
+	}
+	return deps
+}
+
+func sameDeps(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (ep *EPaxos) copyExecuted() []int {
+	executed := make([]int, len(ep.executed))
+	copy(executed, ep.executed)
+	return executed
+}
+
+//
+// instance i of replica q, made up if it is not known yet.
+// nil if it is forgotten. ep.mu must be held.
+//
+func (ep *EPaxos) inst(q int, i int) *instance {
+	if i <= ep.cut[q] {
+		return nil
+	}
+	in, ok := ep.spaces[q][i]
+	if !ok {
+		in = &instance{ballot: q, vballot: -1, deps: ep.noDeps()}
+		ep.touch(in)
+		ep.spaces[q][i] = in
+		if i > ep.max[q] {
+			ep.max[q] = i
+		}
+	}
+	return in
+}
+
+//
+// in has just moved; hold off recovering it.
+//
+func (ep *EPaxos) touch(in *instance) {
+	in.touched = time.Now()
+	in.wait = recoverAfter + time.Duration(rand.Int63n(int64(recoverAfter)))
+}
+
+//
+// fold in peer p's Executed vector, and forget whatever
+// every replica has now executed. ep.mu must be held.
+//
+func (ep *EPaxos) heard(p int, executed []int) {
+	if p < 0 || p >= len(ep.peers) || p == ep.me {
+		return
+	}
+	for q := 0; q < len(executed) && q < len(ep.peers); q++ {
+		if executed[q] > ep.frontiers[p][q] {
+			ep.frontiers[p][q] = executed[q]
+		}
+		if executed[q] > ep.max[q] {
+			ep.max[q] = executed[q]
+		}
+	}
+	ep.forget()
+}
+
+//
+// the keys of cmd; none for a no-op.
+//
+func (ep *EPaxos) keysOf(cmd interface{}) []string {
+	if cmd == nil {
+		return nil
+	}
+	return ep.keys(cmd)
+}
+
+//
+// a command that keys() says has key All interferes with
+// every other, as for a read of a whole range of keys.
+//
+const All = "\x00all"
+
+func hasAll(keys []string) bool {
+	for _, key := range keys {
+		if key == All {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// whether two instances interfere.
+//
+func interfere(a *instance, b *instance) bool {
+	if hasAll(a.keys) || hasAll(b.keys) {
+		return a.cmd != nil && b.cmd != nil
+	}
+	for _, x := range a.keys {
+		for _, y := range b.keys {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// seq and deps, raised to cover the interfering instances
+// this replica knows of. ep.mu must be held.
+//
+func (ep *EPaxos) attributes(cmd interface{}, seq int, deps []int) (int, []int) {
+	out := ep.noDeps()
+	copy(out, deps)
+	keys := ep.keysOf(cmd)
+	if hasAll(keys) {
+		keys = nil
+		for key := range ep.conflicts {
+			keys = append(keys, key)
+		}
+	} else if cmd != nil {
+		keys = append(keys[:len(keys):len(keys)], All)
+	}
+	for _, key := range keys {
+		if c, ok := ep.conflicts[key]; ok {
+			for q := range out {
+				if c[q] > out[q] {
+					out[q] = c[q]
+				}
+			}
+		}
+		if s, ok := ep.seqs[key]; ok && s+1 > seq {
+			seq = s + 1
+		}
+	}
+	return seq, out
+}
+
+//
+// take on cmd, seq and deps for instance i of replica q,
+// and note them for the attributes of commands to come.
+// ep.mu must be held.
+//
+func (ep *EPaxos) take(in *instance, q int, i int, cmd interface{}, seq int, deps []int) {
+	in.cmd = cmd
+	in.seq = seq
+	in.deps = ep.noDeps()
+	copy(in.deps, deps)
+	for r, j := range in.deps {
+		if r < len(ep.max) && j > ep.max[r] {
+			ep.max[r] = j
+		}
+	}
+	in.keys = ep.keysOf(cmd)
+	for _, key := range in.keys {
+		c, ok := ep.conflicts[key]
+		if !ok {
+			c = ep.noDeps()
+			ep.conflicts[key] = c
+		}
+		if i > c[q] {
+			c[q] = i
+		}
+		if s, ok := ep.seqs[key]; !ok || seq > s {
+			ep.seqs[key] = seq
+		}
+	}
+}
+
+//
+// instance i of replica q is decided. ep.mu must be held.
+//
+func (ep *EPaxos) commit(q int, i int, cmd interface{}, seq int, deps []int) {
+	in := ep.inst(q, i)
+	if in == nil || in.status >= committed {
+		return
+	}
+	ep.take(in, q, i, cmd, seq, deps)
+	in.status = committed
+	ep.pending[iid{q, i}] = true
+	ep.touch(in)
+	ep.cond.Broadcast()
+}
+
+//
+// commit instance i of replica q here, and tell the others.
+//
+func (ep *EPaxos) decide(q int, i int, cmd interface{}, seq int, deps []int) {
+	ep.mu.Lock()
+	ep.commit(q, i, cmd, seq, deps)
+	args := &CommitArgs{q, i, cmd, seq, deps, ep.me, ep.copyExecuted()}
+	ep.mu.Unlock()
+
+	for p := range ep.peers {
+		if p != ep.me {
+			go func(p int) {
+				var reply CommitReply
+				if call(ep.peers[p], "EPaxos.Commit", args, &reply) {
+					ep.mu.Lock()
+					ep.heard(p, reply.Executed)
+					ep.mu.Unlock()
+				}
+			}(p)
+		}
+	}
+}
+
+//
+// PreAccept RPC handler.
+//
+func (ep *EPaxos) PreAccept(args *PreAcceptArgs, reply *PreAcceptReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.heard(args.From, args.Executed)
+	reply.Executed = ep.copyExecuted()
+
+	in := ep.inst(args.Rep, args.Idx)
+	if in == nil {
+		reply.Err = Forgotten
+		return nil
+	}
+	reply.Ballot = in.ballot
+	if in.status == preaccepted && in.vballot == args.Ballot {
+		// a repeat.
+		reply.Err = OK
+		reply.Seq = in.seq
+		reply.Deps = in.deps
+		reply.Same = in.same
+		return nil
+	}
+	if args.Ballot < in.ballot || in.status >= committed ||
+		(in.status == accepted && args.Ballot <= in.vballot) {
+		reply.Err = Reject
+		return nil
+	}
+
+	seq, deps := ep.attributes(args.Cmd, args.Seq, args.Deps)
+	ep.take(in, args.Rep, args.Idx, args.Cmd, seq, deps)
+	in.status = preaccepted
+	in.ballot = args.Ballot
+	in.vballot = args.Ballot
+	in.same = ep.initial(args.Ballot) && seq == args.Seq && sameDeps(deps, args.Deps)
+	ep.touch(in)
+
+	reply.Err = OK
+	reply.Ballot = in.ballot
+	reply.Seq = seq
+	reply.Deps = deps
+	reply.Same = in.same
+	return nil
+}
+
+//
+// Accept RPC handler.
+//
+func (ep *EPaxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.heard(args.From, args.Executed)
+	reply.Executed = ep.copyExecuted()
+
+	in := ep.inst(args.Rep, args.Idx)
+	if in == nil {
+		reply.Err = Forgotten
+		return nil
+	}
+	if in.status >= committed {
+		reply.Err = OK
+		return nil
+	}
+	if args.Ballot < in.ballot {
+		reply.Err = Reject
+		reply.Ballot = in.ballot
+		return nil
+	}
+
+	ep.take(in, args.Rep, args.Idx, args.Cmd, args.Seq, args.Deps)
+	in.status = accepted
+	in.ballot = args.Ballot
+	in.vballot = args.Ballot
+	in.same = false
+	ep.touch(in)
+
+	reply.Err = OK
+	reply.Ballot = in.ballot
+	return nil
+}
+
+//
+// Commit RPC handler.
+//
+func (ep *EPaxos) Commit(args *CommitArgs, reply *CommitReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.heard(args.From, args.Executed)
+	ep.commit(args.Rep, args.Idx, args.Cmd, args.Seq, args.Deps)
+	reply.Executed = ep.copyExecuted()
+	return nil
+}
+
+//
+// Sync RPC handler.
+//
+func (ep *EPaxos) Sync(args *SyncArgs, reply *SyncReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.heard(args.From, args.Executed)
+	ep.learn(args.Max)
+	reply.Max = append([]int(nil), ep.max...)
+	reply.Executed = ep.copyExecuted()
+	return nil
+}
+
+//
+// raise max to cover another replica's. ep.mu must be held.
+//
+func (ep *EPaxos) learn(max []int) {
+	for q := 0; q < len(max) && q < len(ep.max); q++ {
+		if max[q] > ep.max[q] {
+			ep.max[q] = max[q]
+		}
+	}
+}
+
+//
+// tell every peer what I know, and hear what they know.
+//
+func (ep *EPaxos) sync() {
+	ep.mu.Lock()
+	args := &SyncArgs{append([]int(nil), ep.max...), ep.me, ep.copyExecuted()}
+	ep.mu.Unlock()
+
+	for p := range ep.peers {
+		if p != ep.me {
+			go func(p int) {
+				var reply SyncReply
+				if call(ep.peers[p], "EPaxos.Sync", args, &reply) {
+					ep.mu.Lock()
+					ep.heard(p, reply.Executed)
+					ep.learn(reply.Max)
+					ep.mu.Unlock()
+				}
+			}(p)
+		}
+	}
+}
+
+//
+// propose cmd in my instance idx.
+//
+func (ep *EPaxos) propose(idx int, cmd interface{}) {
+	ep.mu.Lock()
+	args := &PreAcceptArgs{Rep: ep.me, Idx: idx, Ballot: ep.me, Cmd: cmd,
+		Deps: ep.noDeps(), From: ep.me, Executed: ep.copyExecuted()}
+	ep.mu.Unlock()
+	ep.preAccept(args, true)
+}
+
+//
+// phase 1 at args.Ballot, on me first and then on the
+// others; then commit if fast is set and a fast quorum
+// agreed, or else go on to phase 2.
+//
+func (ep *EPaxos) preAccept(args *PreAcceptArgs, fast bool) {
+	var mine PreAcceptReply
+	ep.PreAccept(args, &mine)
+	if mine.Err != OK {
+		return
+	}
+	args.Seq = mine.Seq
+	args.Deps = mine.Deps
+
+	ch := make(chan *PreAcceptReply, len(ep.peers))
+	for p := range ep.peers {
+		if p != ep.me {
+			go func(p int) {
+				reply := &PreAcceptReply{}
+				if ep.send(p, "EPaxos.PreAccept", args, reply) {
+					ep.mu.Lock()
+					ep.heard(p, reply.Executed)
+					ep.mu.Unlock()
+					ch <- reply
+				} else {
+					ch <- nil
+				}
+			}(p)
+		}
+	}
+
+	oks, same := 1, 1
+	seq, deps := args.Seq, append([]int(nil), args.Deps...)
+	var timeout <-chan time.Time
+	for answered := 1; answered < len(ep.peers); {
+		select {
+		case reply := <-ch:
+			answered++
+			if reply == nil {
+				continue
+			}
+			if reply.Err != OK {
+				ep.outbid(args.Rep, args.Idx, reply.Ballot)
+				return
+			}
+			oks++
+			if reply.Same {
+				same++
+			}
+			if reply.Seq > seq {
+				seq = reply.Seq
+			}
+			for q := range deps {
+				if q < len(reply.Deps) && reply.Deps[q] > deps[q] {
+					deps[q] = reply.Deps[q]
+				}
+			}
+		case <-timeout:
+			answered = len(ep.peers)
+		}
+		if fast && same >= ep.fastQuorum() {
+			ep.fastCommit(args)
+			return
+		}
+		if oks >= ep.majority() {
+			if !fast {
+				break
+			}
+			if timeout == nil {
+				timeout = time.After(fastWait)
+			}
+		}
+	}
+	if oks < ep.majority() {
+		// left for recovery.
+		return
+	}
+	if fast {
+		ep.mu.Lock()
+		ep.slow++
+		ep.mu.Unlock()
+	}
+	ep.accept(&AcceptArgs{Rep: args.Rep, Idx: args.Idx, Ballot: args.Ballot,
+		Cmd: args.Cmd, Seq: seq, Deps: deps})
+}
+
+//
+// a fast quorum pre-accepted args as sent: commit, unless
+// I have since promised somebody recovering the instance
+// not to.
+//
+func (ep *EPaxos) fastCommit(args *PreAcceptArgs) {
+	ep.mu.Lock()
+	in := ep.inst(args.Rep, args.Idx)
+	ok := in != nil && in.ballot == args.Ballot && in.status == preaccepted
+	if ok {
+		ep.fast++
+	}
+	ep.mu.Unlock()
+	if ok {
+		ep.decide(args.Rep, args.Idx, args.Cmd, args.Seq, args.Deps)
+	}
+}
+
+//
+// phase 2: commit if a majority accepts.
+//
+func (ep *EPaxos) accept(args *AcceptArgs) bool {
+	ep.mu.Lock()
+	args.From = ep.me
+	args.Executed = ep.copyExecuted()
+	ep.mu.Unlock()
+
+	ch := make(chan *AcceptReply, len(ep.peers))
+	for p := range ep.peers {
+		go func(p int) {
+			reply := &AcceptReply{}
+			if ep.send(p, "EPaxos.Accept", args, reply) {
+				ep.mu.Lock()
+				ep.heard(p, reply.Executed)
+				ep.mu.Unlock()
+				ch <- reply
+			} else {
+				ch <- nil
+			}
+		}(p)
+	}
+
+	oks := 0
+	for answered := 0; answered < len(ep.peers); answered++ {
+		reply := <-ch
+		if reply == nil {
+			continue
+		}
+		if reply.Err == OK {
+			oks++
+			if oks >= ep.majority() {
+				ep.decide(args.Rep, args.Idx, args.Cmd, args.Seq, args.Deps)
+				return true
+			}
+		} else {
+			ep.outbid(args.Rep, args.Idx, reply.Ballot)
+		}
+	}
+	return false
+}
+
+//
+// somebody has promised ballot b for instance i of replica
+// q; the next recovery has to go higher.
+//
+func (ep *EPaxos) outbid(q int, i int, b int) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if in := ep.inst(q, i); in != nil && b > in.ballot {
+		in.ballot = b
+		ep.touch(in)
+	}
+}
+
+//
+// sync now and then, and recover instances that are
+// stuck.
+//
+func (ep *EPaxos) ticker() {
+	var synced time.Time
+	for ep.dead == false {
+		if time.Since(synced) >= syncEvery {
+			synced = time.Now()
+			ep.sync()
+		}
+		ep.mu.Lock()
+		for q := range ep.peers {
+			for i := ep.executed[q] + 1; i <= ep.max[q] && len(ep.recovering) < maxRecoveries; i++ {
+				in := ep.inst(q, i)
+				id := iid{q, i}
+				if in == nil || in.status >= committed || ep.recovering[id] {
+					continue
+				}
+				if time.Since(in.touched) >= in.wait {
+					ep.recovering[id] = true
+					go ep.recover(q, i)
+				}
+			}
+		}
+		ep.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// the application wants v executed. Submit() returns
+// right away; v shows up in Status() and Decisions() once
+// it has been executed here.
+//
+func (ep *EPaxos) Submit(v interface{}) {
+	ep.mu.Lock()
+	idx := ep.next
+	ep.next++
+	ep.mu.Unlock()
+
+	go ep.propose(idx, v)
+}
+
+//
+// Submit(v); the replicas share no numbering that seq
+// could refer to.
+//
+func (ep *EPaxos) Start(seq int, v interface{}) {
+	ep.Submit(v)
+}
+
+//
+// whether this replica has executed a seq'th command,
+// and if so which.
+//
+func (ep *EPaxos) Status(seq int) (bool, interface{}) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if seq < ep.base || seq >= ep.base+len(ep.log) {
+		return false, nil
+	}
+	return true, ep.log[seq-ep.base]
+}
+
+//
+// the application on this machine is done with the
+// commands executed here up to seq.
+//
+func (ep *EPaxos) Done(seq int) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if seq >= ep.base+len(ep.log) {
+		seq = ep.base + len(ep.log) - 1
+	}
+	if seq >= ep.base {
+		ep.log = append([]interface{}(nil), ep.log[seq+1-ep.base:]...)
+		ep.base = seq + 1
+		ep.cond.Broadcast()
+	}
+}
+
+//
+// the last command executed here, or -1.
+//
+func (ep *EPaxos) Max() int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	return ep.base + len(ep.log) - 1
+}
+
+//
+// one more than the highest Done() argument here; unlike
+// in paxos, the other replicas do not come into it.
+//
+func (ep *EPaxos) Min() int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	return ep.base
+}
+
+//
+// there are no snapshots; the replicas keep every instance
+// until all of them have executed it.
+//
+func (ep *EPaxos) Snapshot(seq int, state []byte) {
+}
+
+func (ep *EPaxos) Restore(seq int) (int, []byte, bool) {
+	return 0, nil, false
+}
+
+//
+// a replica cannot vouch for having executed everything
+// that came before a read; reads have to be submitted.
+//
+func (ep *EPaxos) ReadIndex() (int, bool) {
+	return -1, false
+}
+
+//
+// tell the peer to shut itself down.
+// for testing.
+//
+func (ep *EPaxos) Kill() {
+	ep.dead = true
+	if ep.l != nil {
+		ep.l.Close()
+	}
+	ep.mu.Lock()
+	select {
+	case <-ep.killed:
+	default:
+		close(ep.killed)
+	}
+	ep.cond.Broadcast()
+	ep.mu.Unlock()
+}
+
+//
+// the application wants to create an epaxos replica.
+// the ports of all the replicas (including this one)
+// are in peers[]. this servers port is peers[me].
+// commands for which keys() returns some same string
+// interfere, and are executed in the same order on every
+// replica.
+//
+func Make(peers []string, me int, rpcs *rpc.Server, keys func(interface{}) []string) *EPaxos {
+	ep := &EPaxos{}
+	ep.peers = peers
+	ep.me = me
+	ep.keys = keys
+
+	n := len(peers)
+	ep.spaces = make([]map[int]*instance, n)
+	ep.max = make([]int, n)
+	ep.cut = make([]int, n)
+	ep.executed = make([]int, n)
+	ep.frontiers = make([][]int, n)
+	for q := 0; q < n; q++ {
+		ep.spaces[q] = make(map[int]*instance)
+		ep.max[q] = -1
+		ep.cut[q] = -1
+		ep.executed[q] = -1
+		ep.frontiers[q] = ep.noDeps()
+	}
+	ep.conflicts = make(map[string][]int)
+	ep.seqs = make(map[string]int)
+	ep.pending = make(map[iid]bool)
+	ep.recovering = make(map[iid]bool)
+	ep.cond = sync.NewCond(&ep.mu)
+	ep.killed = make(chan bool)
+
+	go ep.ticker()
+	go ep.executor()
+
+	if rpcs != nil {
+		// caller will create socket &c
+		rpcs.Register(ep)
+	} else {
+		rpcs = rpc.NewServer()
+		rpcs.Register(ep)
+
+		// prepare to receive connections from clients.
+		// the address says which transport to use.
+		l, e := transport.Listen(peers[me])
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		ep.l = l
+
+		// create a thread to accept RPC connections
+		go func() {
+			for ep.dead == false {
+				conn, err := ep.l.Accept()
+				if err == nil && ep.dead == false {
+					if ep.unreliable && (rand.Int63()%1000) < 100 {
+						// discard the request.
+						conn.Close()
+					} else if ep.unreliable && (rand.Int63()%1000) < 200 {
+						// process the request but force discard of reply.
+						conn = transport.DiscardReply(conn)
+						ep.rpcCount++
+						go rpcs.ServeConn(conn)
+					} else {
+						ep.rpcCount++
+						go rpcs.ServeConn(conn)
+					}
+				} else if err == nil {
+					conn.Close()
+				}
+				if err != nil && ep.dead == false {
+					fmt.Printf("EPaxos(%v) accept: %v\n", me, err.Error())
+				}
+			}
+		}()
+	}
+
+	return ep
+}
@@ -0,0 +1,169 @@
+package epaxos
+
+//
+// execution.
+//
+// committed instances and their dependencies form a graph.
+// an instance depends on every instance of replica q up to
+// Deps[q] that shares a key with it, and since which those are
+// is not known until they commit, it waits for all of them
+// to commit. the graph is then cut into strongly connected
+// components (Tarjan), which come out dependencies first;
+// each goes in order of Seq, ties broken by replica and
+// instance. every replica commits the same attributes and
+// so builds the same graph over interfering commands, and
+// executes them in the same order.
+//
+// executed[q] is how far replica q's space is executed
+// without gaps. every message carries it, and an instance
+// that every replica has executed is forgotten.
+//
+
+import "sort"
+
+//
+// Tarjan's algorithm, from one root.
+//
+type tarjan struct {
+	index map[iid]int
+	low   map[iid]int
+	stack []iid
+	on    map[iid]bool
+	n     int
+}
+
+//
+// execute whatever committed instances can be.
+//
+func (ep *EPaxos) executor() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	for ep.dead == false {
+		n := len(ep.pending)
+		ids := make([]iid, 0, n)
+		for id := range ep.pending {
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			if ep.pending[id] {
+				t := &tarjan{index: make(map[iid]int), low: make(map[iid]int), on: make(map[iid]bool)}
+				ep.visit(t, id)
+			}
+		}
+		// executing some may have unblocked others.
+		if len(ep.pending) == n {
+			ep.cond.Wait()
+		}
+	}
+}
+
+//
+// the Tarjan visit of v; false if v depends, however
+// indirectly, on an instance that is not committed yet.
+// ep.mu must be held.
+//
+func (ep *EPaxos) visit(t *tarjan, v iid) bool {
+	t.index[v] = t.n
+	t.low[v] = t.n
+	t.n++
+	t.stack = append(t.stack, v)
+	t.on[v] = true
+
+	in := ep.spaces[v.rep][v.idx]
+	for q := range ep.peers {
+		for j := ep.executed[q] + 1; j <= in.deps[q]; j++ {
+			w := iid{q, j}
+			if w == v {
+				continue
+			}
+			win, ok := ep.spaces[q][j]
+			if !ok || win.status < committed {
+				return false
+			}
+			if win.status == executed || win.cmd == nil || !interfere(win, in) {
+				continue
+			}
+			if _, seen := t.index[w]; !seen {
+				if !ep.visit(t, w) {
+					return false
+				}
+				if t.low[w] < t.low[v] {
+					t.low[v] = t.low[w]
+				}
+			} else if t.on[w] && t.index[w] < t.low[v] {
+				t.low[v] = t.index[w]
+			}
+		}
+	}
+
+	if t.low[v] == t.index[v] {
+		var scc []iid
+		for {
+			w := t.stack[len(t.stack)-1]
+			t.stack = t.stack[:len(t.stack)-1]
+			t.on[w] = false
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		sort.Slice(scc, func(a, b int) bool {
+			x, y := ep.spaces[scc[a].rep][scc[a].idx], ep.spaces[scc[b].rep][scc[b].idx]
+			if x.seq != y.seq {
+				return x.seq < y.seq
+			}
+			if scc[a].rep != scc[b].rep {
+				return scc[a].rep < scc[b].rep
+			}
+			return scc[a].idx < scc[b].idx
+		})
+		for _, w := range scc {
+			ep.exec(w)
+		}
+	}
+	return true
+}
+
+//
+// ep.mu must be held.
+//
+func (ep *EPaxos) exec(id iid) {
+	in := ep.spaces[id.rep][id.idx]
+	in.status = executed
+	delete(ep.pending, id)
+	if in.cmd != nil {
+		ep.log = append(ep.log, in.cmd)
+	}
+	q := id.rep
+	for {
+		next, ok := ep.spaces[q][ep.executed[q]+1]
+		if !ok || next.status != executed {
+			break
+		}
+		ep.executed[q]++
+	}
+	ep.forget()
+	ep.cond.Broadcast()
+}
+
+//
+// forget the instances every replica has executed.
+// ep.mu must be held.
+//
+func (ep *EPaxos) forget() {
+	for q := range ep.peers {
+		bound := ep.executed[q]
+		for p := range ep.peers {
+			if p != ep.me && ep.frontiers[p][q] < bound {
+				bound = ep.frontiers[p][q]
+			}
+		}
+		for i := ep.cut[q] + 1; i <= bound; i++ {
+			delete(ep.spaces[q], i)
+		}
+		if bound > ep.cut[q] {
+			ep.cut[q] = bound
+		}
+	}
+}
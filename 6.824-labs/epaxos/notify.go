@@ -0,0 +1,86 @@
+package epaxos
+
+//
+// blocking and streaming ways to learn about executed
+// commands, as in paxos.
+//
+
+import "paxos"
+import "time"
+
+//
+// wait up to timeout for this replica to execute a seq'th
+// command. returns right away, with false, if seq has been
+// forgotten or the replica is killed.
+//
+func (ep *EPaxos) WaitDecided(seq int, timeout time.Duration) (bool, interface{}) {
+	deadline := time.Now().Add(timeout)
+	t := time.AfterFunc(timeout, func() {
+		ep.mu.Lock()
+		ep.cond.Broadcast()
+		ep.mu.Unlock()
+	})
+	defer t.Stop()
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	for {
+		if seq < ep.base {
+			return false, nil
+		}
+		if seq < ep.base+len(ep.log) {
+			return true, ep.log[seq-ep.base]
+		}
+		if ep.dead || !time.Now().Before(deadline) {
+			return false, nil
+		}
+		ep.cond.Wait()
+	}
+}
+
+//
+// a channel of the commands this replica executes, in
+// order, starting at Min(). the channel is closed when the
+// replica is killed. every call returns the same channel.
+//
+func (ep *EPaxos) Decisions() <-chan paxos.Decision {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.decisions == nil {
+		ep.decisions = make(chan paxos.Decision)
+		go ep.deliver(ep.decisions, ep.base)
+	}
+	return ep.decisions
+}
+
+func (ep *EPaxos) deliver(ch chan paxos.Decision, next int) {
+	defer close(ch)
+
+	for {
+		ep.mu.Lock()
+		var d paxos.Decision
+		for {
+			if ep.dead {
+				ep.mu.Unlock()
+				return
+			} else if next < ep.base {
+				next = ep.base
+			} else if next < ep.base+len(ep.log) {
+				d = paxos.Decision{Seq: next, Value: ep.log[next-ep.base]}
+				next++
+				break
+			} else {
+				ep.cond.Wait()
+			}
+		}
+		ep.mu.Unlock()
+
+		select {
+		case ch <- d:
+		case <-ep.killed:
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package epaxos
+
+//
+// recovery: finishing an instance whose owner has gone
+// quiet, or whose commit never arrived here.
+//
+// the recovering replica picks a ballot higher than any it
+// has seen for the instance, and asks every replica to
+// promise it and say what it holds (Prepare). with a
+// majority of answers in hand, it goes by the first rule
+// that applies:
+//
+// 1. someone has it committed: commit the same here.
+// 2. someone accepted it: accept, at the new ballot, what
+//    was accepted at the highest ballot.
+// 3. the owner did not answer, and enough of the others
+//    pre-accepted it just as the owner sent it that it may
+//    have taken the fast path: accept that.
+// 4. someone pre-accepted it: run phase 1 again at the new
+//    ballot, without the fast path, and then phase 2.
+// 5. nobody has heard of it: accept a no-op.
+//
+// for rule 3: a fast quorum holds the owner and Q-1 of the
+// N-1 others, so of the R others that answer, at least
+// (Q-1) + R - (N-1) were in it. if that many say they
+// pre-accepted the owner's attributes unchanged, those are
+// the attributes the fast path would have committed. and
+// then, with the owner, a majority saw the command before
+// any interfering one that it does not depend on, so every
+// such command depends on it, and accepting the attributes
+// is safe whether or not the fast path was taken.
+//
+
+//
+// what one replica said to Prepare.
+//
+type answer struct {
+	from  int
+	reply *PrepareReply
+}
+
+//
+// Prepare RPC handler.
+//
+func (ep *EPaxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.heard(args.From, args.Executed)
+	reply.Executed = ep.copyExecuted()
+
+	in := ep.inst(args.Rep, args.Idx)
+	if in == nil {
+		reply.Err = Forgotten
+		return nil
+	}
+	if in.status < committed {
+		if args.Ballot < in.ballot {
+			reply.Err = Reject
+			reply.Ballot = in.ballot
+			return nil
+		}
+		in.ballot = args.Ballot
+		ep.touch(in)
+	}
+	reply.Err = OK
+	reply.Ballot = in.ballot
+	reply.Status = in.status
+	reply.VBallot = in.vballot
+	reply.Cmd = in.cmd
+	reply.Seq = in.seq
+	reply.Deps = in.deps
+	reply.Same = in.same
+	return nil
+}
+
+//
+// finish instance i of replica q.
+//
+func (ep *EPaxos) recover(q int, i int) {
+	defer func() {
+		ep.mu.Lock()
+		delete(ep.recovering, iid{q, i})
+		ep.mu.Unlock()
+	}()
+
+	ep.mu.Lock()
+	in := ep.inst(q, i)
+	if in == nil || in.status >= committed {
+		ep.mu.Unlock()
+		return
+	}
+	ep.touch(in)
+	args := &PrepareArgs{q, i, ep.nextBallot(in.ballot), ep.me, ep.copyExecuted()}
+	ep.mu.Unlock()
+
+	ch := make(chan answer, len(ep.peers))
+	for p := range ep.peers {
+		go func(p int) {
+			reply := &PrepareReply{}
+			if ep.send(p, "EPaxos.Prepare", args, reply) {
+				ep.mu.Lock()
+				ep.heard(p, reply.Executed)
+				ep.mu.Unlock()
+				ch <- answer{p, reply}
+			} else {
+				ch <- answer{p, nil}
+			}
+		}(p)
+	}
+
+	var oks []answer
+	for answered := 0; answered < len(ep.peers) && len(oks) < ep.majority(); answered++ {
+		a := <-ch
+		if a.reply == nil {
+			continue
+		}
+		if a.reply.Err == OK {
+			oks = append(oks, a)
+		} else if a.reply.Err == Reject {
+			ep.outbid(q, i, a.reply.Ballot)
+			return
+		}
+	}
+	if len(oks) < ep.majority() {
+		return
+	}
+
+	// rule 1.
+	for _, a := range oks {
+		if r := a.reply; r.Status >= committed {
+			ep.decide(q, i, r.Cmd, r.Seq, r.Deps)
+			return
+		}
+	}
+
+	// rule 2.
+	var best *PrepareReply
+	for _, a := range oks {
+		if r := a.reply; r.Status == accepted && (best == nil || r.VBallot > best.VBallot) {
+			best = r
+		}
+	}
+	if best != nil {
+		ep.accept(&AcceptArgs{Rep: q, Idx: i, Ballot: args.Ballot,
+			Cmd: best.Cmd, Seq: best.Seq, Deps: best.Deps})
+		return
+	}
+
+	// rule 3.
+	owner := false
+	var same *PrepareReply
+	nsame := 0
+	for _, a := range oks {
+		if a.from == q {
+			owner = true
+		} else if r := a.reply; r.Status == preaccepted && r.Same && ep.initial(r.VBallot) {
+			same = r
+			nsame++
+		}
+	}
+	need := (ep.fastQuorum() - 1) + len(oks) - (len(ep.peers) - 1)
+	if !owner && need > 0 && nsame >= need {
+		ep.accept(&AcceptArgs{Rep: q, Idx: i, Ballot: args.Ballot,
+			Cmd: same.Cmd, Seq: same.Seq, Deps: same.Deps})
+		return
+	}
+
+	// rule 4.
+	for _, a := range oks {
+		if r := a.reply; r.Status == preaccepted {
+			ep.mu.Lock()
+			pa := &PreAcceptArgs{Rep: q, Idx: i, Ballot: args.Ballot, Cmd: r.Cmd,
+				Seq: r.Seq, Deps: r.Deps, From: ep.me, Executed: ep.copyExecuted()}
+			ep.mu.Unlock()
+			ep.preAccept(pa, false)
+			return
+		}
+	}
+
+	// rule 5.
+	ep.accept(&AcceptArgs{Rep: q, Idx: i, Ballot: args.Ballot, Deps: ep.noDeps()})
+}
@@ -0,0 +1,418 @@
+package epaxos
+
+import "testing"
+import "runtime"
+import "strconv"
+import "strings"
+import "os"
+import "time"
+import "fmt"
+import "encoding/gob"
+
+//
+// a command: Key says what it interferes with, as a list
+// of keys separated by commas, or "*" for All.
+//
+type cmd struct {
+  Key string
+  N   int
+}
+
+func keysOf(v interface{}) []string {
+  if v.(cmd).Key == "*" {
+    return []string{All}
+  }
+  return strings.Split(v.(cmd).Key, ",")
+}
+
+func init() {
+  gob.Register(cmd{})
+}
+
+func port(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "ep-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+func cleanup(epa []*EPaxos) {
+  for i := 0; i < len(epa); i++ {
+    if epa[i] != nil {
+      epa[i].Kill()
+    }
+  }
+}
+
+func pp(tag string, src int, dst int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  s += "ep-" + tag + "-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += strconv.Itoa(src) + "-"
+  s += strconv.Itoa(dst)
+  return s
+}
+
+func cleanpp(tag string, n int) {
+  for i := 0; i < n; i++ {
+    for j := 0; j < n; j++ {
+      ij := pp(tag, i, j)
+      os.Remove(ij)
+    }
+  }
+}
+
+func part(t *testing.T, tag string, npeers int, p1 []int, p2 []int, p3 []int) {
+  cleanpp(tag, npeers)
+
+  pa := [][]int{p1, p2, p3}
+  for pi := 0; pi < len(pa); pi++ {
+    p := pa[pi]
+    for i := 0; i < len(p); i++ {
+      for j := 0; j < len(p); j++ {
+        ij := pp(tag, p[i], p[j])
+        pj := port(tag, p[j])
+        err := os.Link(pj, ij)
+        if err != nil {
+          t.Fatalf("os.Link(%v, %v): %v\n", pj, ij, err)
+        }
+      }
+    }
+  }
+}
+
+func makeall(tag string, npeers int) []*EPaxos {
+  epa := make([]*EPaxos, npeers)
+  eph := make([]string, npeers)
+  for i := 0; i < npeers; i++ {
+    eph[i] = port(tag, i)
+  }
+  for i := 0; i < npeers; i++ {
+    epa[i] = Make(eph, i, nil, keysOf)
+  }
+  return epa
+}
+
+//
+// replicas that reach each other through pp() links, so
+// that part() can partition them.
+//
+func makepart(tag string, npeers int) []*EPaxos {
+  epa := make([]*EPaxos, npeers)
+  for i := 0; i < npeers; i++ {
+    var eph []string = make([]string, npeers)
+    for j := 0; j < npeers; j++ {
+      if j == i {
+        eph[j] = port(tag, i)
+      } else {
+        eph[j] = pp(tag, i, j)
+      }
+    }
+    epa[i] = Make(eph, i, nil, keysOf)
+  }
+  return epa
+}
+
+//
+// the commands replica ep has executed, in order.
+//
+func history(ep *EPaxos) []cmd {
+  var cmds []cmd
+  for seq := ep.Min(); seq <= ep.Max(); seq++ {
+    if ok, v := ep.Status(seq); ok {
+      cmds = append(cmds, v.(cmd))
+    }
+  }
+  return cmds
+}
+
+//
+// wait until every replica in epa (but the nil ones) has
+// executed n commands, and check that each has executed
+// every command once, and the commands on each key in the
+// same order as the others, and every command after the
+// same commands on All.
+//
+func waitall(t *testing.T, epa []*EPaxos, n int) {
+  for iters := 0; iters < 100; iters++ {
+    done := true
+    for _, ep := range epa {
+      if ep != nil && ep.Max() + 1 < n {
+        done = false
+      }
+    }
+    if done {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  var orders map[string][]int
+  var afters map[cmd]int
+  for i, ep := range epa {
+    if ep == nil {
+      continue
+    }
+    cmds := history(ep)
+    if len(cmds) != n {
+      t.Fatalf("replica %v executed %v commands, expected %v", i, len(cmds), n)
+    }
+    seen := make(map[cmd]bool)
+    order := make(map[string][]int)
+    after := make(map[cmd]int) // how many on All came before
+    alls := 0
+    for _, c := range cmds {
+      if seen[c] {
+        t.Fatalf("replica %v executed %v twice", i, c)
+      }
+      seen[c] = true
+      for _, key := range keysOf(c) {
+        order[key] = append(order[key], c.N)
+      }
+      after[c] = alls
+      if c.Key == "*" {
+        alls++
+      }
+    }
+    if orders == nil {
+      orders = order
+      afters = after
+      continue
+    }
+    for c, n := range after {
+      if afters[c] != n {
+        t.Fatalf("replicas disagree on the order of %v and the commands on All", c)
+      }
+    }
+    for key, ns := range order {
+      if fmt.Sprint(ns) != fmt.Sprint(orders[key]) {
+        t.Fatalf("replicas disagree on the order of %q: %v vs %v", key, ns, orders[key])
+      }
+    }
+  }
+}
+
+func TestBasic(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  epa := makeall("basic", npeers)
+  defer cleanup(epa)
+
+  fmt.Printf("Test: Single proposer ...\n")
+
+  epa[0].Submit(cmd{"a", 0})
+  waitall(t, epa, 1)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Every replica proposes ...\n")
+
+  for i := 0; i < npeers; i++ {
+    epa[i].Submit(cmd{"a", i + 1})
+  }
+  waitall(t, epa, 1 + npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decisions() stream ...\n")
+
+  ch := epa[1].Decisions()
+  for i := 0; i < 1 + npeers; i++ {
+    select {
+    case d := <-ch:
+      if d.Seq != i {
+        t.Fatalf("decision %v has Seq %v", i, d.Seq)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("decision %v did not arrive", i)
+    }
+  }
+  epa[2].Submit(cmd{"b", 0})
+  select {
+  case d := <-ch:
+    if d.Value.(cmd) != (cmd{"b", 0}) {
+      t.Fatalf("wrong decision %v", d.Value)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("new decision did not arrive")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestFastPath(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 5
+  epa := makeall("fast", npeers)
+  defer cleanup(epa)
+
+  fmt.Printf("Test: Commands that commute take one round trip ...\n")
+
+  const ncmds = 20
+  for n := 0; n < ncmds; n++ {
+    for i := 0; i < npeers; i++ {
+      epa[i].Submit(cmd{"k" + strconv.Itoa(i), n})
+    }
+    waitall(t, epa, (n + 1) * npeers)
+  }
+  for i := 0; i < npeers; i++ {
+    epa[i].mu.Lock()
+    fast, slow := epa[i].fast, epa[i].slow
+    epa[i].mu.Unlock()
+    if fast != ncmds || slow != 0 {
+      t.Fatalf("replica %v: %v fast and %v slow commits", i, fast, slow)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Conflicting commands are ordered ...\n")
+
+  for n := 0; n < ncmds; n++ {
+    for i := 0; i < npeers; i++ {
+      epa[i].Submit(cmd{"x", i * 100 + n})
+    }
+  }
+  waitall(t, epa, 2 * ncmds * npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Commands on several keys are ordered with each ...\n")
+
+  for n := 0; n < ncmds; n++ {
+    epa[0].Submit(cmd{"p", 10000 + n})
+    epa[1].Submit(cmd{"q", 20000 + n})
+    epa[2].Submit(cmd{"p,q", 30000 + n})
+    epa[3].Submit(cmd{"q,r", 40000 + n})
+  }
+  waitall(t, epa, 2 * ncmds * npeers + 4 * ncmds)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Commands on All are ordered with every other ...\n")
+
+  for n := 0; n < ncmds; n++ {
+    epa[0].Submit(cmd{"p", 50000 + n})
+    epa[1].Submit(cmd{"*", 60000 + n})
+    epa[2].Submit(cmd{"q", 70000 + n})
+    epa[3].Submit(cmd{"*", 80000 + n})
+    epa[4].Submit(cmd{strconv.Itoa(n), 90000 + n})
+  }
+  waitall(t, epa, 2 * ncmds * npeers + 9 * ncmds)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestForget(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  epa := makeall("forget", npeers)
+  defer cleanup(epa)
+
+  fmt.Printf("Test: Instances every replica executed are forgotten ...\n")
+
+  for n := 0; n < 30; n++ {
+    epa[n % npeers].Submit(cmd{strconv.Itoa(n % 4), n})
+  }
+  waitall(t, epa, 30)
+  for i := 0; i < npeers; i++ {
+    epa[i].Done(epa[i].Max())
+  }
+
+  ok := false
+  for iters := 0; iters < 20 && !ok; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    ok = true
+    for i := 0; i < npeers; i++ {
+      epa[i].mu.Lock()
+      for q := 0; q < npeers; q++ {
+        if len(epa[i].spaces[q]) != 0 {
+          ok = false
+        }
+      }
+      epa[i].mu.Unlock()
+    }
+  }
+  if !ok {
+    t.Fatalf("instances were not forgotten")
+  }
+  for i := 0; i < npeers; i++ {
+    if epa[i].Min() != 30 {
+      t.Fatalf("wrong Min() %v", epa[i].Min())
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRecover(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "recover"
+  const npeers = 5
+  defer cleanpp(tag, npeers)
+  part(t, tag, npeers, []int{}, []int{}, []int{})
+  epa := makepart(tag, npeers)
+  defer cleanup(epa)
+  defer part(t, tag, npeers, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: A command stranded in a minority is recovered ...\n")
+
+  // 0 gets its command to 1 only, and dies.
+  part(t, tag, npeers, []int{0, 1}, []int{2, 3, 4}, []int{})
+  epa[0].Submit(cmd{"a", 0})
+  time.Sleep(100 * time.Millisecond)
+  epa[0].Kill()
+  epa[0] = nil
+
+  // 2's command on the same key depends on it.
+  part(t, tag, npeers, []int{1, 2, 3, 4}, []int{}, []int{})
+  epa[2].Submit(cmd{"a", 1})
+  epa[3].Submit(cmd{"b", 0})
+  waitall(t, epa, 3)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A replica that missed commits catches up ...\n")
+
+  part(t, tag, npeers, []int{1, 2, 3}, []int{4}, []int{})
+  for n := 0; n < 10; n++ {
+    epa[1 + n % 3].Submit(cmd{"c", n})
+  }
+  time.Sleep(time.Second)
+  part(t, tag, npeers, []int{1, 2, 3, 4}, []int{}, []int{})
+  waitall(t, epa, 13)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestUnreliable(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  epa := makeall("unreliable", npeers)
+  defer cleanup(epa)
+  for i := 0; i < npeers; i++ {
+    epa[i].unreliable = true
+  }
+
+  fmt.Printf("Test: Many commands, unreliable ...\n")
+
+  const ncmds = 30
+  for n := 0; n < ncmds; n++ {
+    for i := 0; i < npeers; i++ {
+      epa[i].Submit(cmd{strconv.Itoa(n % 3), i * 100 + n})
+    }
+  }
+  waitall(t, epa, ncmds * npeers)
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,277 @@
+package gateway
+
+//
+// an HTTP/JSON front end to kvpaxos or shardkv, for
+// clients that do not speak Go's net/rpc.
+//
+// GET /kv/{key}                    {"key": ..., "value": ..., "version": ...}
+// PUT /kv/{key}  {"value": ...}    204, once the write is applied
+// GET /range?start=&end=&limit=    {"pairs": [{"key": ..., ...}, ...]}
+// GET /range?prefix=&limit=        the keys that start with prefix
+// GET /watch/{prefix}?from=        one JSON Event per line, as writes
+//                                  are applied, for as long as the
+//                                  client keeps the response open
+//
+// from is the revision to watch after, that of the last
+// event the client saw, or left out to watch for writes
+// from now on.
+//
+// an error is a status code, and a body like
+// {"error": "ErrNoKey", "message": "no such key"}:
+//
+// 400 ErrBadRequest    a malformed request
+// 404 ErrNoKey         the key has no value
+// 404 ErrNotFound      no such endpoint
+// 405 ErrMethod        the endpoint does not take the method
+// 410 ErrCompacted     the servers have forgotten the writes
+//                      after from; watch from now instead
+// 501 ErrNotSupported  the Store has no ranges or watches
+// 503 ErrWrongGroup    no replica group serves the key just
+//                      now; try again
+// 500 ErrInternal      anything else
+//
+// a Get or Put waits for as long as the clerk does, which
+// is forever if the servers are down.
+//
+
+import "net/http"
+import "encoding/json"
+import "strconv"
+import "strings"
+import "time"
+import "kvpaxos"
+
+//
+// a watch waits up to watchStart for a first event before
+// it commits to a 200, so that it can still answer 410 if
+// from turns out to be too old.
+//
+const watchStart = time.Second
+
+type server struct {
+	st Store
+}
+
+//
+// an http.Handler for st; serve it with http.ListenAndServe()
+// or the like.
+//
+func MakeHandler(st Store) http.Handler {
+	s := &server{st}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", s.kv)
+	mux.HandleFunc("/range", s.scan)
+	mux.HandleFunc("/watch/", s.watch)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fail(w, http.StatusNotFound, "ErrNotFound", "no such endpoint")
+	})
+	return mux
+}
+
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func fail(w http.ResponseWriter, status int, code string, message string) {
+	reply(w, status, errorBody{code, message})
+}
+
+//
+// the status and code for an error from the Store.
+//
+func classify(err error) (int, string) {
+	switch err {
+	case ErrNoKey:
+		return http.StatusNotFound, "ErrNoKey"
+	case ErrWrongGroup:
+		return http.StatusServiceUnavailable, "ErrWrongGroup"
+	case ErrCompacted:
+		return http.StatusGone, "ErrCompacted"
+	}
+	return http.StatusInternalServerError, "ErrInternal"
+}
+
+func failWith(w http.ResponseWriter, err error) {
+	status, code := classify(err)
+	if err == ErrWrongGroup {
+		w.Header().Set("Retry-After", "1")
+	}
+	fail(w, status, code, err.Error())
+}
+
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	fail(w, http.StatusMethodNotAllowed, "ErrMethod", r.Method+" not allowed")
+	return false
+}
+
+func (s *server) kv(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "PUT") {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" {
+		fail(w, http.StatusBadRequest, "ErrBadRequest", "missing key")
+		return
+	}
+
+	if r.Method == "GET" {
+		p, err := s.st.Get(key)
+		if err != nil {
+			failWith(w, err)
+			return
+		}
+		reply(w, http.StatusOK, p)
+		return
+	}
+
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		fail(w, http.StatusBadRequest, "ErrBadRequest", `body must be {"value": "..."}`)
+		return
+	}
+	if err := s.st.Put(key, *body.Value); err != nil {
+		failWith(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// a query parameter that has to be a number if present.
+//
+func number(r *http.Request, name string, def int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+func (s *server) scan(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	rg, ok := s.st.(Ranger)
+	if !ok {
+		fail(w, http.StatusNotImplemented, "ErrNotSupported", "this store has no ranges")
+		return
+	}
+	limit, ok := number(r, "limit", 0)
+	if !ok {
+		fail(w, http.StatusBadRequest, "ErrBadRequest", "limit must be a number")
+		return
+	}
+	q := r.URL.Query()
+	start, end := q.Get("start"), q.Get("end")
+	if q.Has("prefix") {
+		if q.Has("start") || q.Has("end") {
+			fail(w, http.StatusBadRequest, "ErrBadRequest", "prefix excludes start and end")
+			return
+		}
+		start, end = q.Get("prefix"), kvpaxos.PrefixEnd(q.Get("prefix"))
+	}
+
+	pairs, err := rg.Scan(start, end, limit)
+	if err != nil {
+		failWith(w, err)
+		return
+	}
+	reply(w, http.StatusOK, struct {
+		Pairs []Pair `json:"pairs"`
+	}{pairs})
+}
+
+func (s *server) watch(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	wt, ok := s.st.(Watcher)
+	if !ok {
+		fail(w, http.StatusNotImplemented, "ErrNotSupported", "this store has no watches")
+		return
+	}
+	from, ok := number(r, "from", kvpaxos.FromNow)
+	if !ok {
+		fail(w, http.StatusBadRequest, "ErrBadRequest", "from must be a revision")
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/watch/")
+
+	events := make(chan Event)
+	stop := make(chan bool)
+	errc := make(chan error, 1)
+	defer close(stop)
+	go func() {
+		errc <- wt.Watch(prefix, from, events, stop)
+	}()
+
+	// hold the status back until the watch has started.
+	var first *Event
+	select {
+	case e := <-events:
+		first = &e
+	case err := <-errc:
+		if err != nil {
+			failWith(w, err)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	case <-time.After(watchStart):
+	case <-r.Context().Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(e Event) bool {
+		if enc.Encode(e) != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if first != nil && !send(*first) {
+		return
+	}
+	for {
+		select {
+		case e := <-events:
+			if !send(e) {
+				return
+			}
+		case err := <-errc:
+			if err != nil {
+				// too late for a status; end with the error.
+				_, code := classify(err)
+				enc.Encode(errorBody{code, err.Error()})
+			}
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package gateway
+
+//
+// what the gateway serves: a Store, and if it can, a
+// Ranger and a Watcher as well. KVPaxos() and ShardKV()
+// make Stores of clerks.
+//
+// a clerk makes one request at a time, so a Store keeps a
+// few, and serves as many requests at once as it has
+// clerks. watches need none.
+//
+
+import "errors"
+import "kvpaxos"
+import "shardkv"
+
+var (
+	ErrNoKey      = errors.New("no such key")
+	ErrWrongGroup = errors.New("no replica group serves the key")
+	ErrCompacted  = errors.New("the servers no longer remember those writes")
+)
+
+type Pair struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version int    `json:"version,omitempty"` // 0 if the Store does not keep versions
+}
+
+type Event struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Revision int    `json:"revision"`
+}
+
+//
+// Get returns ErrNoKey for a key without a value; either
+// call may return ErrWrongGroup.
+//
+type Store interface {
+	Get(key string) (Pair, error)
+	Put(key string, value string) error
+}
+
+//
+// the keys from start up to but not including end ("" for
+// no end), in order, at most limit of them unless limit
+// is 0.
+//
+type Ranger interface {
+	Scan(start string, end string, limit int) ([]Pair, error)
+}
+
+//
+// send the writes to keys that start with prefix, with
+// revisions after from (or kvpaxos.FromNow), to events
+// until stop is closed; or return ErrCompacted once the
+// writes that come next are forgotten.
+//
+type Watcher interface {
+	Watch(prefix string, from int, events chan<- Event, stop <-chan bool) error
+}
+
+type kvStore struct {
+	clerks chan *kvpaxos.Clerk
+	watch  *kvpaxos.Clerk
+}
+
+//
+// a Store, Ranger and Watcher on the kvpaxos servers, with
+// nclerks clerks.
+//
+func KVPaxos(servers []string, nclerks int) Store {
+	s := kvStore{clerks: make(chan *kvpaxos.Clerk, nclerks)}
+	for i := 0; i < nclerks; i++ {
+		s.clerks <- kvpaxos.MakeClerk(servers)
+	}
+	s.watch = kvpaxos.MakeClerk(servers)
+	return s
+}
+
+func (s kvStore) Get(key string) (Pair, error) {
+	ck := <-s.clerks
+	defer func() { s.clerks <- ck }()
+
+	v, version := ck.GetVersion(key)
+	if version == 0 {
+		return Pair{}, ErrNoKey
+	}
+	return Pair{key, v, version}, nil
+}
+
+func (s kvStore) Put(key string, value string) error {
+	ck := <-s.clerks
+	defer func() { s.clerks <- ck }()
+
+	ck.Put(key, value)
+	return nil
+}
+
+func (s kvStore) Scan(start string, end string, limit int) ([]Pair, error) {
+	ck := <-s.clerks
+	defer func() { s.clerks <- ck }()
+
+	pairs := []Pair{}
+	for _, p := range ck.Scan(start, end, limit) {
+		pairs = append(pairs, Pair{p.Key, p.Value, p.Version})
+	}
+	return pairs, nil
+}
+
+func (s kvStore) Watch(prefix string, from int, events chan<- Event, stop <-chan bool) error {
+	w := s.watch.Watch(prefix, from)
+	defer w.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				if w.Err() == kvpaxos.ErrCompacted {
+					return ErrCompacted
+				}
+				return nil
+			}
+			select {
+			case events <- Event{e.Key, e.Value, e.Deleted, e.Version, e.Revision}:
+			case <-stop:
+				return nil
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+type shardStore struct {
+	clerks chan *shardkv.Clerk
+}
+
+//
+// a Store on shardkv, which has neither ranges nor
+// watches, with nclerks clerks that find the replica
+// groups through the shardmasters.
+//
+func ShardKV(shardmasters []string, nclerks int) Store {
+	s := shardStore{make(chan *shardkv.Clerk, nclerks)}
+	for i := 0; i < nclerks; i++ {
+		s.clerks <- shardkv.MakeClerk(shardmasters)
+	}
+	return s
+}
+
+func (s shardStore) Get(key string) (Pair, error) {
+	ck := <-s.clerks
+	defer func() { s.clerks <- ck }()
+
+	v, err := ck.TryGet(key)
+	switch err {
+	case shardkv.ErrNoKey:
+		return Pair{}, ErrNoKey
+	case shardkv.ErrWrongGroup:
+		return Pair{}, ErrWrongGroup
+	}
+	return Pair{Key: key, Value: v}, nil
+}
+
+func (s shardStore) Put(key string, value string) error {
+	ck := <-s.clerks
+	defer func() { s.clerks <- ck }()
+
+	if ck.TryPut(key, value) == shardkv.ErrWrongGroup {
+		return ErrWrongGroup
+	}
+	return nil
+}
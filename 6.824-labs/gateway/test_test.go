@@ -0,0 +1,263 @@
+package gateway
+
+import "testing"
+import "runtime"
+import "strconv"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "strings"
+import "bufio"
+import "io"
+import "kvpaxos"
+
+//
+// how many clusters start() has made. the test cannot kill
+// kvpaxos servers, so each cluster needs addresses of its
+// own, even across -count runs.
+//
+var nclusters int
+
+func start(t *testing.T, tag string) *httptest.Server {
+  const nservers = 3
+  nclusters++
+  var kvh []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = "mem://gw-" + tag + "-" + strconv.Itoa(nclusters) + "-" + strconv.Itoa(i)
+  }
+  for i := 0; i < nservers; i++ {
+    kvpaxos.StartServer(kvh, i)
+  }
+  return httptest.NewServer(MakeHandler(KVPaxos(kvh, 4)))
+}
+
+func do(t *testing.T, method string, url string, body string) (int, http.Header, string) {
+  req, err := http.NewRequest(method, url, strings.NewReader(body))
+  if err != nil {
+    t.Fatalf("%v %v: %v", method, url, err)
+  }
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatalf("%v %v: %v", method, url, err)
+  }
+  defer resp.Body.Close()
+  b, _ := io.ReadAll(resp.Body)
+  return resp.StatusCode, resp.Header, string(b)
+}
+
+//
+// check the status of a request, and if it failed, that
+// the body names the error.
+//
+func expect(t *testing.T, method string, url string, body string, status int, code string) string {
+  got, _, b := do(t, method, url, body)
+  if got != status {
+    t.Fatalf("%v %v -> %v %v, expected %v", method, url, got, b, status)
+  }
+  if code != "" {
+    var e errorBody
+    if err := json.Unmarshal([]byte(b), &e); err != nil || e.Error != code {
+      t.Fatalf("%v %v -> %v, expected error %v", method, url, b, code)
+    }
+  }
+  return b
+}
+
+func TestKV(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := start(t, "kv")
+  defer s.Close()
+
+  fmt.Printf("Test: Get and Put ...\n")
+
+  expect(t, "GET", s.URL + "/kv/a", "", http.StatusNotFound, "ErrNoKey")
+  expect(t, "PUT", s.URL + "/kv/a", `{"value": "x"}`, http.StatusNoContent, "")
+  expect(t, "PUT", s.URL + "/kv/a", `{"value": "y"}`, http.StatusNoContent, "")
+  b := expect(t, "GET", s.URL + "/kv/a", "", http.StatusOK, "")
+  var p Pair
+  if err := json.Unmarshal([]byte(b), &p); err != nil || p != (Pair{"a", "y", 2}) {
+    t.Fatalf("GET /kv/a -> %v, expected a = y, version 2", b)
+  }
+  // keys can have slashes, and values can be empty.
+  expect(t, "PUT", s.URL + "/kv/dir/b", `{"value": ""}`, http.StatusNoContent, "")
+  b = expect(t, "GET", s.URL + "/kv/dir/b", "", http.StatusOK, "")
+  if err := json.Unmarshal([]byte(b), &p); err != nil || p != (Pair{"dir/b", "", 1}) {
+    t.Fatalf("GET /kv/dir/b -> %v", b)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Bad requests ...\n")
+
+  expect(t, "PUT", s.URL + "/kv/a", `y`, http.StatusBadRequest, "ErrBadRequest")
+  expect(t, "PUT", s.URL + "/kv/a", `{"val": "y"}`, http.StatusBadRequest, "ErrBadRequest")
+  expect(t, "GET", s.URL + "/kv/", "", http.StatusBadRequest, "ErrBadRequest")
+  expect(t, "GET", s.URL + "/nothing", "", http.StatusNotFound, "ErrNotFound")
+  _, h, _ := do(t, "DELETE", s.URL + "/kv/a", "")
+  expect(t, "DELETE", s.URL + "/kv/a", "", http.StatusMethodNotAllowed, "ErrMethod")
+  if h.Get("Allow") != "GET, PUT" {
+    t.Fatalf("Allow: %q", h.Get("Allow"))
+  }
+  // none of that wrote anything.
+  b = expect(t, "GET", s.URL + "/kv/a", "", http.StatusOK, "")
+  if err := json.Unmarshal([]byte(b), &p); err != nil || p != (Pair{"a", "y", 2}) {
+    t.Fatalf("GET /kv/a -> %v, expected a = y, version 2", b)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRange(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := start(t, "range")
+  defer s.Close()
+
+  fmt.Printf("Test: Ranges ...\n")
+
+  for _, k := range []string{"b", "a2", "a1", "a3", "c"} {
+    expect(t, "PUT", s.URL + "/kv/" + k, `{"value": "v` + k + `"}`, http.StatusNoContent, "")
+  }
+
+  keys := func(query string) string {
+    b := expect(t, "GET", s.URL + "/range?" + query, "", http.StatusOK, "")
+    var r struct {
+      Pairs []Pair `json:"pairs"`
+    }
+    if err := json.Unmarshal([]byte(b), &r); err != nil || r.Pairs == nil {
+      t.Fatalf("GET /range?%v -> %v", query, b)
+    }
+    var ks []string
+    for _, p := range r.Pairs {
+      if p.Value != "v" + p.Key {
+        t.Fatalf("GET /range?%v -> %v", query, b)
+      }
+      ks = append(ks, p.Key)
+    }
+    return strings.Join(ks, " ")
+  }
+
+  cases := []struct {
+    query string
+    keys string
+  }{
+    {"", "a1 a2 a3 b c"},
+    {"prefix=a", "a1 a2 a3"},
+    {"prefix=a&limit=2", "a1 a2"},
+    {"start=a2&end=c", "a2 a3 b"},
+    {"start=a3", "a3 b c"},
+    {"start=d", ""},
+  }
+  for _, c := range cases {
+    if ks := keys(c.query); ks != c.keys {
+      t.Fatalf("GET /range?%v -> [%v], expected [%v]", c.query, ks, c.keys)
+    }
+  }
+
+  expect(t, "GET", s.URL + "/range?limit=x", "", http.StatusBadRequest, "ErrBadRequest")
+  expect(t, "GET", s.URL + "/range?limit=-1", "", http.StatusBadRequest, "ErrBadRequest")
+  expect(t, "GET", s.URL + "/range?prefix=a&start=b", "", http.StatusBadRequest, "ErrBadRequest")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  s := start(t, "watch")
+  defer s.Close()
+
+  fmt.Printf("Test: Watches stream writes ...\n")
+
+  expect(t, "PUT", s.URL + "/kv/a1", `{"value": "x"}`, http.StatusNoContent, "")
+  expect(t, "PUT", s.URL + "/kv/b", `{"value": "x"}`, http.StatusNoContent, "")
+  expect(t, "PUT", s.URL + "/kv/a2", `{"value": "y"}`, http.StatusNoContent, "")
+
+  resp, err := http.Get(s.URL + "/watch/a?from=0")
+  if err != nil {
+    t.Fatalf("GET /watch/a: %v", err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    t.Fatalf("GET /watch/a -> %v", resp.StatusCode)
+  }
+  lines := bufio.NewScanner(resp.Body)
+  next := func() Event {
+    if !lines.Scan() {
+      t.Fatalf("watch ended: %v", lines.Err())
+    }
+    var e Event
+    if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+      t.Fatalf("watch sent %q: %v", lines.Text(), err)
+    }
+    return e
+  }
+
+  if e := next(); e != (Event{"a1", "x", false, 1, 1}) {
+    t.Fatalf("first event %+v", e)
+  }
+  if e := next(); e != (Event{"a2", "y", false, 1, 3}) {
+    t.Fatalf("second event %+v", e)
+  }
+  expect(t, "PUT", s.URL + "/kv/a1", `{"value": "z"}`, http.StatusNoContent, "")
+  if e := next(); e != (Event{"a1", "z", false, 2, 4}) {
+    t.Fatalf("third event %+v", e)
+  }
+
+  expect(t, "GET", s.URL + "/watch/a?from=x", "", http.StatusBadRequest, "ErrBadRequest")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a Store with neither ranges nor watches, that fails
+// with err.
+//
+type broken struct {
+  err error
+}
+
+func (b broken) Get(key string) (Pair, error) {
+  return Pair{}, b.err
+}
+
+func (b broken) Put(key string, value string) error {
+  return b.err
+}
+
+//
+// a Store whose watches all start too far back.
+//
+type compacted struct {
+  broken
+}
+
+func (c compacted) Watch(prefix string, from int, events chan<- Event, stop <-chan bool) error {
+  return ErrCompacted
+}
+
+func TestErrors(t *testing.T) {
+  fmt.Printf("Test: Store errors become status codes ...\n")
+
+  s := httptest.NewServer(MakeHandler(broken{ErrWrongGroup}))
+  defer s.Close()
+
+  _, h, _ := do(t, "GET", s.URL + "/kv/a", "")
+  expect(t, "GET", s.URL + "/kv/a", "", http.StatusServiceUnavailable, "ErrWrongGroup")
+  if h.Get("Retry-After") == "" {
+    t.Fatalf("ErrWrongGroup without Retry-After")
+  }
+  expect(t, "PUT", s.URL + "/kv/a", `{"value": "x"}`, http.StatusServiceUnavailable, "ErrWrongGroup")
+  expect(t, "GET", s.URL + "/range", "", http.StatusNotImplemented, "ErrNotSupported")
+  expect(t, "GET", s.URL + "/watch/", "", http.StatusNotImplemented, "ErrNotSupported")
+
+  s2 := httptest.NewServer(MakeHandler(compacted{broken{fmt.Errorf("disk on fire")}}))
+  defer s2.Close()
+
+  expect(t, "GET", s2.URL + "/kv/a", "", http.StatusInternalServerError, "ErrInternal")
+  expect(t, "GET", s2.URL + "/watch/a?from=1", "", http.StatusGone, "ErrCompacted")
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,20 +1,45 @@
 package kvpaxos
 
-import "net/rpc"
+import "transport"
 import "time"
+import "sync"
+import "crypto/rand"
+import "math/big"
 
 type Clerk struct {
+	mu      sync.Mutex // one request at a time
 	servers []string
-	// You will have to modify this struct.
+	id      int64 // the servers know this clerk's requests by it
+	seq     int   // requests made so far
 }
 
 func MakeClerk(servers []string) *Clerk {
 	ck := new(Clerk)
 	ck.servers = servers
-	// You'll have to add code here.
+	ck.id = nrand()
 	return ck
 }
 
+//
+// the servers have forgotten this clerk's session, and
+// refused a request as perhaps a retry of one from before;
+// the clerk starts a new session, as if it were new, and
+// makes the request again. that is safe unless the request
+// was applied, and the clerk then went on retrying it for
+// longer than the servers keep an idle session.
+//
+func (ck *Clerk) renew() {
+	ck.id = nrand()
+	ck.seq = 1
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -33,7 +58,7 @@ func MakeClerk(servers []string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
@@ -52,22 +77,36 @@ func call(srv string, rpcname string,
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
-	// You will have to modify this function.
+	v, _ := ck.GetVersion(key)
+	return v
+}
+
+//
+// fetch the current value for a key, and its version.
+// returns "" and 0 if the key does not exist.
+//
+func (ck *Clerk) GetVersion(key string) (string, int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
 
+	ck.seq++
 	for {
 		// try each known server.
 		for _, srv := range ck.servers {
 			args := &GetArgs{}
 			args.Key = key
+			args.Client = ck.id
+			args.Seq = ck.seq
 			var reply GetReply
 			ok := call(srv, "KVPaxos.Get", args, &reply)
 			if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-				return reply.Value
+				return reply.Value, reply.Version
+			} else if ok && reply.Err == ErrSessionExpired {
+				ck.renew()
 			}
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	return ""
 }
 
 //
@@ -75,19 +114,238 @@ func (ck *Clerk) Get(key string) string {
 // keeps trying until it succeeds.
 //
 func (ck *Clerk) Put(key string, value string) {
-	// You will have to modify this function.
+	ck.put(key, value, Put, 0)
+}
+
+//
+// set the value for a key, and have the servers delete
+// it once ttl has passed, unless a Put, Delete or Txn
+// write to it comes first; an Append or PutHash keeps the
+// deadline. another PutWithTTL sets a new one.
+//
+// the servers agree on when ttl has passed by the clock
+// of the log (see Tick in server.go), and remove the key
+// at the same point in it.
+//
+func (ck *Clerk) PutWithTTL(key string, value string, ttl time.Duration) {
+	ck.put(key, value, PutTTL, ttl)
+}
+
+//
+// add value to the end of the key's value, or set it if
+// there is none.
+//
+func (ck *Clerk) Append(key string, value string) {
+	ck.put(key, value, Append, 0)
+}
+
+//
+// remove the key, if it has a value.
+//
+func (ck *Clerk) Delete(key string) {
+	ck.put(key, "", Delete, 0)
+}
 
+//
+// set the key's value to hash(previous value + value),
+// and return the previous value.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+	return ck.put(key, value, PutHash, 0)
+}
+
+//
+// a Put, PutTTL, Append, PutHash or Delete. keeps trying
+// until it succeeds, and returns the previous value for a
+// PutHash.
+//
+func (ck *Clerk) put(key string, value string, kind string, ttl time.Duration) string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
 	for {
 		for _, srv := range ck.servers {
 			args := &PutArgs{}
 			args.Key = key
 			args.Value = value
+			args.Kind = kind
+			args.TTL = ttl
+			args.Client = ck.id
+			args.Seq = ck.seq
 			var reply PutReply
 			ok := call(srv, "KVPaxos.Put", args, &reply)
 			if ok && reply.Err == OK {
-				return
+				return reply.PreviousValue
+			} else if ok && reply.Err == ErrSessionExpired {
+				ck.renew()
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// the keys from start up to but not including end, with
+// their values, in order; see ScanArgs. keeps trying
+// forever in the face of errors.
+//
+func (ck *Clerk) Scan(start string, end string, limit int) []KeyValue {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+	for {
+		for _, srv := range ck.servers {
+			args := &ScanArgs{}
+			args.Start = start
+			args.End = end
+			args.Limit = limit
+			args.Client = ck.id
+			args.Seq = ck.seq
+			var reply ScanReply
+			ok := call(srv, "KVPaxos.Scan", args, &reply)
+			if ok && reply.Err == OK {
+				return reply.Pairs
+			} else if ok && reply.Err == ErrSessionExpired {
+				ck.renew()
 			}
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
 }
+
+//
+// make writes, all at once, if every one of guards holds.
+// returns whether they held. keeps trying until the
+// servers answer.
+//
+func (ck *Clerk) Txn(guards []Guard, writes []Write) bool {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+	for {
+		for _, srv := range ck.servers {
+			args := &TxnArgs{}
+			args.Guards = guards
+			args.Writes = writes
+			args.Client = ck.id
+			args.Seq = ck.seq
+			var reply TxnReply
+			ok := call(srv, "KVPaxos.Txn", args, &reply)
+			if ok && reply.Err == OK {
+				return reply.Succeeded
+			} else if ok && reply.Err == ErrSessionExpired {
+				ck.renew()
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// set the key's value to new if it is old, where a key
+// without a value has value "". returns whether it was.
+//
+func (ck *Clerk) CompareAndSwap(key string, old string, new string) bool {
+	return ck.Txn([]Guard{{Kind: ValueIs, Key: key, Value: old}},
+		[]Write{{Key: key, Value: new}})
+}
+
+//
+// a Watcher reports writes to keys that start with a
+// prefix, in revision order, as the servers apply them.
+//
+type Watcher struct {
+	prefix string
+	from   int // the revision to watch after
+	events chan Event
+	done   chan bool
+	once   sync.Once
+	err    Err
+}
+
+//
+// watch for writes to keys that start with prefix, with
+// revisions after from, or from FromNow. to pick up where
+// an earlier Watcher left off, pass the Revision of the
+// last Event it delivered.
+//
+func (ck *Clerk) Watch(prefix string, from int) *Watcher {
+	w := &Watcher{prefix: prefix, from: from}
+	w.events = make(chan Event)
+	w.done = make(chan bool)
+	go w.poll(ck.servers)
+	return w
+}
+
+//
+// the writes. the channel is closed when Stop() is called,
+// or if the servers no longer remember the writes the
+// Watcher needs next; Err() then says ErrCompacted.
+//
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+//
+// why Events() was closed; only valid once it has been.
+//
+func (w *Watcher) Err() Err {
+	return w.err
+}
+
+func (w *Watcher) Stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+//
+// long-poll the servers, one at a time, moving on to the
+// next whenever one does not answer. every server numbers
+// the writes alike, even on epaxos (see keys() in
+// server.go), so the next one picks up where the last
+// left off.
+//
+func (w *Watcher) poll(servers []string) {
+	defer close(w.events)
+
+	i := 0
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		args := &WatchArgs{}
+		args.Prefix = w.prefix
+		args.From = w.from
+		var reply WatchReply
+		ok := call(servers[i], "KVPaxos.Watch", args, &reply)
+		if ok && reply.Err == ErrCompacted {
+			w.err = ErrCompacted
+			return
+		}
+		if !ok || reply.Err != OK {
+			i = (i + 1) % len(servers)
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			continue
+		}
+
+		for _, e := range reply.Events {
+			select {
+			case w.events <- e:
+			case <-w.done:
+				return
+			}
+		}
+		if reply.Revision > w.from {
+			w.from = reply.Revision
+		}
+	}
+}
@@ -1,28 +1,176 @@
 package kvpaxos
 
+import "hash/fnv"
+import "time"
+
 const (
-	OK       = "OK"
-	ErrNoKey = "ErrNoKey"
+	OK                = "OK"
+	ErrNoKey          = "ErrNoKey"
+	ErrCompacted      = "ErrCompacted"
+	ErrSessionExpired = "ErrSessionExpired"
 )
 
 type Err string
 
+//
+// Client and Seq identify a request: the clerk it comes
+// from, and how many requests that clerk has made. a retry
+// has the same ones, so the servers apply it at most once.
+//
 type PutArgs struct {
-	// You'll have to add definitions here.
-	Key   string
-	Value string
+	Key    string
+	Value  string
+	Kind   string        // Put, PutTTL, Append, PutHash or Delete
+	TTL    time.Duration // for a PutTTL
+	Client int64
+	Seq    int
 }
 
 type PutReply struct {
-	Err Err
+	Err           Err
+	PreviousValue string // for PutHash
 }
 
 type GetArgs struct {
-	// You'll have to add definitions here.
-	Key string
+	Key    string
+	Client int64
+	Seq    int
 }
 
 type GetReply struct {
+	Err     Err
+	Value   string
+	Version int
+}
+
+//
+// the keys from Start up to but not including End, in
+// order; up to End "" means to the last key. Limit, if not
+// 0, is the most keys to return.
+//
+type ScanArgs struct {
+	Start  string
+	End    string
+	Limit  int
+	Client int64
+	Seq    int
+}
+
+type ScanReply struct {
 	Err   Err
-	Value string
+	Pairs []KeyValue
+}
+
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version int
+}
+
+//
+// the End for a Scan of the keys that start with prefix.
+//
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	// every key from prefix on starts with it.
+	return ""
+}
+
+//
+// a key's version counts the writes to it since it was
+// last absent: 0 if it has no value, 1 after the first
+// Put, and so on. a delete sets it back to 0.
+//
+const (
+	ValueIs   = "ValueIs"   // the key's value is Value; "" if it has none
+	Absent    = "Absent"    // the key has no value
+	VersionIs = "VersionIs" // the key's version is Version
+)
+
+//
+// a condition a Txn checks before it writes.
+//
+type Guard struct {
+	Kind    string // ValueIs, Absent or VersionIs
+	Key     string
+	Value   string
+	Version int
+}
+
+//
+// a put, or a delete, that a Txn makes.
+//
+type Write struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+//
+// the Writes are made, all at once, only if every one
+// of the Guards holds.
+//
+type TxnArgs struct {
+	Guards []Guard
+	Writes []Write
+	Client int64
+	Seq    int
+}
+
+type TxnReply struct {
+	Err       Err
+	Succeeded bool // the guards held, and the writes were made
+}
+
+//
+// the servers number the operations that write, in the
+// order the log applies them: a write's revision is one
+// more than the one before. all the writes of a Txn have
+// the same revision.
+//
+// an Event is one write, as a Watch reports it.
+//
+type Event struct {
+	Key      string
+	Value    string
+	Deleted  bool
+	Version  int // the key's, after the write
+	Revision int
+}
+
+//
+// FromNow, as From, watches for writes after whatever the
+// server has applied.
+//
+const FromNow = -1
+
+//
+// wait for writes to keys that start with Prefix with a
+// revision after From. the reply's Revision is where the
+// next Watch should start: the last revision the server
+// has applied, even if nothing was written to Prefix. the
+// Err is ErrCompacted if the server no longer remembers
+// the writes just after From.
+//
+type WatchArgs struct {
+	Prefix string
+	From   int
+}
+
+type WatchReply struct {
+	Err      Err
+	Events   []Event
+	Revision int
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
 }
@@ -0,0 +1,104 @@
+package kvpaxos
+
+//
+// the keys that have values, in order, for Scan. the
+// values stay in kv.data; this is just an index, rebuilt
+// from kv.data after a snapshot is restored.
+//
+// a skiplist: every key is on level 0, and each level up
+// holds about a quarter of the keys of the one below, so
+// a lookup, an insert and a remove take O(log n) steps
+// however many keys there are. the levels come from a
+// generator of the index's own; they only affect speed,
+// so replicas need not agree on them.
+//
+
+import "math/rand"
+
+const maxLevel = 24
+
+type knode struct {
+	key  string
+	next []*knode // the next node on each level
+}
+
+type keyspace struct {
+	head  knode // before the first key, on every level
+	level int   // levels in use
+	rng   *rand.Rand
+}
+
+//
+// the last node before key on each level, and the first
+// node >= key on level 0, if any.
+//
+func (ks *keyspace) search(key string, prev []*knode) *knode {
+	x := &ks.head
+	for l := ks.level - 1; l >= 0; l-- {
+		for x.next[l] != nil && x.next[l].key < key {
+			x = x.next[l]
+		}
+		if prev != nil {
+			prev[l] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (ks *keyspace) insert(key string) {
+	var prev [maxLevel]*knode
+	if x := ks.search(key, prev[:]); x != nil && x.key == key {
+		return
+	}
+	level := 1
+	for level < maxLevel && ks.rng.Intn(4) == 0 {
+		level++
+	}
+	for ; ks.level < level; ks.level++ {
+		prev[ks.level] = &ks.head
+	}
+	x := &knode{key, make([]*knode, level)}
+	for l := 0; l < level; l++ {
+		x.next[l] = prev[l].next[l]
+		prev[l].next[l] = x
+	}
+}
+
+func (ks *keyspace) remove(key string) {
+	var prev [maxLevel]*knode
+	x := ks.search(key, prev[:])
+	if x == nil || x.key != key {
+		return
+	}
+	for l := 0; l < len(x.next); l++ {
+		prev[l].next[l] = x.next[l]
+	}
+	for ks.level > 1 && ks.head.next[ks.level-1] == nil {
+		ks.level--
+	}
+}
+
+//
+// the keys from start up to but not including end ("" for
+// no end), at most limit of them unless limit is 0.
+//
+func (ks *keyspace) scan(start string, end string, limit int) []string {
+	var keys []string
+	for x := ks.search(start, nil); x != nil; x = x.next[0] {
+		if end != "" && x.key >= end || limit > 0 && len(keys) >= limit {
+			break
+		}
+		keys = append(keys, x.key)
+	}
+	return keys
+}
+
+func makeKeyspace(data map[string]entry) *keyspace {
+	ks := &keyspace{level: 1}
+	ks.head.next = make([]*knode, maxLevel)
+	ks.rng = rand.New(rand.NewSource(1))
+	for key := range data {
+		ks.insert(key)
+	}
+	return ks
+}
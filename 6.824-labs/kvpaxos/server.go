@@ -3,18 +3,122 @@ package kvpaxos
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
 import "log"
 import "paxos"
+import "raft"
+import "epaxos"
+import "rsm"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "time"
+import "bytes"
+import "strconv"
+import "strings"
+import "sort"
+
+//
+// hand paxos a snapshot of the key/value state every
+// snapshotEvery instances, so that it can forget the log
+// even if some replica is down.
+//
+const snapshotEvery = 100
+
+//
+// client operations arriving within maxDelay of each other
+// share a paxos instance, up to maxBatch of them, and up to
+// pipelineDepth instances are in flight at once.
+//
+const maxBatch = 100
+const maxDelay = 2 * time.Millisecond
+const pipelineDepth = 4
+
+//
+// a Watch waits up to watchWait for a write before it
+// replies anyway. replicas remember the latest writes for
+// watches, up to watchHistory of them and watchBytes of
+// keys and values, and forget older ones a revision at a
+// time.
+//
+const watchWait = time.Second
+const watchHistory = 1000
+const watchBytes = 4 << 20
+
+//
+// keys with a TTL are deleted by Ticks: ops that carry the
+// clock of the replica that proposed them. the clock of the
+// log is the latest a Tick has carried, and a Tick deletes
+// the keys whose deadlines that reaches, at the same point
+// in the log on every replica. a replica looks every
+// tickEvery for a deadline that has passed, by its own
+// clock, and proposes a Tick once one has for me times
+// tickStagger. so replica 0 usually proposes them alone,
+// and the next one up takes over if it is down. a replica
+// has one Tick in flight at a time: it proposes another for
+// the same deadline only if tickRetry passes without the
+// first one being applied.
+//
+const tickEvery = 100 * time.Millisecond
+const tickStagger = 300 * time.Millisecond
+const tickRetry = 2 * time.Second
+
+const (
+	Get     = "Get"
+	Put     = "Put"
+	PutTTL  = "PutTTL"
+	Append  = "Append"
+	PutHash = "PutHash"
+	Delete  = "Delete"
+	Scan    = "Scan"
+	Txn     = "Txn"
+	Tick    = "Tick"
+)
 
 type Op struct {
-	// Your definitions here.
-	// Field names must start with capital letters,
-	// otherwise RPC will break.
+	Kind   string // Get, Put, PutTTL, Append, PutHash, Delete, Scan, Txn or Tick
+	Key    string // the Start, for a Scan
+	Value  string
+	End    string        // for a Scan
+	Limit  int           // for a Scan
+	TTL    time.Duration // for a PutTTL
+	Time   int64         // for a PutTTL or Tick, the proposer's clock, in ns
+	Guards []Guard       // for a Txn
+	Writes []Write       // for a Txn
+}
+
+//
+// a key's value, its version (see common.go), and when
+// its TTL runs out by the clock of the log, or 0.
+//
+type entry struct {
+	Value    string
+	Version  int
+	Deadline int64
+}
+
+//
+// what a snapshot holds: everything execute() and tick()
+// change. rsm keeps the sessions.
+//
+type state struct {
+	Data      map[string]entry
+	Revision  int
+	History   []Event
+	Compacted int
+	Now       int64
+}
+
+//
+// the outcome of an applied operation, for the handler
+// waiting on it, and for retries.
+//
+type result struct {
+	Err       Err
+	Value     string
+	Version   int
+	Pairs     []KeyValue // for a Scan
+	Succeeded bool       // for a Txn
 }
 
 type KVPaxos struct {
@@ -23,23 +127,454 @@ type KVPaxos struct {
 	me         int
 	dead       bool // for testing
 	unreliable bool // for testing
-	px         *paxos.Paxos
+	px         paxos.Interface
+	rs         *rsm.RSM
+	useRaft    bool   // see Raft()
+	useEPaxos  bool   // see EPaxos()
+	dir        string // see DataDir()
 
-	// Your definitions here.
+	data      map[string]entry
+	keyspace  *keyspace       // kv.data's keys, in order
+	ttls      map[string]bool // the keys with deadlines
+	now       int64           // the clock of the log, as of the last Tick
+	rev       int             // of the last write applied
+	history   []Event         // the latest writes, for watches
+	hbytes    int             // of keys and values in history
+	compacted int             // the last revision forgotten from history
+	cond      *sync.Cond      // on mu, signalled as ops are applied
 }
 
+//
+// a Get is served from local state once this replica has
+// applied everything up to a read index; only if paxos
+// cannot vouch for one does the Get go through the log.
+//
 func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
-	// Your code here.
+	if kv.rs.Read(func() {
+		if e, ok := kv.data[args.Key]; ok {
+			reply.Err = OK
+			reply.Value = e.Value
+			reply.Version = e.Version
+		} else {
+			reply.Err = ErrNoKey
+		}
+	}) {
+		return nil
+	}
+	op := Op{Kind: Get, Key: args.Key}
+	if r, ok := kv.submit(args.Client, args.Seq, op); ok {
+		reply.Err = r.Err
+		reply.Value = r.Value
+		reply.Version = r.Version
+	}
+	return nil
+}
 
+//
+// a Scan, like a Get, is served from local state if paxos
+// vouches for a read index, and otherwise goes through the
+// log.
+//
+func (kv *KVPaxos) Scan(args *ScanArgs, reply *ScanReply) error {
+	if kv.rs.Read(func() {
+		reply.Err = OK
+		reply.Pairs = kv.scan(args.Start, args.End, args.Limit)
+	}) {
+		return nil
+	}
+	op := Op{Kind: Scan, Key: args.Start, End: args.End, Limit: args.Limit}
+	if r, ok := kv.submit(args.Client, args.Seq, op); ok {
+		reply.Err = r.Err
+		reply.Pairs = r.Pairs
+	}
 	return nil
 }
 
+func (kv *KVPaxos) scan(start string, end string, limit int) []KeyValue {
+	var pairs []KeyValue
+	for _, key := range kv.keyspace.scan(start, end, limit) {
+		e := kv.data[key]
+		pairs = append(pairs, KeyValue{key, e.Value, e.Version})
+	}
+	return pairs
+}
+
+//
+// wake up the waiters on kv.cond after d, so that they
+// can notice a deadline.
+//
+func (kv *KVPaxos) wake(d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		kv.mu.Lock()
+		kv.cond.Broadcast()
+		kv.mu.Unlock()
+	})
+}
+
+//
+// a long poll: reply once this replica has applied a
+// write to args.Prefix after args.From, or after
+// watchWait. like a Get served from local state, but
+// without a read index, since events are in revision
+// order anyway, and a watcher only ever asks for those
+// after the last it saw.
+//
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+	deadline := time.Now().Add(watchWait)
+	t := kv.wake(watchWait)
+	defer t.Stop()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	from := args.From
+	if from == FromNow {
+		from = kv.rev
+	}
+	for {
+		if from < kv.compacted {
+			reply.Err = ErrCompacted
+			return nil
+		}
+		if from <= kv.rev {
+			reply.Events = kv.since(args.Prefix, from)
+			if len(reply.Events) > 0 {
+				break
+			}
+		}
+		if kv.dead {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		kv.cond.Wait()
+	}
+	reply.Err = OK
+	reply.Revision = from
+	if kv.rev > from {
+		reply.Revision = kv.rev
+	}
+	return nil
+}
+
+//
+// the remembered writes to prefix after revision from.
+//
+func (kv *KVPaxos) since(prefix string, from int) []Event {
+	i := sort.Search(len(kv.history), func(i int) bool {
+		return kv.history[i].Revision > from
+	})
+	var events []Event
+	for _, e := range kv.history[i:] {
+		if strings.HasPrefix(e.Key, prefix) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
 func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
-	// Your code here.
+	op := Op{Kind: args.Kind, Key: args.Key, Value: args.Value}
+	if args.Kind == PutTTL {
+		op.TTL = args.TTL
+		op.Time = time.Now().UnixNano()
+	}
+	if r, ok := kv.submit(args.Client, args.Seq, op); ok {
+		reply.Err = r.Err
+		reply.PreviousValue = r.Value
+	}
+	return nil
+}
 
+func (kv *KVPaxos) Txn(args *TxnArgs, reply *TxnReply) error {
+	op := Op{Kind: Txn, Guards: args.Guards, Writes: args.Writes}
+	if r, ok := kv.submit(args.Client, args.Seq, op); ok {
+		reply.Err = r.Err
+		reply.Succeeded = r.Succeeded
+	}
 	return nil
 }
 
+//
+// how far this replica's log reaches; see kvctl.
+//
+func (kv *KVPaxos) Status(args *paxos.StatusArgs, reply *paxos.StatusReply) error {
+	reply.Min = kv.px.Min()
+	reply.Max = kv.px.Max()
+	return nil
+}
+
+//
+// get op applied, once for this clerk and seq, and wait
+// for the result. returns false if that takes too long,
+// and the clerk should retry. if the clerk's session has
+// expired, the result says ErrSessionExpired.
+//
+func (kv *KVPaxos) submit(client int64, seq int, op Op) (result, bool) {
+	r, err := kv.rs.Submit(client, seq, op)
+	if err == rsm.ErrSessionExpired {
+		return result{Err: ErrSessionExpired}, true
+	} else if err != nil {
+		return result{}, false
+	}
+	return r.(result), true
+}
+
+//
+// the key/value state, as rsm applies ops to it, with
+// kv.mu held.
+//
+type machine struct {
+	kv *KVPaxos
+}
+
+func (m machine) Apply(v interface{}) interface{} {
+	op := v.(Op)
+	defer m.kv.cond.Broadcast()
+	if op.Kind == Tick {
+		m.kv.tick(op.Time)
+		return nil
+	}
+	return m.kv.execute(op)
+}
+
+func (m machine) Snapshot() []byte {
+	return m.kv.snapshot()
+}
+
+func (m machine) Restore(data []byte) {
+	m.kv.restore(data)
+	m.kv.cond.Broadcast()
+}
+
+//
+// apply op for the first time. for a PutHash, the result
+// holds the previous value.
+//
+func (kv *KVPaxos) execute(op Op) result {
+	var r result
+	switch op.Kind {
+	case Put:
+		kv.rev++
+		kv.put(op.Key, op.Value, 0)
+		r.Err = OK
+	case PutTTL:
+		// by the proposer's clock, not the log's, which
+		// may lag: only Ticks advance that, and their order
+		// with this op is the same everywhere.
+		kv.rev++
+		kv.put(op.Key, op.Value, op.Time+int64(op.TTL))
+		r.Err = OK
+	case Append:
+		kv.rev++
+		e := kv.data[op.Key]
+		kv.put(op.Key, e.Value+op.Value, e.Deadline)
+		r.Err = OK
+	case PutHash:
+		kv.rev++
+		e := kv.data[op.Key]
+		r.Value = e.Value
+		kv.put(op.Key, strconv.Itoa(int(hash(r.Value+op.Value))), e.Deadline)
+		r.Err = OK
+	case Delete:
+		if _, ok := kv.data[op.Key]; ok {
+			kv.rev++
+			kv.delete(op.Key)
+		}
+		r.Err = OK
+	case Scan:
+		r.Pairs = kv.scan(op.Key, op.End, op.Limit)
+		r.Err = OK
+	case Txn:
+		r.Succeeded = kv.holds(op.Guards)
+		written := false
+		for i := 0; r.Succeeded && i < len(op.Writes); i++ {
+			w := op.Writes[i]
+			if _, ok := kv.data[w.Key]; w.Delete && !ok {
+				// as for Delete, nothing to write.
+				continue
+			}
+			if !written {
+				kv.rev++
+				written = true
+			}
+			if w.Delete {
+				kv.delete(w.Key)
+			} else {
+				kv.put(w.Key, w.Value, 0)
+			}
+		}
+		r.Err = OK
+	default:
+		if e, ok := kv.data[op.Key]; ok {
+			r.Err = OK
+			r.Value = e.Value
+			r.Version = e.Version
+		} else {
+			r.Err = ErrNoKey
+		}
+	}
+	return r
+}
+
+//
+// a write, as part of revision kv.rev.
+//
+func (kv *KVPaxos) put(key string, value string, deadline int64) {
+	e, ok := kv.data[key]
+	if !ok {
+		kv.keyspace.insert(key)
+	}
+	if deadline != 0 {
+		kv.ttls[key] = true
+	} else {
+		delete(kv.ttls, key)
+	}
+	e = entry{value, e.Version + 1, deadline}
+	kv.data[key] = e
+	kv.record(Event{Key: key, Value: value, Version: e.Version, Revision: kv.rev})
+}
+
+func (kv *KVPaxos) delete(key string) {
+	delete(kv.data, key)
+	kv.keyspace.remove(key)
+	delete(kv.ttls, key)
+	kv.record(Event{Key: key, Deleted: true, Revision: kv.rev})
+}
+
+//
+// remember e for watches, forgetting the oldest
+// revisions if there are too many.
+//
+func (kv *KVPaxos) record(e Event) {
+	kv.history = append(kv.history, e)
+	kv.hbytes += len(e.Key) + len(e.Value)
+	for len(kv.history) > watchHistory || kv.hbytes > watchBytes {
+		old := kv.history[0].Revision
+		if old == kv.rev {
+			// keep the revision being written.
+			break
+		}
+		for kv.history[0].Revision == old {
+			kv.hbytes -= len(kv.history[0].Key) + len(kv.history[0].Value)
+			kv.history[0] = Event{} // for the garbage collector
+			kv.history = kv.history[1:]
+		}
+		kv.compacted = old
+	}
+}
+
+func (kv *KVPaxos) holds(guards []Guard) bool {
+	for _, g := range guards {
+		e, ok := kv.data[g.Key]
+		switch g.Kind {
+		case ValueIs:
+			if e.Value != g.Value {
+				return false
+			}
+		case Absent:
+			if ok {
+				return false
+			}
+		case VersionIs:
+			if e.Version != g.Version {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//
+// advance the clock of the log to t, and delete the keys
+// whose deadlines it reaches, in order, as one revision.
+//
+func (kv *KVPaxos) tick(t int64) {
+	if t > kv.now {
+		kv.now = t
+	}
+	var expired []string
+	for key := range kv.ttls {
+		if kv.data[key].Deadline <= kv.now {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Strings(expired)
+	kv.rev++
+	for _, key := range expired {
+		kv.delete(key)
+	}
+}
+
+//
+// propose a Tick when a deadline passes; see tickEvery.
+//
+func (kv *KVPaxos) ticker() {
+	var proposed int64 // the deadline of the Tick in flight
+	var at time.Time   // when it was proposed
+	for kv.dead == false {
+		time.Sleep(tickEvery)
+
+		kv.mu.Lock()
+		var first int64
+		for key := range kv.ttls {
+			if d := kv.data[key].Deadline; first == 0 || d < first {
+				first = d
+			}
+		}
+		kv.mu.Unlock()
+
+		now := time.Now().UnixNano()
+		if first != 0 && now >= first+int64(kv.me)*int64(tickStagger) &&
+			(first != proposed || time.Since(at) >= tickRetry) {
+			kv.rs.Propose(Op{Kind: Tick, Time: now})
+			proposed = first
+			at = time.Now()
+		}
+	}
+}
+
+func (kv *KVPaxos) snapshot() []byte {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(state{kv.data, kv.rev, kv.history, kv.compacted, kv.now}); err != nil {
+		log.Fatal("kvpaxos snapshot: ", err)
+	}
+	return b.Bytes()
+}
+
+func (kv *KVPaxos) restore(data []byte) {
+	var st state
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		log.Fatal("kvpaxos restore: ", err)
+	}
+	// gob leaves out empty maps.
+	if st.Data == nil {
+		st.Data = make(map[string]entry)
+	}
+	kv.data = st.Data
+	kv.keyspace = makeKeyspace(kv.data)
+	kv.ttls = make(map[string]bool)
+	for key, e := range kv.data {
+		if e.Deadline != 0 {
+			kv.ttls[key] = true
+		}
+	}
+	kv.now = st.Now
+	kv.rev = st.Revision
+	kv.history = st.History
+	kv.hbytes = 0
+	for _, e := range kv.history {
+		kv.hbytes += len(e.Key) + len(e.Value)
+	}
+	kv.compacted = st.Compacted
+}
+
 // tell the server to shut itself down.
 // please do not change this function.
 func (kv *KVPaxos) kill() {
@@ -48,30 +583,123 @@ func (kv *KVPaxos) kill() {
 	kv.px.Kill()
 }
 
+//
+// Option configures a kvpaxos server; pass any number of
+// them to StartServer().
+//
+type Option func(kv *KVPaxos)
+
+//
+// Raft makes the servers agree on their log with raft
+// instead of paxos. every server has to be given the
+// same option.
+//
+func Raft() Option {
+	return func(kv *KVPaxos) {
+		kv.useRaft = true
+	}
+}
+
+//
+// EPaxos makes the servers agree with epaxos, which has no
+// leader: an operation commits in one round trip unless
+// another server is submitting operations on the same key
+// at the same time. writes all count as on the same key,
+// since every server has to number them alike for Watch.
+// Gets go through epaxos too. every server has to be given
+// the same option.
+//
+func EPaxos() Option {
+	return func(kv *KVPaxos) {
+		kv.useEPaxos = true
+	}
+}
+
+//
+// DataDir keeps the server's paxos log in dir, so it can
+// crash and be started again with the same dir. raft and
+// epaxos keep nothing on disk, and ignore it.
+//
+func DataDir(dir string) Option {
+	return func(kv *KVPaxos) {
+		kv.dir = dir
+	}
+}
+
+//
+// operations on the same key interfere, a Txn with those
+// on any key it guards or writes, and a Scan, or a Tick,
+// which may delete any key, with every other. every write
+// also has revKey, so that writes interfere with each
+// other whatever their keys: each one takes the next
+// revision, and for a Watch to resume on another replica,
+// the replicas have to apply them in the same order.
+// rsm.Keys() adds the clerk's.
+//
+const revKey = "\x00rev"
+
+func keys(v interface{}) []string {
+	op := v.(Op)
+	switch op.Kind {
+	case Tick, Scan:
+		return []string{epaxos.All}
+	case Get:
+		return []string{op.Key}
+	case Txn:
+		ks := []string{revKey}
+		for _, g := range op.Guards {
+			ks = append(ks, g.Key)
+		}
+		for _, w := range op.Writes {
+			ks = append(ks, w.Key)
+		}
+		return ks
+	}
+	return []string{op.Key, revKey}
+}
+
 //
 // servers[] contains the ports of the set of
 // servers that will cooperate via Paxos to
 // form the fault-tolerant key/value service.
 // me is the index of the current server in servers[].
 //
-func StartServer(servers []string, me int) *KVPaxos {
+func StartServer(servers []string, me int, opts ...Option) *KVPaxos {
 	// this call is all that's needed to persuade
 	// Go's RPC library to marshall/unmarshall
 	// struct Op.
 	gob.Register(Op{})
+	gob.Register(result{})
 
 	kv := new(KVPaxos)
 	kv.me = me
-
-	// Your initialization code here.
+	for _, opt := range opts {
+		opt(kv)
+	}
+	kv.data = make(map[string]entry)
+	kv.keyspace = makeKeyspace(nil)
+	kv.ttls = make(map[string]bool)
+	kv.cond = sync.NewCond(&kv.mu)
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(kv)
 
-	kv.px = paxos.Make(servers, me, rpcs)
+	if kv.useRaft {
+		kv.px = raft.Make(servers, me, rpcs)
+	} else if kv.useEPaxos {
+		kv.px = epaxos.Make(servers, me, rpcs, rsm.Keys(keys))
+	} else {
+		popts := []paxos.Option{paxos.Batching(maxBatch, maxDelay),
+			paxos.Pipeline(pipelineDepth), paxos.Leases()}
+		if kv.dir != "" {
+			popts = append(popts, paxos.DataDir(kv.dir))
+		}
+		kv.px = paxos.Make(servers, me, rpcs, popts...)
+	}
+	kv.rs = rsm.Make(kv.px, machine{kv}, &kv.mu, rsm.Snapshots(snapshotEvery))
+	go kv.ticker()
 
-	os.Remove(servers[me])
-	l, e := net.Listen("unix", servers[me])
+	l, e := transport.Listen(servers[me])
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -89,12 +717,7 @@ func StartServer(servers []string, me int) *KVPaxos {
 					conn.Close()
 				} else if kv.unreliable && (rand.Int63()%1000) < 200 {
 					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-					if err != nil {
-						fmt.Printf("shutdown: %v\n", err)
-					}
+					conn = transport.DiscardReply(conn)
 					go rpcs.ServeConn(conn)
 				} else {
 					go rpcs.ServeConn(conn)
@@ -7,8 +7,36 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "strings"
+import "sort"
+import "linearizability"
+import "transport"
+
+//
+// StartServer() options for the run in progress.
+//
+var opts []Option
+
+//
+// run every test on paxos, then again on raft, and again
+// on epaxos.
+//
+func TestMain(m *testing.M) {
+  code := m.Run()
+  if code == 0 {
+    fmt.Printf("Running the tests again on raft ...\n")
+    opts = []Option{Raft()}
+    code = m.Run()
+  }
+  if code == 0 {
+    fmt.Printf("Running the tests again on epaxos ...\n")
+    opts = []Option{EPaxos()}
+    code = m.Run()
+  }
+  os.Exit(code)
+}
 
-func check(t *testing.T, ck *Clerk, key string, value string) {
+func check(t *testing.T, ck linearizability.KV, key string, value string) {
   v := ck.Get(key)
   if v != value {
     t.Fatalf("Get(%v) -> %v, expected %v", key, v, value)
@@ -46,7 +74,7 @@ func TestBasic(t *testing.T) {
     kvh[i] = port("basic", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, opts...)
   }
 
   ck := MakeClerk(kvh)
@@ -115,7 +143,7 @@ func TestDone(t *testing.T) {
     kvh[i] = port("done", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, opts...)
   }
   ck := MakeClerk(kvh)
   var cka [nservers]*Clerk
@@ -231,7 +259,7 @@ func TestPartition(t *testing.T) {
         kvh[j] = pp(tag, i, j)
       }
     }
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, opts...)
   }
   defer part(t, tag, nservers, []int{}, []int{}, []int{})
 
@@ -327,7 +355,7 @@ func TestUnreliable(t *testing.T) {
     kvh[i] = port("un", i)
   }
   for i := 0; i < nservers; i++ {
-    kva[i] = StartServer(kvh, i)
+    kva[i] = StartServer(kvh, i, opts...)
     kva[i].unreliable = true
   }
 
@@ -352,6 +380,7 @@ func TestUnreliable(t *testing.T) {
 
   fmt.Printf("Test: Sequence of puts, unreliable ...\n")
 
+  h := linearizability.MakeHistory()
   for iters := 0; iters < 6; iters++ {
   const ncli = 5
     var ca [ncli]chan bool
@@ -366,7 +395,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := h.Client(MakeClerk(sa))
         key := strconv.Itoa(me)
         myck.Put(key, "0")
         myck.Put(key, "1")
@@ -406,7 +435,7 @@ func TestUnreliable(t *testing.T) {
           j := rand.Intn(i+1)
           sa[i], sa[j] = sa[j], sa[i]
         }
-        myck := MakeClerk(sa)
+        myck := h.Client(MakeClerk(sa))
         if (rand.Int() % 1000) < 500 {
           myck.Put("b", strconv.Itoa(rand.Int()))
         } else {
@@ -420,208 +449,1419 @@ func TestUnreliable(t *testing.T) {
 
     var va [nservers]string
     for i := 0; i < nservers; i++ {
-      va[i] = cka[i].Get("b")
+      va[i] = h.Client(cka[i]).Get("b")
       if va[i] != va[0] {
         t.Fatalf("mismatch; 0 got %v, %v got %v", va[0], i, va[i])
       }
     }
   }
+  if err := h.Check(); err != nil {
+    t.Fatalf("%v", err)
+  }
 
   fmt.Printf("  ... Passed\n")
 
   time.Sleep(1 * time.Second)
 }
 
-func TestHole(t *testing.T) {
-  runtime.GOMAXPROCS(4)
+//
+// send the Put in args to the servers, kvh[i] first, until
+// one answers, and return the answer. it is the same
+// request every time, so the servers apply it at most once.
+// a raft follower does not answer, so try each in turn.
+//
+func sendPut(t *testing.T, kvh []string, i int, args *PutArgs) Err {
+  for iters := 0; iters < 50; iters++ {
+    var reply PutReply
+    srv := kvh[(i + iters) % len(kvh)]
+    if call(srv, "KVPaxos.Put", args, &reply) && reply.Err != "" {
+      return reply.Err
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  t.Fatalf("no answer to %v", *args)
+  return ""
+}
 
-  fmt.Printf("Test: Tolerates holes in paxos sequence ...\n")
+func TestAtMostOnce(t *testing.T) {
+  runtime.GOMAXPROCS(4)
 
-  tag := "hole"
-  const nservers = 5
+  const nservers = 3
   var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
   defer cleanup(kva)
-  defer cleanpp(tag, nservers)
 
   for i := 0; i < nservers; i++ {
-    var kvh []string = make([]string, nservers)
-    for j := 0; j < nservers; j++ {
-      if j == i {
-        kvh[j] = port(tag, i)
-      } else {
-        kvh[j] = pp(tag, i, j)
-      }
-    }
-    kva[i] = StartServer(kvh, i)
+    kvh[i] = port("once", i)
   }
-  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
 
-  for iters := 0; iters < 5; iters++ {
-    part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  fmt.Printf("Test: A late retry is not applied again ...\n")
 
-    ck2 := MakeClerk([]string{port(tag, 2)})
-    ck2.Put("q", "q")
+  args := &PutArgs{Key: "a", Value: "1", Kind: Put, Client: nrand(), Seq: 1}
+  if err := sendPut(t, kvh, 0, args); err != OK {
+    t.Fatalf("Put failed: %v", err)
+  }
+  ck.Put("a", "2")
+  if err := sendPut(t, kvh, 1, args); err != OK {
+    t.Fatalf("retried Put failed: %v", err)
+  }
+  check(t, ck, "a", "2")
 
-    done := false
-    const nclients = 10
-    var ca [nclients]chan bool
-    for xcli := 0; xcli < nclients; xcli++ {
-      ca[xcli] = make(chan bool)
-      go func(cli int) {
-        ok := false
-        defer func() { ca[cli] <- ok }()
-        var cka [nservers]*Clerk
-        for i := 0; i < nservers; i++ {
-          cka[i] = MakeClerk([]string{port(tag, i)})
-        }
-        key := strconv.Itoa(cli)
-        last := ""
-        cka[0].Put(key, last)
-        for done == false {
-          ci := (rand.Int() % 2)
-          if (rand.Int() % 1000) < 500 {
-            nv := strconv.Itoa(rand.Int())
-            cka[ci].Put(key, nv)
-            last = nv
-          } else {
-            v := cka[ci].Get(key)
-            if v != last {
-              t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
-                cli, key, last, v)
-            }
-          }
-        }
-        ok = true
-      } (xcli)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: No request applied twice, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+  const ncli = 5
+  const nputs = 10
+  var ca [ncli]chan bool
+  for cli := 0; cli < ncli; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      sa := make([]string, len(kvh))
+      copy(sa, kvh)
+      for i := range sa {
+        j := rand.Intn(i+1)
+        sa[i], sa[j] = sa[j], sa[i]
+      }
+      myck := MakeClerk(sa)
+      for n := 0; n < nputs; n++ {
+        myck.Put("k" + strconv.Itoa(me), strconv.Itoa(n))
+      }
+    }(cli)
+  }
+  for cli := 0; cli < ncli; cli++ {
+    <- ca[cli]
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
+  }
+
+  // a retry applied late would have put back an old value.
+  for cli := 0; cli < ncli; cli++ {
+    check(t, ck, "k" + strconv.Itoa(cli), strconv.Itoa(nputs - 1))
+  }
+  for iters := 0; iters < 50; iters++ {
+    same := true
+    for i := 1; i < nservers; i++ {
+      kva[0].mu.Lock()
+      d0 := fmt.Sprint(kva[0].data)
+      kva[0].mu.Unlock()
+      kva[i].mu.Lock()
+      di := fmt.Sprint(kva[i].data)
+      kva[i].mu.Unlock()
+      same = same && d0 == di
+    }
+    if same {
+      break
+    }
+    if iters == 49 {
+      t.Fatalf("replicas hold different data")
     }
+    time.Sleep(100 * time.Millisecond)
+  }
 
-    time.Sleep(3 * time.Second)
+  fmt.Printf("  ... Passed\n")
 
-    part(t, tag, nservers, []int{2,3,4}, []int{0,1}, []int{})
+  fmt.Printf("Test: Idle sessions are forgotten ...\n")
 
-    // can majority partition make progress even though
-    // minority servers were interrupted in the middle of
-    // paxos agreements?
-    check(t, ck2, "q", "q")
-    ck2.Put("q", "qq")
-    check(t, ck2, "q", "qq")
-      
-    // restore network, wait for all threads to exit.
-    part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
-    done = true
-    ok := true
-    for i := 0; i < nclients; i++ {
-      z := <- ca[i]
-      ok = ok && z
+  args = &PutArgs{Key: "b", Value: "1", Kind: Put, Client: nrand(), Seq: 1}
+  for ; args.Seq <= 2; args.Seq++ {
+    if err := sendPut(t, kvh, 0, args); err != OK {
+      t.Fatalf("Put failed: %v", err)
     }
-    if ok == false {
-      t.Fatal("something is wrong")
+    args.Kind = Append
+  }
+  args.Seq--
+
+  // make every session look idle, until it is forgotten: a
+  // retry of a client's last request may still be on its
+  // way from the unreliable phase, and counts as the client
+  // being active, since it could come from a clerk waiting
+  // for the answer.
+  forgotten := false
+  for iters := 0; iters < 50 && !forgotten; iters++ {
+    for i := 0; i < nservers; i++ {
+      kva[i].rs.Idle()
     }
-    check(t, ck2, "q", "qq")
+    time.Sleep(100 * time.Millisecond)
+    forgotten = true
+    for i := 0; i < nservers; i++ {
+      if kva[i].rs.Sessions() != 0 {
+        forgotten = false
+      }
+    }
+  }
+  if !forgotten {
+    t.Fatalf("idle sessions were not forgotten")
+  }
+  // a late retry is refused rather than applied again.
+  if err := sendPut(t, kvh, 1, args); err != ErrSessionExpired {
+    t.Fatalf("retried Append after expiry: %v, expected %v", err, ErrSessionExpired)
   }
+  check(t, ck, "b", "11")
+  // and a clerk that was forgotten carries on.
+  check(t, ck, "a", "2")
+  ck.Put("a", "3")
+  check(t, ck, "a", "3")
 
   fmt.Printf("  ... Passed\n")
 }
 
-func TestManyPartition(t *testing.T) {
-  runtime.GOMAXPROCS(4)
+//
+// check that every client's appends to value are there
+// once each, and in the order the client made them.
+//
+func checkAppends(t *testing.T, value string, ncli int, nappends int) {
+  for cli := 0; cli < ncli; cli++ {
+    last := -1
+    for n := 0; n < nappends; n++ {
+      x := "x " + strconv.Itoa(cli) + " " + strconv.Itoa(n) + " y"
+      i := strings.Index(value, x)
+      if i < 0 {
+        t.Fatalf("missing element %q in Append result %q", x, value)
+      }
+      if strings.LastIndex(value, x) != i {
+        t.Fatalf("duplicate element %q in Append result %q", x, value)
+      }
+      if i < last {
+        t.Fatalf("wrong order for element %q in Append result %q", x, value)
+      }
+      last = i
+    }
+  }
+}
 
-  fmt.Printf("Test: Many clients, changing partitions ...\n")
+func TestAppend(t *testing.T) {
+  runtime.GOMAXPROCS(4)
 
-  tag := "many"
-  const nservers = 5
+  const nservers = 3
   var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
   defer cleanup(kva)
-  defer cleanpp(tag, nservers)
 
   for i := 0; i < nservers; i++ {
-    var kvh []string = make([]string, nservers)
-    for j := 0; j < nservers; j++ {
-      if j == i {
-        kvh[j] = port(tag, i)
-      } else {
-        kvh[j] = pp(tag, i, j)
-      }
-    }
-    kva[i] = StartServer(kvh, i)
-    kva[i].unreliable = true
+    kvh[i] = port("append", i)
   }
-  defer part(t, tag, nservers, []int{}, []int{}, []int{})
-  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
 
-  done := false
+  fmt.Printf("Test: Append and PutHash ...\n")
 
-  // re-partition periodically
-  ch1 := make(chan bool)
-  go func() {
-    defer func() { ch1 <- true } ()
-    for done == false {
-      var a [nservers]int
-      for i := 0; i < nservers; i++ {
-        a[i] = (rand.Int() % 3)
-      }
-      pa := make([][]int, 3)
-      for i := 0; i < 3; i++ {
-        pa[i] = make([]int, 0)
-        for j := 0; j < nservers; j++ {
-          if a[j] == i {
-            pa[i] = append(pa[i], j)
-          }
-        }
-      }
-      part(t, tag, nservers, pa[0], pa[1], pa[2])
-      time.Sleep(time.Duration(rand.Int63() % 200) * time.Millisecond)
+  ck.Append("a", "x")
+  ck.Append("a", "y")
+  check(t, ck, "a", "xy")
+  ck.Put("a", "z")
+  ck.Append("a", "w")
+  check(t, ck, "a", "zw")
+
+  prev := ""
+  for i := 0; i < 10; i++ {
+    v := strconv.Itoa(i)
+    if p := ck.PutHash("h", v); p != prev {
+      t.Fatalf("PutHash returned %v, expected %v", p, prev)
     }
-  }()
+    prev = strconv.Itoa(int(hash(prev + v)))
+  }
+  check(t, ck, "h", prev)
 
-  const nclients = 10
-  var ca [nclients]chan bool
-  for xcli := 0; xcli < nclients; xcli++ {
-    ca[xcli] = make(chan bool)
-    go func(cli int) {
-      ok := false
-      defer func() { ca[cli] <- ok }()
-      sa := make([]string, nservers)
-      for i := 0; i < nservers; i++ {
-        sa[i] = port(tag, i)
-      }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent appends and PutHashes, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+  const ncli = 5
+  const nops = 10
+  type link struct {
+    prev  string
+    value string
+  }
+  links := make(chan link, ncli * nops)
+  var ca [ncli]chan bool
+  for cli := 0; cli < ncli; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      sa := make([]string, len(kvh))
+      copy(sa, kvh)
       for i := range sa {
         j := rand.Intn(i+1)
         sa[i], sa[j] = sa[j], sa[i]
       }
       myck := MakeClerk(sa)
-      key := strconv.Itoa(cli)
-      last := ""
-      myck.Put(key, last)
-      for done == false {
-        if (rand.Int() % 1000) < 500 {
-          nv := strconv.Itoa(rand.Int())
-          myck.Put(key, nv)
-          last = nv
-        } else {
-          v := myck.Get(key)
-          if v != last {
-            t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
-              cli, key, last, v)
-          }
-        }
+      for n := 0; n < nops; n++ {
+        myck.Append("b", "x " + strconv.Itoa(me) + " " + strconv.Itoa(n) + " y")
+        v := strconv.Itoa(me * 100 + n)
+        links <- link{myck.PutHash("c", v), v}
       }
-      ok = true
-    } (xcli)
+    }(cli)
+  }
+  for cli := 0; cli < ncli; cli++ {
+    <- ca[cli]
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
   }
 
-  time.Sleep(20 * time.Second)
-  done = true
-  <- ch1
-  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  checkAppends(t, ck.Get("b"), ncli, nops)
 
-  ok := true
-  for i := 0; i < nclients; i++ {
-    z := <- ca[i]
-    ok = ok && z
+  // applied once each, the PutHashes form one chain from "",
+  // each from the value the one before left.
+  next := make(map[string]string)
+  for i := 0; i < ncli * nops; i++ {
+    l := <- links
+    if _, ok := next[l.prev]; ok {
+      t.Fatalf("two PutHashes saw %q", l.prev)
+    }
+    next[l.prev] = l.value
+  }
+  cur := ""
+  for i := 0; i < ncli * nops; i++ {
+    v, ok := next[cur]
+    if !ok {
+      t.Fatalf("no PutHash saw %q", cur)
+    }
+    cur = strconv.Itoa(int(hash(cur + v)))
   }
+  check(t, ck, "c", cur)
 
-  if ok {
-    fmt.Printf("  ... Passed\n")
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTxn(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("txn", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Versions count writes ...\n")
+
+  if v, n := ck.GetVersion("a"); v != "" || n != 0 {
+    t.Fatalf("GetVersion of a missing key -> %v %v, expected \"\" 0", v, n)
+  }
+  ck.Put("a", "x")
+  ck.Append("a", "y")
+  ck.PutHash("a", "z")
+  if _, n := ck.GetVersion("a"); n != 3 {
+    t.Fatalf("version %v after three writes, expected 3", n)
+  }
+  ck.Txn(nil, []Write{{Key: "a", Delete: true}})
+  if v, n := ck.GetVersion("a"); v != "" || n != 0 {
+    t.Fatalf("GetVersion of a deleted key -> %v %v, expected \"\" 0", v, n)
   }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: CompareAndSwap ...\n")
+
+  if ck.CompareAndSwap("b", "x", "y") {
+    t.Fatalf("CompareAndSwap succeeded on a missing key")
+  }
+  if !ck.CompareAndSwap("b", "", "x") {
+    t.Fatalf("CompareAndSwap from \"\" failed on a missing key")
+  }
+  if ck.CompareAndSwap("b", "y", "z") {
+    t.Fatalf("CompareAndSwap succeeded with the wrong old value")
+  }
+  check(t, ck, "b", "x")
+  if !ck.CompareAndSwap("b", "x", "y") {
+    t.Fatalf("CompareAndSwap failed with the right old value")
+  }
+  check(t, ck, "b", "y")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Transactions check every guard ...\n")
+
+  ck.Put("c", "1")
+  _, n := ck.GetVersion("c")
+  writes := []Write{{Key: "c", Value: "2"}, {Key: "d", Value: "2"}}
+  failing := [][]Guard{
+    {{Kind: VersionIs, Key: "c", Version: n}, {Kind: ValueIs, Key: "b", Value: "x"}},
+    {{Kind: VersionIs, Key: "c", Version: n + 1}},
+    {{Kind: ValueIs, Key: "c", Value: "1"}, {Kind: Absent, Key: "b"}},
+  }
+  for _, guards := range failing {
+    if ck.Txn(guards, writes) {
+      t.Fatalf("Txn succeeded with a guard that does not hold: %v", guards)
+    }
+  }
+  check(t, ck, "c", "1")
+  check(t, ck, "d", "")
+
+  guards := []Guard{
+    {Kind: VersionIs, Key: "c", Version: n},
+    {Kind: ValueIs, Key: "b", Value: "y"},
+    {Kind: Absent, Key: "d"},
+  }
+  if !ck.Txn(guards, writes) {
+    t.Fatalf("Txn failed though its guards hold")
+  }
+  check(t, ck, "c", "2")
+  check(t, ck, "d", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent transactions, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+
+  // each client increments a counter with CompareAndSwap,
+  // and moves one unit at a time between two accounts,
+  // guarding on their versions. both need every success
+  // reported, and none applied twice.
+  ck.Put("n", "0")
+  ck.Put("x", "100")
+  ck.Put("y", "100")
+  const ncli = 5
+  const nops = 5
+  var ca [ncli]chan bool
+  for cli := 0; cli < ncli; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      sa := make([]string, len(kvh))
+      copy(sa, kvh)
+      for i := range sa {
+        j := rand.Intn(i+1)
+        sa[i], sa[j] = sa[j], sa[i]
+      }
+      myck := MakeClerk(sa)
+      for i := 0; i < nops; i++ {
+        for {
+          v := myck.Get("n")
+          x, _ := strconv.Atoi(v)
+          if myck.CompareAndSwap("n", v, strconv.Itoa(x+1)) {
+            break
+          }
+        }
+        from, to := "x", "y"
+        if (me+i)%2 == 1 {
+          from, to = "y", "x"
+        }
+        for {
+          fv, fn := myck.GetVersion(from)
+          tv, tn := myck.GetVersion(to)
+          f, _ := strconv.Atoi(fv)
+          g, _ := strconv.Atoi(tv)
+          guards := []Guard{
+            {Kind: VersionIs, Key: from, Version: fn},
+            {Kind: VersionIs, Key: to, Version: tn},
+          }
+          writes := []Write{
+            {Key: from, Value: strconv.Itoa(f-1)},
+            {Key: to, Value: strconv.Itoa(g+1)},
+          }
+          if myck.Txn(guards, writes) {
+            break
+          }
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < ncli; cli++ {
+    <- ca[cli]
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
+  }
+
+  check(t, ck, "n", strconv.Itoa(ncli * nops))
+  x, _ := strconv.Atoi(ck.Get("x"))
+  y, _ := strconv.Atoi(ck.Get("y"))
+  if x + y != 200 {
+    t.Fatalf("accounts hold %v and %v, expected a total of 200", x, y)
+  }
+  if _, n := ck.GetVersion("x"); n != ncli * nops + 1 {
+    t.Fatalf("version of x is %v, expected %v", n, ncli * nops + 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// the next n events from w, or fail if they take too long.
+//
+func nextEvents(t *testing.T, w *Watcher, n int) []Event {
+  var events []Event
+  for len(events) < n {
+    select {
+    case e, ok := <-w.Events():
+      if !ok {
+        t.Fatalf("watch ended after %v events: %v", len(events), w.Err())
+      }
+      events = append(events, e)
+    case <-time.After(10 * time.Second):
+      t.Fatalf("only %v of %v events arrived", len(events), n)
+    }
+  }
+  return events
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Watches see writes in order ...\n")
+
+  ck.Put("w/a", "1")
+  ck.Put("x", "2")
+  ck.Append("w/b", "3")
+  ck.Txn(nil, []Write{{Key: "w/a", Delete: true}, {Key: "w/z", Delete: true}, {Key: "w/c", Value: "4"}})
+  // deletes of keys without values are no writes.
+  ck.Txn(nil, []Write{{Key: "w/z", Delete: true}})
+  ck.Put("w/c", "5")
+
+  w := ck.Watch("w/", 0)
+  events := nextEvents(t, w, 4)
+  expected := []Event{
+    {Key: "w/a", Value: "1", Version: 1, Revision: 1},
+    {Key: "w/b", Value: "3", Version: 1, Revision: 3},
+    {Key: "w/a", Deleted: true, Revision: 4},
+    {Key: "w/c", Value: "4", Version: 1, Revision: 4},
+  }
+  for i := range expected {
+    if events[i] != expected[i] {
+      t.Fatalf("event %v is %v, expected %v", i, events[i], expected[i])
+    }
+  }
+
+  ck.Put("w/d", "6")
+  events = nextEvents(t, w, 2)
+  if events[0].Value != "5" || events[0].Revision != 5 || events[1].Value != "6" {
+    t.Fatalf("got %v, expected the writes of 5 and 6, from revision 5", events)
+  }
+  w.Stop()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watches resume after the last event seen ...\n")
+
+  w = ck.Watch("w/", events[0].Revision)
+  if e := nextEvents(t, w, 1)[0]; e != events[1] {
+    t.Fatalf("resumed with %v, expected %v", e, events[1])
+  }
+  w.Stop()
+
+  w = ck.Watch("w/", FromNow)
+  time.Sleep(2 * watchWait)
+  ck.Put("w/e", "7")
+  if e := nextEvents(t, w, 1)[0]; e.Value != "7" {
+    t.Fatalf("watch from now got %v, expected the write of 7", e)
+  }
+  w.Stop()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Replicas number concurrent writes alike ...\n")
+
+  const nwrites = 30
+  var done [nservers]chan bool
+  for i := 0; i < nservers; i++ {
+    done[i] = make(chan bool)
+    go func(i int) {
+      myck := MakeClerk([]string{kvh[i]})
+      for j := 0; j < nwrites; j++ {
+        myck.Put("s/" + strconv.Itoa(i), strconv.Itoa(j))
+      }
+      done[i] <- true
+    }(i)
+  }
+  for i := 0; i < nservers; i++ {
+    <-done[i]
+  }
+
+  var seen [nservers][]Event
+  for i := 0; i < nservers; i++ {
+    w = MakeClerk([]string{kvh[i]}).Watch("s/", 0)
+    seen[i] = nextEvents(t, w, nservers * nwrites)
+    w.Stop()
+    for j := range seen[i] {
+      if seen[i][j] != seen[0][j] {
+        t.Fatalf("event %v is %v on server %v, %v on server 0", j, seen[i][j], i, seen[0][j])
+      }
+    }
+  }
+
+  // switch servers halfway through.
+  half := nservers * nwrites / 2
+  w = MakeClerk([]string{kvh[1]}).Watch("s/", seen[0][half-1].Revision)
+  for j, e := range nextEvents(t, w, half) {
+    if e != seen[0][half+j] {
+      t.Fatalf("resumed on server 1 with %v, expected %v", e, seen[0][half+j])
+    }
+  }
+  w.Stop()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watches survive lost replies and dead servers ...\n")
+
+  _, n := ck.GetVersion("u")
+  w = ck.Watch("u", FromNow)
+  time.Sleep(2 * watchWait)
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+  const nputs = 30
+  go func() {
+    myck := MakeClerk(kvh)
+    for i := 0; i < nputs; i++ {
+      if i == nputs/2 {
+        kva[0].kill()
+      }
+      myck.Put("u", strconv.Itoa(i))
+    }
+  }()
+  events = nextEvents(t, w, nputs)
+  for i, e := range events {
+    if e.Value != strconv.Itoa(i) || e.Version != n+i+1 {
+      t.Fatalf("event %v is %v, expected value %v, version %v", i, e, i, n+i+1)
+    }
+  }
+  w.Stop()
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watches fail once the writes are forgotten ...\n")
+
+  big := strings.Repeat("x", watchBytes/4)
+  for i := 0; i < 6; i++ {
+    ck.Put("big", big)
+  }
+  w = ck.Watch("w/", 0)
+  select {
+  case e, ok := <-w.Events():
+    if ok {
+      t.Fatalf("watch from 0 got %v, expected it to end", e)
+    }
+    if w.Err() != ErrCompacted {
+      t.Fatalf("watch from 0 ended with %v, expected %v", w.Err(), ErrCompacted)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatalf("watch from 0 did not end")
+  }
+  w.Stop()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestScan(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("scan", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  keysOf := func(pairs []KeyValue) string {
+    var keys []string
+    for _, p := range pairs {
+      keys = append(keys, p.Key)
+    }
+    return strings.Join(keys, " ")
+  }
+  checkScan := func(start string, end string, limit int, expected string) {
+    if keys := keysOf(ck.Scan(start, end, limit)); keys != expected {
+      t.Fatalf("Scan(%q, %q, %v) -> %q, expected %q", start, end, limit, keys, expected)
+    }
+  }
+
+  fmt.Printf("Test: Scans return keys in order ...\n")
+
+  for _, key := range []string{"c/2", "a", "d", "c/1", "b", "c/3"} {
+    ck.Put(key, key + "!")
+  }
+  pairs := ck.Scan("", "", 0)
+  checkScan("", "", 0, "a b c/1 c/2 c/3 d")
+  for _, p := range pairs {
+    if p.Value != p.Key + "!" || p.Version != 1 {
+      t.Fatalf("Scan returned %v, expected value %q, version 1", p, p.Key + "!")
+    }
+  }
+  checkScan("b", "c/3", 0, "b c/1 c/2")
+  checkScan("bb", "", 2, "c/1 c/2")
+  checkScan("c/", PrefixEnd("c/"), 0, "c/1 c/2 c/3")
+  checkScan("e", "", 0, "")
+  checkScan("d", "a", 0, "")
+
+  ck.Delete("c/2")
+  ck.Delete("x")
+  checkScan("c/", PrefixEnd("c/"), 0, "c/1 c/3")
+  check(t, ck, "c/2", "")
+  ck.Put("c/2", "again")
+  if _, n := ck.GetVersion("c/2"); n != 1 {
+    t.Fatalf("version %v after a delete and a Put, expected 1", n)
+  }
+  if PrefixEnd("a\xff\xff") != "b" || PrefixEnd("\xff") != "" {
+    t.Fatalf("wrong PrefixEnd()")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scans see writes made through other replicas ...\n")
+
+  for i := 0; i < nservers; i++ {
+    key := "r/" + strconv.Itoa(i)
+    cka[i].Put(key, "x")
+    for j := 0; j < nservers; j++ {
+      if keys := keysOf(cka[j].Scan(key, "", 1)); keys != key {
+        t.Fatalf("Scan through server %v -> %q, expected %q", j, keys, key)
+      }
+    }
+    cka[(i + 1) % nservers].Delete(key)
+    if keys := keysOf(cka[i].Scan("r/", PrefixEnd("r/"), 0)); keys != "" {
+      t.Fatalf("Scan through server %v -> %q after a Delete", i, keys)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Scans during concurrent writes, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+
+  // each client Puts its keys in order, and Deletes the
+  // even ones again. its scans must be in order, and see
+  // exactly its own writes so far.
+  const ncli = 3
+  const nkeys = 8
+  key := func(cli int, n int) string {
+    return "s/" + strconv.Itoa(cli) + "/" + strconv.Itoa(n)
+  }
+  var ca [ncli]chan bool
+  for cli := 0; cli < ncli; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk(kvh)
+      for n := 0; n < nkeys; n++ {
+        myck.Put(key(me, n), "x")
+        pairs := myck.Scan("s/", PrefixEnd("s/"), 0)
+        for i := 1; i < len(pairs); i++ {
+          if pairs[i-1].Key >= pairs[i].Key {
+            t.Errorf("Scan out of order: %v", keysOf(pairs))
+            return
+          }
+        }
+        mine := keysOf(myck.Scan("s/" + strconv.Itoa(me) + "/", PrefixEnd("s/" + strconv.Itoa(me) + "/"), 0))
+        expected := ""
+        for i := 0; i <= n; i++ {
+          if i % 2 == 1 || i == n {
+            expected = strings.TrimSpace(expected + " " + key(me, i))
+          }
+        }
+        if mine != expected {
+          t.Errorf("client %v scanned %q, expected %q", me, mine, expected)
+          return
+        }
+        if n % 2 == 0 {
+          myck.Delete(key(me, n))
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < ncli; cli++ {
+    <- ca[cli]
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
+  }
+  if t.Failed() {
+    t.FailNow()
+  }
+
+  var expected []string
+  for cli := 0; cli < ncli; cli++ {
+    for n := 1; n < nkeys; n += 2 {
+      expected = append(expected, key(cli, n))
+    }
+  }
+  checkScan("s/", PrefixEnd("s/"), 0, strings.Join(expected, " "))
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestKeyspace(t *testing.T) {
+  fmt.Printf("Test: The key index matches a sorted list ...\n")
+
+  ks := makeKeyspace(nil)
+  present := map[string]bool{}
+  r := rand.New(rand.NewSource(1))
+  for iters := 0; iters < 20000; iters++ {
+    key := strconv.Itoa(r.Intn(1000))
+    if r.Intn(3) == 0 {
+      ks.remove(key)
+      delete(present, key)
+    } else {
+      ks.insert(key)
+      present[key] = true
+    }
+    if iters % 1000 != 0 {
+      continue
+    }
+    var sorted []string
+    for k := range present {
+      sorted = append(sorted, k)
+    }
+    sort.Strings(sorted)
+    if got := ks.scan("", "", 0); strings.Join(got, " ") != strings.Join(sorted, " ") {
+      t.Fatalf("index has %v keys, expected %v", len(got), len(sorted))
+    }
+    start := strconv.Itoa(r.Intn(1000))
+    end := strconv.Itoa(r.Intn(1000))
+    var expected []string
+    for _, k := range sorted {
+      if k >= start && k < end && len(expected) < 10 {
+        expected = append(expected, k)
+      }
+    }
+    if got := ks.scan(start, end, 10); strings.Join(got, " ") != strings.Join(expected, " ") {
+      t.Fatalf("scan(%q, %q, 10) -> %v, expected %v", start, end, got, expected)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// an insert and a remove in an index of n keys, which
+// should cost about the same for every n.
+// go test -run XXX -bench Keyspace
+//
+func BenchmarkKeyspace(b *testing.B) {
+  for _, n := range []int{1000, 100000, 1000000} {
+    b.Run(strconv.Itoa(n), func(b *testing.B) {
+      ks := makeKeyspace(nil)
+      for i := 0; i < n; i++ {
+        ks.insert("k" + strconv.Itoa(i))
+      }
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        key := "k" + strconv.Itoa(i % n) + "x"
+        ks.insert(key)
+        ks.remove(key)
+      }
+    })
+  }
+}
+
+func TestTTL(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ttl", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  ck := MakeClerk(kvh)
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Keys expire after their TTL ...\n")
+
+  ck.PutWithTTL("a", "x", time.Second)
+  ck.Put("b", "y")
+  ck.PutWithTTL("c", "1", time.Second)
+  ck.Append("c", "2")
+  ck.PutWithTTL("d", "1", time.Second)
+  ck.Put("d", "2")
+  check(t, ck, "a", "x")
+  check(t, ck, "c", "12")
+
+  time.Sleep(2 * time.Second)
+  for i := 0; i < nservers; i++ {
+    check(t, cka[i], "a", "")
+    check(t, cka[i], "b", "y")
+    check(t, cka[i], "c", "")
+    check(t, cka[i], "d", "2")
+  }
+
+  ck.PutWithTTL("a", "z", time.Second)
+  time.Sleep(500 * time.Millisecond)
+  ck.PutWithTTL("a", "z", 2 * time.Second)
+  time.Sleep(time.Second)
+  check(t, ck, "a", "z")
+  time.Sleep(2 * time.Second)
+  check(t, ck, "a", "")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Replicas delete a key at the same point ...\n")
+
+  // with writes to another key going on, each replica
+  // must report the delete with the same revision.
+  var wa [nservers]*Watcher
+  for i := 0; i < nservers; i++ {
+    wa[i] = cka[i].Watch("e", FromNow)
+    defer wa[i].Stop()
+  }
+  time.Sleep(2 * watchWait)
+  done := make(chan bool)
+  go func() {
+    myck := MakeClerk(kvh)
+    for i := 0; ; i++ {
+      select {
+      case <-done:
+        done <- true
+        return
+      default:
+      }
+      myck.Put("f", strconv.Itoa(i))
+    }
+  }()
+  ck.PutWithTTL("e", "x", 500 * time.Millisecond)
+  var deleted Event
+  for i := 0; i < nservers; i++ {
+    events := nextEvents(t, wa[i], 2)
+    if events[0].Value != "x" || !events[1].Deleted {
+      t.Fatalf("replica %v reported %v, expected a Put and a delete", i, events)
+    }
+    if i == 0 {
+      deleted = events[1]
+    } else if events[1] != deleted {
+      t.Fatalf("replica %v reported %v, expected %v", i, events[1], deleted)
+    }
+  }
+  done <- true
+  <-done
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Keys expire without replica 0 ...\n")
+
+  kva[0].kill()
+  ck.PutWithTTL("g", "x", 500 * time.Millisecond)
+  check(t, ck, "g", "x")
+  time.Sleep(2 * time.Second)
+  for i := 1; i < nservers; i++ {
+    check(t, cka[i], "g", "")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestHole(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Tolerates holes in paxos sequence ...\n")
+
+  tag := "hole"
+  const nservers = 5
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  h := linearizability.MakeHistory()
+  for iters := 0; iters < 5; iters++ {
+    part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+
+    ck2 := h.Client(MakeClerk([]string{port(tag, 2)}))
+    ck2.Put("q", "q")
+
+    done := false
+    const nclients = 10
+    var ca [nclients]chan bool
+    for xcli := 0; xcli < nclients; xcli++ {
+      ca[xcli] = make(chan bool)
+      go func(cli int) {
+        ok := false
+        defer func() { ca[cli] <- ok }()
+        var cka [nservers]linearizability.KV
+        for i := 0; i < nservers; i++ {
+          cka[i] = h.Client(MakeClerk([]string{port(tag, i)}))
+        }
+        key := strconv.Itoa(cli)
+        last := ""
+        cka[0].Put(key, last)
+        for done == false {
+          ci := (rand.Int() % 2)
+          if (rand.Int() % 1000) < 500 {
+            nv := strconv.Itoa(rand.Int())
+            cka[ci].Put(key, nv)
+            last = nv
+          } else {
+            v := cka[ci].Get(key)
+            if v != last {
+              t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
+                cli, key, last, v)
+            }
+          }
+        }
+        ok = true
+      } (xcli)
+    }
+
+    time.Sleep(3 * time.Second)
+
+    part(t, tag, nservers, []int{2,3,4}, []int{0,1}, []int{})
+
+    // can majority partition make progress even though
+    // minority servers were interrupted in the middle of
+    // paxos agreements?
+    check(t, ck2, "q", "q")
+    ck2.Put("q", "qq")
+    check(t, ck2, "q", "qq")
+      
+    // restore network, wait for all threads to exit.
+    part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+    done = true
+    ok := true
+    for i := 0; i < nclients; i++ {
+      z := <- ca[i]
+      ok = ok && z
+    }
+    if ok == false {
+      t.Fatal("something is wrong")
+    }
+    check(t, ck2, "q", "qq")
+  }
+  if err := h.Check(); err != nil {
+    t.Fatalf("%v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestManyPartition(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Many clients, changing partitions ...\n")
+
+  tag := "many"
+  const nservers = 5
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i, opts...)
+    kva[i].unreliable = true
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+
+  done := false
+  h := linearizability.MakeHistory()
+
+  // re-partition periodically
+  ch1 := make(chan bool)
+  go func() {
+    defer func() { ch1 <- true } ()
+    for done == false {
+      var a [nservers]int
+      for i := 0; i < nservers; i++ {
+        a[i] = (rand.Int() % 3)
+      }
+      pa := make([][]int, 3)
+      for i := 0; i < 3; i++ {
+        pa[i] = make([]int, 0)
+        for j := 0; j < nservers; j++ {
+          if a[j] == i {
+            pa[i] = append(pa[i], j)
+          }
+        }
+      }
+      part(t, tag, nservers, pa[0], pa[1], pa[2])
+      time.Sleep(time.Duration(rand.Int63() % 200) * time.Millisecond)
+    }
+  }()
+
+  const nclients = 10
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      ok := false
+      defer func() { ca[cli] <- ok }()
+      sa := make([]string, nservers)
+      for i := 0; i < nservers; i++ {
+        sa[i] = port(tag, i)
+      }
+      for i := range sa {
+        j := rand.Intn(i+1)
+        sa[i], sa[j] = sa[j], sa[i]
+      }
+      myck := h.Client(MakeClerk(sa))
+      key := strconv.Itoa(cli)
+      last := ""
+      myck.Put(key, last)
+      for done == false {
+        if (rand.Int() % 1000) < 500 {
+          nv := strconv.Itoa(rand.Int())
+          myck.Put(key, nv)
+          last = nv
+        } else {
+          v := myck.Get(key)
+          if v != last {
+            t.Fatalf("%v: wrong value, key %v, wanted %v, got %v",
+              cli, key, last, v)
+          }
+        }
+      }
+      ok = true
+    } (xcli)
+  }
+
+  time.Sleep(20 * time.Second)
+  done = true
+  <- ch1
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+
+  ok := true
+  for i := 0; i < nclients; i++ {
+    z := <- ca[i]
+    ok = ok && z
+  }
+  if err := h.Check(); err != nil {
+    t.Fatalf("%v", err)
+  }
+
+  if ok {
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Lagging replica catches up from a snapshot ...\n")
+
+  tag := "snapshot"
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{port(tag, i)})
+  }
+
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+  cka[2].Put("a", "x")
+  part(t, tag, nservers, []int{0,1}, []int{2}, []int{})
+
+  const nputs = snapshotEvery * 3
+  for i := 0; i < nputs; i++ {
+    cka[i % 2].Put(strconv.Itoa(i % 10), strconv.Itoa(i))
+  }
+  cka[0].Put("a", "y")
+
+  if kva[0].px.Min() == 0 || kva[1].px.Min() == 0 {
+    t.Fatalf("paxos log was not compacted")
+  }
+
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+  check(t, cka[2], "a", "y")
+  for i := nputs - 10; i < nputs; i++ {
+    check(t, cka[2], strconv.Itoa(i % 10), strconv.Itoa(i))
+  }
+  if kva[2].px.Min() < snapshotEvery {
+    t.Fatalf("lagging replica did not take the snapshot")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  // raft and epaxos keep nothing on disk.
+  if len(opts) > 0 {
+    return
+  }
+
+  fmt.Printf("Test: Servers restarted with their DataDir remember ...\n")
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  var dirs []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("restart", i)
+    dirs[i] = kvh[i] + "-data"
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, DataDir(dirs[i]))
+  }
+
+  ck := MakeClerk(kvh)
+  const nputs = snapshotEvery + 50
+  for i := 0; i < nputs; i++ {
+    ck.Put(strconv.Itoa(i % 10), strconv.Itoa(i))
+  }
+  ck.Append("a", "x")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].kill()
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, DataDir(dirs[i]))
+  }
+
+  for i := nputs - 10; i < nputs; i++ {
+    check(t, ck, strconv.Itoa(i % 10), strconv.Itoa(i))
+  }
+  ck.Append("a", "y")
+  for i := 0; i < nservers; i++ {
+    check(t, MakeClerk([]string{kvh[i]}), "a", "xy")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaseReads(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("lease", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  // epaxos has no read index: its Gets are commands like
+  // any other.
+  if kva[0].useEPaxos == false {
+    fmt.Printf("Test: Gets are served without the log ...\n")
+
+    cka[0].Put("a", "aa")
+    cka[1].Put("b", "bb")
+    time.Sleep(100 * time.Millisecond)
+
+    max := kva[0].px.Max()
+    for iters := 0; iters < 100; iters++ {
+      check(t, cka[iters % nservers], "a", "aa")
+      check(t, cka[iters % nservers], "b", "bb")
+    }
+    if kva[0].px.Max() > max + 2 {
+      t.Fatalf("200 Gets used %v instances", kva[0].px.Max() - max)
+    }
+
+    fmt.Printf("  ... Passed\n")
+  }
+
+  fmt.Printf("Test: Gets see Puts made through other replicas ...\n")
+
+  for iters := 0; iters < 50; iters++ {
+    v := strconv.Itoa(iters)
+    cka[iters % nservers].Put("a", v)
+    check(t, cka[(iters + 1) % nservers], "a", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Simulated network, lossy and partitioned ...\n")
+
+  const nservers = 5
+  nw := transport.MakeNetwork(transport.Seed())
+  defer func() {
+    if t.Failed() {
+      fmt.Printf("  ... failed with TRANSPORT_SEED=%v\n", nw.Seed())
+    }
+  }()
+
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var addrs []string = make([]string, nservers)
+  defer cleanup(kva)
+  for i := 0; i < nservers; i++ {
+    addrs[i] = nw.Addr(strconv.Itoa(i))
+  }
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = addrs[i]
+      } else {
+        kvh[j] = nw.Link(strconv.Itoa(i), strconv.Itoa(j))
+      }
+    }
+    kva[i] = StartServer(kvh, i, opts...)
+  }
+  nw.SetFaults(transport.Faults{Loss: 0.05, LoseReply: 0.05, Duplicate: 0.05,
+    Delay: 10 * time.Millisecond})
+
+  done := false
+  h := linearizability.MakeHistory()
+
+  // the partitions and the workload come from the seed too,
+  // a generator for each goroutine.
+  rng := func(i int) *rand.Rand {
+    return rand.New(rand.NewSource(nw.Seed() + int64(i)))
+  }
+
+  // re-partition periodically, always leaving a majority.
+  ch1 := make(chan bool)
+  go func() {
+    defer func() { ch1 <- true } ()
+    r := rng(0)
+    for done == false {
+      perm := r.Perm(nservers)
+      var a, b []string
+      for i, s := range perm {
+        if i < 3 {
+          a = append(a, strconv.Itoa(s))
+        } else {
+          b = append(b, strconv.Itoa(s))
+        }
+      }
+      nw.Partition(a, b)
+      time.Sleep(time.Duration(500 + r.Int63() % 500) * time.Millisecond)
+    }
+  }()
+
+  const nclients = 5
+  var ca [nclients]chan bool
+  for xcli := 0; xcli < nclients; xcli++ {
+    ca[xcli] = make(chan bool)
+    go func(cli int) {
+      defer func() { ca[cli] <- true }()
+      r := rng(cli + 1)
+      sa := make([]string, nservers)
+      copy(sa, addrs)
+      for i := range sa {
+        j := r.Intn(i+1)
+        sa[i], sa[j] = sa[j], sa[i]
+      }
+      myck := h.Client(MakeClerk(sa))
+      for done == false {
+        key := strconv.Itoa(r.Int() % 3)
+        if (r.Int() % 1000) < 500 {
+          myck.Put(key, strconv.Itoa(r.Int()))
+        } else {
+          myck.Get(key)
+        }
+      }
+    } (xcli)
+  }
+
+  time.Sleep(8 * time.Second)
+  done = true
+  <- ch1
+  nw.Partition()
+  for i := 0; i < nclients; i++ {
+    <- ca[i]
+  }
+
+  if len(h.Operations()) < 10 {
+    t.Fatalf("only %v operations completed", len(h.Operations()))
+  }
+  if err := h.Check(); err != nil {
+    t.Fatalf("%v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
 }
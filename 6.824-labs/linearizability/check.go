@@ -0,0 +1,243 @@
+package linearizability
+
+//
+// the checker: the search of Wing & Gong, with the pruning
+// of Lowe and the per-key partitioning of Porcupine.
+//
+// operations on different keys do not interact, so each
+// key's history is checked on its own. for one key, the
+// calls and returns go in a linked list in time order, and
+// the search repeatedly takes a call that comes before the
+// first remaining return (an operation that could have
+// taken effect first), checks it against the value, and
+// removes it and its return from the list. when no such
+// call fits, it puts the last one back and tries the next.
+// a (set of operations taken, value) pair that has been
+// seen before leads nowhere new, so is not tried again.
+//
+
+import "fmt"
+import "sort"
+import "time"
+
+//
+// how many operations of the prefix Violation.Error()
+// shows, counting back from the end.
+//
+const showPrefix = 10
+
+//
+// a history that is not linearizable. Prefix is a longest
+// order of operations on Key that is consistent with their
+// results, and Value the key's value after it. Next holds
+// the operations that could come after Prefix; none of
+// them leads to an order of every operation.
+//
+type Violation struct {
+	Key    string
+	Prefix []Operation
+	Value  string
+	Next   []Operation
+}
+
+func (v *Violation) Error() string {
+	s := fmt.Sprintf("history of key %q is not linearizable\n", v.Key)
+	s += "  longest linearizable prefix:\n"
+	prefix := v.Prefix
+	if len(prefix) > showPrefix {
+		s += fmt.Sprintf("    ... %v earlier operations\n", len(prefix)-showPrefix)
+		prefix = prefix[len(prefix)-showPrefix:]
+	}
+	for _, op := range prefix {
+		s += fmt.Sprintf("    %v\n", op)
+	}
+	s += fmt.Sprintf("  after which the value is %q, and none of these can follow:\n", v.Value)
+	for _, op := range v.Next {
+		s += fmt.Sprintf("    %v\n", op)
+	}
+	return s
+}
+
+//
+// nil if ops are linearizable as operations on a key/value
+// map in which every key starts out as ""; otherwise a
+// *Violation for the first key, in sorted order, whose
+// operations are not.
+//
+func Check(ops []Operation) error {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	var keys []string
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if v := checkKey(key, byKey[key]); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+//
+// the model: the value after op, when the value before it
+// is value, and whether op could have returned what it did.
+//
+func step(value string, op Operation) (string, bool) {
+	if op.Kind == Put {
+		return op.Value, true
+	}
+	return value, op.Value == value
+}
+
+//
+// a call or return in the list.
+//
+type node struct {
+	op    int
+	call  bool
+	match *node // a call's return
+	prev  *node
+	next  *node
+}
+
+//
+// take call n and its return out of the list.
+//
+func lift(n *node) {
+	n.prev.next = n.next
+	if n.next != nil {
+		n.next.prev = n.prev
+	}
+	m := n.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+//
+// undo lift(n).
+//
+func unlift(n *node) {
+	m := n.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	n.prev.next = n
+	if n.next != nil {
+		n.next.prev = n
+	}
+}
+
+func checkKey(key string, ops []Operation) *Violation {
+	type event struct {
+		t    time.Duration
+		call bool
+		op   int
+	}
+	events := make([]event, 0, 2*len(ops))
+	for i, op := range ops {
+		events = append(events, event{op.Call, true, i}, event{op.Return, false, i})
+	}
+	// a call before a return at the same time, since the
+	// two operations may then have overlapped.
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].t != events[j].t {
+			return events[i].t < events[j].t
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &node{op: -1}
+	tail := head
+	calls := make([]*node, len(ops))
+	for _, e := range events {
+		n := &node{op: e.op, call: e.call, prev: tail}
+		tail.next = n
+		tail = n
+		if e.call {
+			calls[e.op] = n
+		} else {
+			calls[e.op].match = n
+		}
+	}
+
+	type frame struct {
+		n     *node
+		value string // before n's operation
+	}
+	var stack []frame
+	taken := make([]byte, (len(ops)+7)/8)
+	seen := make(map[string]bool)
+	value := ""
+	var best []int
+	bestValue := ""
+
+	n := head.next
+	for head.next != nil {
+		if n.call {
+			if next, ok := step(value, ops[n.op]); ok {
+				taken[n.op/8] |= 1 << uint(n.op%8)
+				k := string(taken) + "\x00" + next
+				if !seen[k] {
+					seen[k] = true
+					stack = append(stack, frame{n, value})
+					value = next
+					lift(n)
+					if len(stack) > len(best) {
+						best = best[:0]
+						for _, f := range stack {
+							best = append(best, f.n.op)
+						}
+						bestValue = value
+					}
+					n = head.next
+					continue
+				}
+				taken[n.op/8] &^= 1 << uint(n.op%8)
+			}
+			n = n.next
+		} else {
+			// no operation that could come next fits.
+			if len(stack) == 0 {
+				return violation(key, ops, best, bestValue)
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value = f.value
+			taken[f.n.op/8] &^= 1 << uint(f.n.op%8)
+			unlift(f.n)
+			n = f.n.next
+		}
+	}
+	return nil
+}
+
+func violation(key string, ops []Operation, best []int, value string) *Violation {
+	v := &Violation{Key: key, Value: value}
+	in := make([]bool, len(ops))
+	for _, i := range best {
+		v.Prefix = append(v.Prefix, ops[i])
+		in[i] = true
+	}
+	// the rest that could come first: those called before
+	// any of the rest returned.
+	first := time.Duration(-1)
+	for i, op := range ops {
+		if !in[i] && (first < 0 || op.Return < first) {
+			first = op.Return
+		}
+	}
+	for i, op := range ops {
+		if !in[i] && op.Call <= first {
+			v.Next = append(v.Next, op)
+		}
+	}
+	sort.Slice(v.Next, func(i, j int) bool { return v.Next[i].Call < v.Next[j].Call })
+	return v
+}
@@ -0,0 +1,117 @@
+package linearizability
+
+//
+// recording client histories.
+//
+// wrap each clerk with History.Client(); every Get() and
+// Put() through the wrapper is recorded with the times it
+// was called and returned. Check() then decides whether
+// some order of the operations, consistent with those
+// times, explains every result (see check.go).
+//
+
+import "fmt"
+import "sync"
+import "time"
+
+const (
+	Get = "Get"
+	Put = "Put"
+)
+
+//
+// the clerk interface of kvpaxos and shardkv.
+//
+type KV interface {
+	Get(key string) string
+	Put(key string, value string)
+}
+
+//
+// one completed call. Call and Return are measured from
+// the start of the history, on the monotonic clock.
+//
+type Operation struct {
+	Client int
+	Kind   string // Get or Put
+	Key    string
+	Value  string // what a Put wrote, or what a Get returned
+	Call   time.Duration
+	Return time.Duration
+}
+
+func (op Operation) String() string {
+	s := fmt.Sprintf("client %v: %v(%q", op.Client, op.Kind, op.Key)
+	if op.Kind == Put {
+		s += fmt.Sprintf(", %q)", op.Value)
+	} else {
+		s += fmt.Sprintf(") -> %q", op.Value)
+	}
+	return s + fmt.Sprintf("  [%v, %v]", op.Call, op.Return)
+}
+
+type History struct {
+	mu      sync.Mutex
+	start   time.Time
+	ops     []Operation
+	clients int
+}
+
+func MakeHistory() *History {
+	h := new(History)
+	h.start = time.Now()
+	return h
+}
+
+//
+// a KV that records every call to kv in h, as a client of
+// its own.
+//
+func (h *History) Client(kv KV) KV {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients++
+	return &client{h, h.clients - 1, kv}
+}
+
+//
+// the operations recorded so far, in the order they
+// returned.
+//
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Operation(nil), h.ops...)
+}
+
+//
+// Check() the operations recorded so far.
+//
+func (h *History) Check() error {
+	return Check(h.Operations())
+}
+
+func (h *History) record(op Operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+type client struct {
+	h  *History
+	id int
+	kv KV
+}
+
+func (c *client) Get(key string) string {
+	call := time.Since(c.h.start)
+	v := c.kv.Get(key)
+	c.h.record(Operation{c.id, Get, key, v, call, time.Since(c.h.start)})
+	return v
+}
+
+func (c *client) Put(key string, value string) {
+	call := time.Since(c.h.start)
+	c.kv.Put(key, value)
+	c.h.record(Operation{c.id, Put, key, value, call, time.Since(c.h.start)})
+}
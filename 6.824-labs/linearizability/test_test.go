@@ -0,0 +1,186 @@
+package linearizability
+
+import "testing"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "fmt"
+import "math/rand"
+
+func op(client int, kind string, key string, value string, call int, ret int) Operation {
+  return Operation{client, kind, key, value,
+    time.Duration(call) * time.Millisecond, time.Duration(ret) * time.Millisecond}
+}
+
+//
+// a map that every client sees the same way, as a
+// linearizable service should.
+//
+type store struct {
+  mu sync.Mutex
+  data map[string]string
+}
+
+func (s *store) Get(key string) string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.data[key]
+}
+
+func (s *store) Put(key string, value string) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.data[key] = value
+}
+
+//
+// a replica that a write reaches only after a while.
+//
+type lagging struct {
+  s *store
+}
+
+func (l *lagging) Get(key string) string {
+  return l.s.Get(key)
+}
+
+func (l *lagging) Put(key string, value string) {
+  go func() {
+    time.Sleep(20 * time.Millisecond)
+    l.s.Put(key, value)
+  }()
+}
+
+func TestSequential(t *testing.T) {
+  fmt.Printf("Test: Sequential histories ...\n")
+
+  ops := []Operation{
+    op(0, Get, "a", "", 0, 1),
+    op(0, Put, "a", "x", 2, 3),
+    op(1, Get, "a", "x", 4, 5),
+    op(1, Put, "a", "y", 6, 7),
+    op(0, Get, "a", "y", 8, 9),
+  }
+  if err := Check(ops); err != nil {
+    t.Fatalf("linearizable history rejected: %v", err)
+  }
+
+  stale := append([]Operation(nil), ops...)
+  stale[4] = op(0, Get, "a", "x", 8, 9)
+  if Check(stale) == nil {
+    t.Fatalf("stale read accepted")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestConcurrent(t *testing.T) {
+  fmt.Printf("Test: Overlapping operations ...\n")
+
+  // the Get overlaps both Puts, so it may see either.
+  for _, v := range []string{"", "x", "y"} {
+    ops := []Operation{
+      op(0, Put, "a", "x", 0, 10),
+      op(1, Put, "a", "y", 5, 15),
+      op(2, Get, "a", v, 1, 20),
+    }
+    if err := Check(ops); err != nil {
+      t.Fatalf("Get of %q rejected: %v", v, err)
+    }
+  }
+
+  // once the Get has seen y, a later Get cannot see x,
+  // since x went in before y.
+  ops := []Operation{
+    op(0, Put, "a", "x", 0, 10),
+    op(1, Put, "a", "y", 5, 15),
+    op(2, Get, "a", "x", 16, 17),
+    op(3, Get, "a", "y", 12, 13),
+  }
+  if Check(ops) == nil {
+    t.Fatalf("x after y accepted")
+  }
+
+  // keys do not constrain each other.
+  ops = []Operation{
+    op(0, Put, "a", "x", 0, 1),
+    op(0, Put, "b", "x", 2, 3),
+    op(1, Get, "b", "", 0, 1),
+    op(1, Get, "a", "x", 2, 3),
+  }
+  if err := Check(ops); err != nil {
+    t.Fatalf("linearizable history rejected: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCounterexample(t *testing.T) {
+  fmt.Printf("Test: Counterexample ...\n")
+
+  ops := []Operation{
+    op(0, Put, "a", "x", 0, 1),
+    op(1, Put, "b", "1", 0, 1),
+    op(1, Get, "b", "1", 2, 3),
+    op(1, Put, "b", "2", 4, 5),
+    op(0, Get, "b", "1", 6, 7),
+  }
+  err := Check(ops)
+  v, ok := err.(*Violation)
+  if !ok {
+    t.Fatalf("expected a *Violation, got %v", err)
+  }
+  if v.Key != "b" || len(v.Prefix) != 3 || v.Value != "2" ||
+     len(v.Next) != 1 || v.Next[0] != ops[4] {
+    t.Fatalf("wrong counterexample: %+v", v)
+  }
+  s := err.Error()
+  if !strings.Contains(s, `"b"`) || !strings.Contains(s, `client 0: Get("b") -> "1"`) {
+    t.Fatalf("counterexample does not name the operation: %v", s)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRecord(t *testing.T) {
+  fmt.Printf("Test: Recorded histories ...\n")
+
+  s := &store{data: make(map[string]string)}
+  h := MakeHistory()
+  var wg sync.WaitGroup
+  for cli := 0; cli < 5; cli++ {
+    wg.Add(1)
+    go func(me int) {
+      defer wg.Done()
+      ck := h.Client(s)
+      for i := 0; i < 20; i++ {
+        key := strconv.Itoa(rand.Int() % 2)
+        if rand.Int() % 2 == 0 {
+          ck.Put(key, strconv.Itoa(me*100 + i))
+        } else {
+          ck.Get(key)
+        }
+        time.Sleep(time.Duration(rand.Int() % 5) * time.Millisecond)
+      }
+    }(cli)
+  }
+  wg.Wait()
+  if len(h.Operations()) != 100 {
+    t.Fatalf("recorded %v operations, expected 100", len(h.Operations()))
+  }
+  if err := h.Check(); err != nil {
+    t.Fatalf("linearizable history rejected: %v", err)
+  }
+
+  // a Get right after a Put misses it.
+  h = MakeHistory()
+  ck := h.Client(&lagging{&store{data: make(map[string]string)}})
+  ck.Put("a", "x")
+  ck.Get("a")
+  if err := h.Check(); err == nil {
+    t.Fatalf("stale read accepted")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
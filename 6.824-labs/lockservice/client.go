@@ -3,7 +3,7 @@ package lockservice
 import (
 	"crypto/rand"
 	"math/big"
-	"net/rpc"
+	"transport"
 )
 
 //
@@ -48,7 +48,7 @@ func MakeClerk(primary string, backup string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
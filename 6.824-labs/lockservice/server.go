@@ -2,10 +2,10 @@ package lockservice
 
 import "net"
 import "net/rpc"
+import "transport"
 import "log"
 import "sync"
 import "fmt"
-import "os"
 import "io"
 import "time"
 
@@ -139,9 +139,8 @@ func StartServer(primary string, backup string, am_primary bool) *LockServer {
 	rpcs.Register(ls)
 
 	// prepare to receive connections from clients.
-	// change "unix" to "tcp" to use over a network.
-	os.Remove(me) // only needed for "unix"
-	l, e := net.Listen("unix", me)
+	// the address says which transport to use.
+	l, e := transport.Listen(me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -0,0 +1,209 @@
+package main
+
+//
+// client for kvpaxos, shardmaster and shardkv clusters.
+//
+// export GOPATH=~/6.824
+// go build kvpaxosd.go
+// go build shardmasterd.go
+// go build shardkvd.go
+// go build kvctl.go
+//
+// describe the cluster in a config file (see
+// cluster/cluster.go), then start every replica it names:
+//
+// ./kvpaxosd cluster.json 0 &
+// ./kvpaxosd cluster.json 1 &
+// ./kvpaxosd cluster.json 2 &
+// ./shardmasterd cluster.json 0 &
+// ...
+// ./shardkvd cluster.json 100 0 &
+// ...
+//
+// and talk to them:
+//
+// ./kvctl cluster.json put key1 value1
+// ./kvctl cluster.json get key1
+// ./kvctl cluster.json join 100
+// ./kvctl cluster.json query
+// ./kvctl cluster.json status
+//
+// get, put, append and scan go to kvpaxos; join, leave,
+// move and query to the shardmasters. join takes the
+// group's servers from the config file.
+//
+// a daemon that crashes can be started again with the
+// same arguments on the paxos backend, which keeps its log
+// in the replica's dir; on raft or epaxos it refuses to.
+// kvctl cannot replace a dead replica with a new one; see
+// cluster/cluster.go.
+//
+
+import "kvpaxos"
+import "shardmaster"
+import "cluster"
+import "paxos"
+import "transport"
+import "os"
+import "fmt"
+import "strconv"
+import "sort"
+import "strings"
+
+func usage() {
+  fmt.Printf("Usage: kvctl cluster.json get key\n")
+  fmt.Printf("       kvctl cluster.json put key value\n")
+  fmt.Printf("       kvctl cluster.json append key value\n")
+  fmt.Printf("       kvctl cluster.json scan start [end [limit]]\n")
+  fmt.Printf("       kvctl cluster.json join gid\n")
+  fmt.Printf("       kvctl cluster.json leave gid\n")
+  fmt.Printf("       kvctl cluster.json move shard gid\n")
+  fmt.Printf("       kvctl cluster.json query [num]\n")
+  fmt.Printf("       kvctl cluster.json status\n")
+  os.Exit(1)
+}
+
+func fail(format string, a ...interface{}) {
+  fmt.Printf("kvctl: " + format + "\n", a...)
+  os.Exit(1)
+}
+
+func atoi(s string) int {
+  n, err := strconv.Atoi(s)
+  if err != nil {
+    fail("bad number %q", s)
+  }
+  return n
+}
+
+func atogid(s string) int64 {
+  gid, err := strconv.ParseInt(s, 10, 64)
+  if err != nil {
+    fail("bad gid %q", s)
+  }
+  return gid
+}
+
+func main() {
+  if len(os.Args) < 3 {
+    usage()
+  }
+  c, err := cluster.Load(os.Args[1])
+  if err != nil {
+    fail("%v", err)
+  }
+  cmd, args := os.Args[2], os.Args[3:]
+
+  switch {
+  case cmd == "get" && len(args) == 1:
+    fmt.Printf("%v\n", kvpaxos.MakeClerk(kv(c)).Get(args[0]))
+  case cmd == "put" && len(args) == 2:
+    kvpaxos.MakeClerk(kv(c)).Put(args[0], args[1])
+  case cmd == "append" && len(args) == 2:
+    kvpaxos.MakeClerk(kv(c)).Append(args[0], args[1])
+  case cmd == "scan" && len(args) >= 1 && len(args) <= 3:
+    end, limit := "", 0
+    if len(args) >= 2 {
+      end = args[1]
+    }
+    if len(args) == 3 {
+      limit = atoi(args[2])
+    }
+    for _, p := range kvpaxos.MakeClerk(kv(c)).Scan(args[0], end, limit) {
+      fmt.Printf("%v %v\n", p.Key, p.Value)
+    }
+  case cmd == "join" && len(args) == 1:
+    gid := atogid(args[0])
+    if c.Groups[gid] == nil {
+      fail("no group %v in %v", gid, os.Args[1])
+    }
+    shardmaster.MakeClerk(sm(c)).Join(gid, cluster.Addrs(c.Groups[gid]))
+  case cmd == "leave" && len(args) == 1:
+    shardmaster.MakeClerk(sm(c)).Leave(atogid(args[0]))
+  case cmd == "move" && len(args) == 2:
+    shard := atoi(args[0])
+    if shard < 0 || shard >= shardmaster.NShards {
+      fail("no shard %v; there are %v", shard, shardmaster.NShards)
+    }
+    // the shardmasters ignore a move to a group that has not
+    // joined, so say so here.
+    ck := shardmaster.MakeClerk(sm(c))
+    gid := atogid(args[1])
+    if _, ok := ck.Query(-1).Groups[gid]; !ok {
+      fail("group %v has not joined", gid)
+    }
+    ck.Move(shard, gid)
+  case cmd == "query" && len(args) <= 1:
+    num := -1
+    if len(args) == 1 {
+      num = atoi(args[0])
+    }
+    printConfig(shardmaster.MakeClerk(sm(c)).Query(num))
+  case cmd == "status" && len(args) == 0:
+    status("kvpaxos", "KVPaxos", cluster.Addrs(c.KVPaxos))
+    status("shardmaster", "ShardMaster", cluster.Addrs(c.ShardMasters))
+    gids := make([]int64, 0, len(c.Groups))
+    for gid := range c.Groups {
+      gids = append(gids, gid)
+    }
+    sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+    for _, gid := range gids {
+      status("group " + strconv.FormatInt(gid, 10), "ShardKV", cluster.Addrs(c.Groups[gid]))
+    }
+  default:
+    usage()
+  }
+}
+
+func kv(c *cluster.Config) []string {
+  if len(c.KVPaxos) == 0 {
+    fail("no kvpaxos servers in %v", os.Args[1])
+  }
+  return cluster.Addrs(c.KVPaxos)
+}
+
+func sm(c *cluster.Config) []string {
+  if len(c.ShardMasters) == 0 {
+    fail("no shardmasters in %v", os.Args[1])
+  }
+  return cluster.Addrs(c.ShardMasters)
+}
+
+func printConfig(config shardmaster.Config) {
+  fmt.Printf("config %v\n", config.Num)
+  for shard, gid := range config.Shards {
+    fmt.Printf("shard %v: %v\n", shard, gid)
+  }
+  gids := make([]int64, 0, len(config.Groups))
+  for gid := range config.Groups {
+    gids = append(gids, gid)
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+  for _, gid := range gids {
+    fmt.Printf("group %v: %v\n", gid, strings.Join(config.Groups[gid], " "))
+  }
+}
+
+//
+// print the Min() and Max() of every replica's log, asking
+// each once, without retrying.
+//
+func status(service string, name string, servers []string) {
+  for i, srv := range servers {
+    var reply paxos.StatusReply
+    if err := call(srv, name + ".Status", &paxos.StatusArgs{}, &reply); err != nil {
+      fmt.Printf("%v %v %v: %v\n", service, i, srv, err)
+    } else {
+      fmt.Printf("%v %v %v: min %v max %v\n", service, i, srv, reply.Min, reply.Max)
+    }
+  }
+}
+
+func call(srv string, rpcname string, args interface{}, reply interface{}) error {
+  c, err := transport.Dial(srv)
+  if err != nil {
+    return err
+  }
+  defer c.Close()
+  return c.Call(rpcname, args, reply)
+}
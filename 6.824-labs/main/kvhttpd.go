@@ -0,0 +1,61 @@
+package main
+
+//
+// HTTP/JSON gateway to the kvpaxos or shardkv servers of
+// a cluster (see kvctl.go, and gateway/gateway.go for the
+// endpoints):
+//
+// ./kvhttpd cluster.json :8080 kvpaxos &
+// curl -X PUT -d '{"value": "v1"}' localhost:8080/kv/key1
+// curl localhost:8080/kv/key1
+// curl 'localhost:8080/range?prefix=key'
+// curl localhost:8080/watch/key
+//
+
+import "cluster"
+import "gateway"
+import "net/http"
+import "os"
+import "fmt"
+
+//
+// how many requests the gateway makes of the servers at
+// once.
+//
+const nclerks = 16
+
+func main() {
+  if len(os.Args) != 4 {
+    fmt.Printf("Usage: kvhttpd cluster.json addr kvpaxos|shardkv\n")
+    os.Exit(1)
+  }
+
+  c, err := cluster.Load(os.Args[1])
+  if err != nil {
+    fmt.Printf("kvhttpd: %v\n", err)
+    os.Exit(1)
+  }
+
+  var st gateway.Store
+  switch os.Args[3] {
+  case "kvpaxos":
+    if len(c.KVPaxos) == 0 {
+      fmt.Printf("kvhttpd: no kvpaxos servers in %v\n", os.Args[1])
+      os.Exit(1)
+    }
+    st = gateway.KVPaxos(cluster.Addrs(c.KVPaxos), nclerks)
+  case "shardkv":
+    if len(c.ShardMasters) == 0 {
+      fmt.Printf("kvhttpd: no shardmasters in %v\n", os.Args[1])
+      os.Exit(1)
+    }
+    st = gateway.ShardKV(cluster.Addrs(c.ShardMasters), nclerks)
+  default:
+    fmt.Printf("kvhttpd: no service %q; kvpaxos or shardkv\n", os.Args[3])
+    os.Exit(1)
+  }
+
+  err = http.ListenAndServe(os.Args[2], gateway.MakeHandler(st))
+  fmt.Printf("kvhttpd: %v\n", err)
+  os.Exit(1)
+}
@@ -0,0 +1,45 @@
+package main
+
+//
+// see directions in kvctl.go
+//
+
+import "time"
+import "kvpaxos"
+import "cluster"
+import "os"
+import "fmt"
+
+func main() {
+  if len(os.Args) != 3 {
+    fmt.Printf("Usage: kvpaxosd cluster.json me\n")
+    os.Exit(1)
+  }
+
+  c, err := cluster.Load(os.Args[1])
+  if err != nil {
+    fmt.Printf("kvpaxosd: %v\n", err)
+    os.Exit(1)
+  }
+  me, err := cluster.Index("kvpaxos", c.KVPaxos, os.Args[2])
+  if err != nil {
+    fmt.Printf("kvpaxosd: %v\n", err)
+    os.Exit(1)
+  }
+
+  if err := cluster.Prepare(c.Backend, c.KVPaxos[me]); err != nil {
+    fmt.Printf("kvpaxosd: %v\n", err)
+    os.Exit(1)
+  }
+
+  opts := []kvpaxos.Option{kvpaxos.DataDir(c.KVPaxos[me].Dir)}
+  switch c.Backend {
+  case cluster.Raft:
+    opts = append(opts, kvpaxos.Raft())
+  case cluster.EPaxos:
+    opts = append(opts, kvpaxos.EPaxos())
+  }
+  kvpaxos.StartServer(cluster.Addrs(c.KVPaxos), me, opts...)
+
+  for { time.Sleep(100 * time.Second) }
+}
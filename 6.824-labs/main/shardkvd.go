@@ -0,0 +1,52 @@
+package main
+
+//
+// see directions in kvctl.go
+//
+
+import "time"
+import "shardkv"
+import "cluster"
+import "os"
+import "fmt"
+import "strconv"
+
+func main() {
+  if len(os.Args) != 4 {
+    fmt.Printf("Usage: shardkvd cluster.json gid me\n")
+    os.Exit(1)
+  }
+
+  c, err := cluster.Load(os.Args[1])
+  if err != nil {
+    fmt.Printf("shardkvd: %v\n", err)
+    os.Exit(1)
+  }
+  gid, err := strconv.ParseInt(os.Args[2], 10, 64)
+  if err != nil || c.Groups[gid] == nil {
+    fmt.Printf("shardkvd: no group %v in %v\n", os.Args[2], os.Args[1])
+    os.Exit(1)
+  }
+  me, err := cluster.Index("group " + os.Args[2], c.Groups[gid], os.Args[3])
+  if err != nil {
+    fmt.Printf("shardkvd: %v\n", err)
+    os.Exit(1)
+  }
+
+  if err := cluster.Prepare(c.Backend, c.Groups[gid][me]); err != nil {
+    fmt.Printf("shardkvd: %v\n", err)
+    os.Exit(1)
+  }
+
+  opts := []shardkv.Option{shardkv.DataDir(c.Groups[gid][me].Dir)}
+  switch c.Backend {
+  case cluster.Raft:
+    opts = append(opts, shardkv.Raft())
+  case cluster.EPaxos:
+    fmt.Printf("shardkvd: shardkv does not run on epaxos\n")
+    os.Exit(1)
+  }
+  shardkv.StartServer(gid, cluster.Addrs(c.ShardMasters), cluster.Addrs(c.Groups[gid]), me, opts...)
+
+  for { time.Sleep(100 * time.Second) }
+}
@@ -0,0 +1,46 @@
+package main
+
+//
+// see directions in kvctl.go
+//
+
+import "time"
+import "shardmaster"
+import "cluster"
+import "os"
+import "fmt"
+
+func main() {
+  if len(os.Args) != 3 {
+    fmt.Printf("Usage: shardmasterd cluster.json me\n")
+    os.Exit(1)
+  }
+
+  c, err := cluster.Load(os.Args[1])
+  if err != nil {
+    fmt.Printf("shardmasterd: %v\n", err)
+    os.Exit(1)
+  }
+  me, err := cluster.Index("shardmasters", c.ShardMasters, os.Args[2])
+  if err != nil {
+    fmt.Printf("shardmasterd: %v\n", err)
+    os.Exit(1)
+  }
+
+  if err := cluster.Prepare(c.Backend, c.ShardMasters[me]); err != nil {
+    fmt.Printf("shardmasterd: %v\n", err)
+    os.Exit(1)
+  }
+
+  opts := []shardmaster.Option{shardmaster.DataDir(c.ShardMasters[me].Dir)}
+  switch c.Backend {
+  case cluster.Raft:
+    opts = append(opts, shardmaster.Raft())
+  case cluster.EPaxos:
+    fmt.Printf("shardmasterd: shardmaster does not run on epaxos\n")
+    os.Exit(1)
+  }
+  shardmaster.StartServer(cluster.Addrs(c.ShardMasters), me, opts...)
+
+  for { time.Sleep(100 * time.Second) }
+}
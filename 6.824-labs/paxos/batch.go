@@ -0,0 +1,255 @@
+package paxos
+
+//
+// batching and pipelining.
+//
+// Start() makes the application pick an instance for every
+// value. Submit() leaves that to the library instead: values
+// submitted at about the same time go into one instance as
+// a Batch, and up to a few batches are proposed at once.
+//
+// a follower hands its batches to the leader (Append), so
+// that only the leader picks instances and batches from
+// different peers do not fight over the same ones. without
+// a leader, a peer proposes its batch itself at the next
+// instance it does not know to be taken.
+//
+// if some other value wins the instance a batch went to,
+// the batch, id and all, is proposed again at a later one.
+// the same happens if the instance is compacted away before
+// this peer learns what was decided there, or if the
+// leader's reply to Append is lost, so a batch can (rarely)
+// be decided twice. Decisions() delivers a batch it has
+// already delivered, in the last dedupWindow instances, as
+// a nil Value (see notify.go); Status() shows both.
+//
+
+import "time"
+import crand "crypto/rand"
+import "math/big"
+
+//
+// how many times a follower tries to hand a batch to the
+// leader, handoffWait apart, before proposing it itself.
+// a batch the leader took but whose reply was lost every
+// time ends up in the log twice, so keep trying a while.
+//
+const handoffTries = 10
+const handoffWait = 10 * time.Millisecond
+
+//
+// the value of an instance that holds submitted values,
+// in the order they were submitted on one peer.
+//
+type Batch struct {
+	Id     int64
+	Values []interface{}
+}
+
+//
+// Batching puts up to max submitted values in a batch,
+// and waits up to delay for a batch to fill before
+// proposing it. the default is max=1, delay=0.
+//
+func Batching(max int, delay time.Duration) Option {
+	return func(px *Paxos) {
+		if max < 1 {
+			max = 1
+		}
+		px.maxBatch = max
+		px.maxDelay = delay
+	}
+}
+
+//
+// Pipeline lets up to depth batches be in flight at
+// once, at most Alpha. the default is 1.
+//
+func Pipeline(depth int) Option {
+	return func(px *Paxos) {
+		if depth < 1 {
+			depth = 1
+		}
+		if depth > Alpha {
+			depth = Alpha
+		}
+		px.depth = depth
+	}
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := crand.Int(crand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
+
+//
+// the application wants v in the log, and does not care
+// where. Submit() returns right away; v shows up in
+// Status() and Decisions() as part of a Batch.
+//
+func (px *Paxos) Submit(v interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if len(px.queue) == 0 {
+		px.queuedAt = time.Now()
+	}
+	px.queue = append(px.queue, v)
+	px.cond.Broadcast()
+}
+
+//
+// turn queued values into batches and propose them.
+//
+func (px *Paxos) batcher() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	for px.dead == false {
+		if len(px.queue) == 0 && len(px.retry) == 0 || len(px.inflight)+px.handoffs >= px.depth || px.me < 0 {
+			px.cond.Wait()
+			continue
+		}
+
+		var b Batch
+		if len(px.retry) > 0 {
+			b = px.retry[0]
+			px.retry = px.retry[1:]
+		} else if wait := px.maxDelay - time.Since(px.queuedAt); len(px.queue) < px.maxBatch && wait > 0 {
+			px.mu.Unlock()
+			time.Sleep(wait)
+			px.mu.Lock()
+			continue
+		} else {
+			n := len(px.queue)
+			if n > px.maxBatch {
+				n = px.maxBatch
+			}
+			b = Batch{nrand(), make([]interface{}, n)}
+			copy(b.Values, px.queue)
+			px.queue = px.queue[n:]
+			px.queuedAt = time.Now()
+		}
+
+		if px.leader >= 0 && px.leader != px.me && px.leader < len(px.peers) {
+			px.handoffs++
+			go px.handoff(px.peers[px.leader], b)
+		} else {
+			px.propose1(px.slot(), b)
+		}
+	}
+}
+
+//
+// the next instance nobody is known to use.
+// px.mu must be held.
+//
+func (px *Paxos) slot() int {
+	if px.max+1 < px.floor() {
+		return px.floor()
+	}
+	return px.max + 1
+}
+
+//
+// px.mu must be held.
+//
+func (px *Paxos) propose1(seq int, b Batch) {
+	// the leader may pick an instance I proposed another
+	// batch at; at most one of them wins.
+	px.inflight[seq] = append(px.inflight[seq], b)
+	if inst, ok := px.instances[seq]; ok && inst.decided {
+		px.settle(seq, inst.va, true)
+	} else if seq < px.floor() {
+		px.settle(seq, nil, false)
+	} else {
+		px.startProposer(seq, b)
+	}
+}
+
+//
+// ask the leader to put b in an instance; propose it
+// myself if the leader does not answer.
+//
+func (px *Paxos) handoff(leader string, b Batch) {
+	px.mu.Lock()
+	args := &AppendArgs{b, px.copyDones()}
+	px.mu.Unlock()
+
+	// retrying with the same batch gets the same instance,
+	// so a lost reply does not put b in the log twice.
+	var reply AppendReply
+	ok := false
+	for i := 0; i < handoffTries && !ok && px.dead == false; i++ {
+		if i > 0 {
+			time.Sleep(handoffWait)
+		}
+		ok = call(leader, "Paxos.Append", args, &reply)
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.handoffs--
+	if ok {
+		px.merge(reply.Dones)
+	}
+	if ok && reply.Err == OK {
+		px.instance(reply.Seq)
+		px.propose1(reply.Seq, b)
+	} else {
+		// propose() forwards to the leader, or takes
+		// over if it is gone.
+		px.propose1(px.slot(), b)
+	}
+	px.cond.Broadcast()
+}
+
+//
+// Append RPC handler: the leader puts a follower's batch
+// in the next free instance.
+//
+func (px *Paxos) Append(args *AppendArgs, reply *AppendReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	if seq, ok := px.appended[args.Batch.Id]; ok {
+		reply.Err = OK
+		reply.Seq = seq
+	} else if px.isLeader() {
+		reply.Err = OK
+		reply.Seq = px.slot()
+		px.appended[args.Batch.Id] = reply.Seq
+		px.startProposer(reply.Seq, args.Batch)
+	} else {
+		reply.Err = NotLeader
+	}
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// instance seq is decided, or forgotten if decided is
+// false. if a batch of mine was headed there and did not
+// make it, propose it again; it may have made it somewhere
+// else, so it keeps its id. px.mu must be held.
+//
+func (px *Paxos) settle(seq int, v interface{}, decided bool) {
+	bs, ok := px.inflight[seq]
+	if !ok {
+		return
+	}
+	delete(px.inflight, seq)
+	for _, b := range bs {
+		if x, isb := v.(Batch); decided && isb && x.Id == b.Id {
+			continue
+		}
+		px.retry = append(px.retry, b)
+	}
+	px.cond.Broadcast()
+}
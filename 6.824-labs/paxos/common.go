@@ -0,0 +1,132 @@
+package paxos
+
+//
+// RPC definitions for the Paxos peers.
+//
+// Every message carries the sender's view of the highest
+// Done() argument of each peer, so that Min() can advance
+// without any extra traffic.
+//
+
+const (
+	OK        = "OK"
+	Reject    = "Reject"
+	Forgotten = "Forgotten"
+	NotLeader = "NotLeader"
+)
+
+type Err string
+
+//
+// Prepare(ballot): phase 1 of Multi-Paxos. A promise covers
+// every instance >= From, so a leader only has to run it once.
+//
+type PrepareArgs struct {
+	Ballot int
+	From   int
+	Dones  []int
+}
+
+type PrepareReply struct {
+	Err       Err
+	Promised  int              // acceptor's highest promised ballot
+	Instances map[int]Accepted // instances >= From with an accepted value
+	Compacted int              // acceptor's snapshot covers instances <= Compacted
+	Dones     []int
+}
+
+type Accepted struct {
+	Na      int
+	Va      interface{}
+	Decided bool
+}
+
+//
+// Accept(seq, ballot, value): phase 2 for a single instance.
+//
+type AcceptArgs struct {
+	Seq    int
+	Ballot int
+	Value  interface{}
+	Dones  []int
+}
+
+type AcceptReply struct {
+	Err       Err
+	Promised  int
+	Decided   bool
+	Value     interface{}
+	Compacted int
+	Dones     []int
+}
+
+type DecidedArgs struct {
+	Seq   int
+	Value interface{}
+	Dones []int
+}
+
+type DecidedReply struct {
+	Dones []int
+}
+
+//
+// Forward(seq, value): a follower hands a proposal
+// to the peer it believes is the leader.
+//
+type ForwardArgs struct {
+	Seq   int
+	Value interface{}
+	Dones []int
+}
+
+type ForwardReply struct {
+	Err       Err
+	Decided   bool
+	Value     interface{}
+	Compacted int
+	Dones     []int
+}
+
+//
+// Append(batch): a follower hands a batch of submitted
+// values to the leader, which picks the instance.
+//
+type AppendArgs struct {
+	Batch Batch
+	Dones []int
+}
+
+type AppendReply struct {
+	Err   Err
+	Seq   int
+	Dones []int
+}
+
+//
+// Heartbeat(ballot): the leader checks that a majority
+// still follows it, and renews its lease (see lease.go).
+//
+type HeartbeatArgs struct {
+	Ballot int
+	Dones  []int
+}
+
+type HeartbeatReply struct {
+	Err      Err
+	Promised int
+	Dones    []int
+}
+
+//
+// Index(): a follower asks the leader for a read index.
+//
+type IndexArgs struct {
+	Dones []int
+}
+
+type IndexReply struct {
+	Err   Err
+	Seq   int
+	Dones []int
+}
@@ -0,0 +1,401 @@
+package paxos
+
+//
+// dynamic membership.
+//
+// every peer has an id, its index in px.peers; ids are
+// handed out in log order and never reused, so px.peers
+// only grows. a Reconfig value decided at instance N names
+// the voting peers for instances N+Alpha and later.
+//
+// a peer proposes for instance s only once it knows every
+// decision up to s-Alpha, so it always knows which peers
+// vote on s. Alpha is therefore also the number of
+// instances that can be in flight at once.
+//
+// a configuration can also name learners: peers that are
+// sent every decision, and fetch snapshots like anybody
+// else, but never vote, never lead, and do not hold back
+// Min() for the voters. a learner's Start()ed and
+// Submit()ted values go to the leader. Promote() turns a
+// learner into a voter through the log. since the voters
+// forget instances without waiting for learners, a learner
+// that falls behind relies on their snapshots.
+//
+// reconfiguration needs every peer to call a given peer by
+// the same name. a new peer is started with the Join()
+// option; it fetches the membership and the decided
+// instances from the other peers it was given, until it
+// finds itself in the set. instances that everybody has
+// already forgotten (see Min()) cannot be fetched.
+//
+
+import "time"
+import "sort"
+import "math/rand"
+
+const Alpha = 32
+
+//
+// start agreement on a Reconfig to change the set of
+// voting peers. applications see it in Status() like any
+// other value and should skip it. a Reconfig holds a
+// slice, so compare them with reflect.DeepEqual, not ==.
+//
+// if Learners is nil, the learners stay as they were,
+// less any that Peers makes voters.
+//
+type Reconfig struct {
+	Peers    []string
+	Learners []string
+}
+
+type config struct {
+	Start    int   // first instance this set votes on
+	Ids      []int // ids of the voting peers
+	Learners []int // ids of the learners
+	Q1       int   // quorum sizes, see quorum.go
+	Q2       int
+	Rows     int
+}
+
+type FetchArgs struct {
+	From int
+}
+
+type FetchReply struct {
+	Promised int // so that a learner finds the leader
+	Peers    []string
+	Configs  []config
+	Prefix   int                 // Peers and Configs are as of this instance
+	Decided  map[int]interface{} // decided instances >= From
+	Snapshot *snapshot           // if From has been compacted away
+	Dones    []int
+}
+
+//
+// Join makes a peer that was not part of the initial set
+// wait until a Reconfig adds it, catching up from the
+// other peers in peers[].
+//
+func Join() Option {
+	return func(px *Paxos) {
+		px.joining = true
+	}
+}
+
+//
+// Learners makes peers[id] a learner for each of ids; the
+// other peers vote. every peer has to be given the same
+// option.
+//
+func Learners(ids ...int) Option {
+	return func(px *Paxos) {
+		c := &px.configs[0]
+		c.Ids = nil
+		for id := range px.peers {
+			if contains(ids, id) {
+				c.Learners = append(c.Learners, id)
+			} else {
+				c.Ids = append(c.Ids, id)
+			}
+		}
+	}
+}
+
+//
+// start agreement on instance seq for a Reconfig that
+// makes learner addr a voter, leaving the other voters
+// and learners as they are now.
+//
+func (px *Paxos) Promote(seq int, addr string) {
+	px.mu.Lock()
+	var r Reconfig
+	if len(px.configs) > 0 {
+		c := px.configs[len(px.configs)-1]
+		for _, id := range c.Ids {
+			r.Peers = append(r.Peers, px.peers[id])
+		}
+		r.Learners = []string{}
+		for _, id := range c.Learners {
+			if px.peers[id] != addr {
+				r.Learners = append(r.Learners, px.peers[id])
+			}
+		}
+	}
+	r.Peers = append(r.Peers, addr)
+	px.mu.Unlock()
+
+	px.Start(seq, r)
+}
+
+func contains(ids []int, id int) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// the set of peers that votes on instance seq.
+// px.mu must be held.
+//
+func (px *Paxos) configFor(seq int) config {
+	var c config
+	for _, x := range px.configs {
+		if x.Start <= seq {
+			c = x
+		}
+	}
+	return c
+}
+
+//
+// the configurations that still vote on some instance
+// beyond the decided prefix.
+//
+func (px *Paxos) active() []config {
+	for i := len(px.configs) - 1; i >= 0; i-- {
+		if px.configs[i].Start <= px.prefix+1 {
+			return px.configs[i:]
+		}
+	}
+	return px.configs
+}
+
+func (px *Paxos) activeIds() []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, c := range px.active() {
+		for _, id := range c.Ids {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+//
+// the learners of the active configurations that do not
+// also vote in one of them.
+//
+func (px *Paxos) learnerIds() []int {
+	voters := px.activeIds()
+	var ids []int
+	for _, c := range px.active() {
+		for _, id := range c.Learners {
+			if !contains(voters, id) && !contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+//
+// may this peer vote, and so lead? px.mu must be held.
+//
+func (px *Paxos) voting() bool {
+	return px.me >= 0 && contains(px.activeIds(), px.me)
+}
+
+func (px *Paxos) lookup(addr string) int {
+	for id, p := range px.peers {
+		if p == addr {
+			return id
+		}
+	}
+	return -1
+}
+
+//
+// extend the decided prefix as far as possible, acting on
+// Reconfigs in log order. px.mu must be held.
+//
+func (px *Paxos) advance() {
+	for px.me >= 0 {
+		next := px.prefix + 1
+		inst, ok := px.instances[next]
+		if ok && inst.decided {
+			if r, isr := inst.va.(Reconfig); isr {
+				px.reconfigure(next, r)
+			}
+		} else if next >= px.floor() {
+			break
+		}
+		px.prefix = next
+	}
+}
+
+func (px *Paxos) reconfigure(seq int, r Reconfig) {
+	var ids []int
+	for _, addr := range r.Peers {
+		ids = append(ids, px.add(addr))
+	}
+	var learners []int
+	if r.Learners != nil {
+		for _, addr := range r.Learners {
+			learners = append(learners, px.add(addr))
+		}
+	} else if len(px.configs) > 0 {
+		for _, id := range px.configs[len(px.configs)-1].Learners {
+			if !contains(ids, id) {
+				learners = append(learners, id)
+			}
+		}
+	}
+	if len(ids) > 0 {
+		c := config{Start: seq + Alpha, Ids: ids, Learners: learners}
+		if len(px.configs) > 0 {
+			last := px.configs[len(px.configs)-1]
+			c.Q1, c.Q2, c.Rows = last.Q1, last.Q2, last.Rows
+			if c.check() != nil {
+				// they do not fit the new set.
+				c.Q1, c.Q2, c.Rows = 0, 0, 0
+			}
+		}
+		px.configs = append(px.configs, c)
+		// my promises were counted against the old sets;
+		// the next proposal has to run phase 1 again.
+		px.ballot = -1
+	}
+}
+
+//
+// the id of the peer at addr, which is new if there is
+// none yet.
+//
+func (px *Paxos) add(addr string) int {
+	id := px.lookup(addr)
+	if id < 0 {
+		// a new peer must not pull Min() backwards.
+		px.dones = append(px.dones, px.min()-1)
+		px.peers = append(px.peers, addr)
+		id = len(px.peers) - 1
+	}
+	return id
+}
+
+//
+// Fetch RPC handler: the membership and every decided
+// instance >= args.From, for peers that are catching up.
+//
+func (px *Paxos) Fetch(args *FetchArgs, reply *FetchReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.me < 0 {
+		return nil
+	}
+	reply.Promised = px.np
+	reply.Peers = make([]string, len(px.peers))
+	copy(reply.Peers, px.peers)
+	reply.Configs = make([]config, len(px.configs))
+	copy(reply.Configs, px.configs)
+	reply.Prefix = px.prefix
+	reply.Decided = make(map[int]interface{})
+	for seq, inst := range px.instances {
+		if seq >= args.From && inst.decided {
+			reply.Decided[seq] = inst.va
+		}
+	}
+	if args.From <= px.snap.Seq {
+		snap := px.snap
+		reply.Snapshot = &snap
+	}
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// pull decisions beyond the prefix from some other voting
+// peer, for when this peer has fallen too far behind
+// to propose.
+//
+func (px *Paxos) catchup() {
+	px.mu.Lock()
+	args := &FetchArgs{px.prefix + 1}
+	var srvs []string
+	for _, id := range px.activeIds() {
+		if id != px.me {
+			srvs = append(srvs, px.peers[id])
+		}
+	}
+	px.mu.Unlock()
+
+	for _, i := range rand.Perm(len(srvs)) {
+		var reply FetchReply
+		if call(srvs[i], "Paxos.Fetch", args, &reply) && reply.Peers != nil {
+			px.mu.Lock()
+			px.install(&reply)
+			px.merge(reply.Dones)
+			if !px.voting() {
+				px.observe(reply.Promised)
+			}
+			for seq, v := range reply.Decided {
+				if seq >= px.floor() {
+					px.learn(seq, v)
+				}
+			}
+			// a peer that has not compacted as far as
+			// somebody else cannot fill the gap.
+			behind := px.prefix < px.compacted
+			px.mu.Unlock()
+			if !behind {
+				return
+			}
+		}
+	}
+}
+
+//
+// wait for a Reconfig that adds self, fetching the
+// membership from the peers in seeds.
+//
+func (px *Paxos) join(self string, seeds []string) {
+	for px.dead == false {
+		for _, srv := range seeds {
+			var reply FetchReply
+			if call(srv, "Paxos.Fetch", &FetchArgs{0}, &reply) && px.adopt(self, &reply) {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (px *Paxos) adopt(self string, reply *FetchReply) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	me := -1
+	for id, p := range reply.Peers {
+		if p == self {
+			me = id
+		}
+	}
+	if me < 0 || len(reply.Dones) != len(reply.Peers) {
+		return false
+	}
+	px.peers = reply.Peers
+	px.configs = reply.Configs
+	px.prefix = reply.Prefix
+	px.dones = reply.Dones
+	px.me = me
+	for seq, v := range reply.Decided {
+		if seq >= px.floor() {
+			px.learn(seq, v)
+		}
+	}
+	px.advance()
+	if px.wal != nil {
+		px.checkpoint()
+	}
+	return true
+}
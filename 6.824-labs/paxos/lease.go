@@ -0,0 +1,244 @@
+package paxos
+
+//
+// leader leases and read indexes.
+//
+// a linearizable read has to see every value decided
+// before the read began. the application gets that by
+// putting the read in the log, or more cheaply by asking
+// ReadIndex() for an instance, waiting until it has applied
+// every instance up to that one, and then reading its own
+// state.
+//
+// any instance decided so far is <= the leader's Max(): a
+// new leader learns of every value that may have been
+// chosen when it runs phase 1, and after that values are
+// only chosen at its ballot. so the leader can give out
+// its Max() as a read index, as long as it is sure it is
+// still the leader. without a lease it makes sure by
+// sending a round of heartbeats and hearing back from a
+// phase 2 quorum, which meets every phase 1 quorum.
+//
+// with the Leases() option, the leader sends heartbeats
+// every heartbeatEvery. a peer that answers one promises
+// not to answer another peer's Prepare for leaseTime. once
+// a phase 2 quorum has answered a heartbeat sent at time t, the
+// leader knows nobody else can become leader before t +
+// leaseTime by the other peers' clocks, and so before t +
+// leaseTime - clockDrift by its own. until then ReadIndex()
+// answers without any messages.
+//
+// a peer that crashes forgets the leases it granted. a
+// peer with a DataDir() therefore honours no Prepare at all
+// for leaseTime after it starts.
+//
+
+import "time"
+
+const heartbeatEvery = 50 * time.Millisecond
+const leaseTime = 500 * time.Millisecond
+
+//
+// how far the clocks of two peers may drift apart over
+// leaseTime.
+//
+const clockDrift = leaseTime / 10
+
+//
+// Leases makes the leader hold a lease, so that ReadIndex()
+// on the leader needs no messages. every peer has to be
+// given the same option.
+//
+func Leases() Option {
+	return func(px *Paxos) {
+		px.lease = true
+	}
+}
+
+//
+// an instance that a linearizable read starting now may
+// be served at: once the application has applied every
+// instance <= seq, its state reflects every value decided
+// before the call. ok is false if no leader could vouch
+// for seq; the application should then put the read in
+// the log.
+//
+func (px *Paxos) ReadIndex() (int, bool) {
+	px.mu.Lock()
+	seq := px.max
+	if px.holdsLease() {
+		px.mu.Unlock()
+		return seq, true
+	}
+	leading := px.isLeader()
+	leader := ""
+	if px.leader >= 0 && px.leader != px.me && px.leader < len(px.peers) {
+		leader = px.peers[px.leader]
+	}
+	args := &IndexArgs{px.copyDones()}
+	px.mu.Unlock()
+
+	if leading {
+		return seq, px.confirm()
+	} else if leader == "" {
+		return -1, false
+	}
+
+	var reply IndexReply
+	if call(leader, "Paxos.Index", args, &reply) == false {
+		return -1, false
+	}
+	px.mu.Lock()
+	px.merge(reply.Dones)
+	px.mu.Unlock()
+	return reply.Seq, reply.Err == OK
+}
+
+//
+// Index RPC handler: ReadIndex() on behalf of a follower.
+//
+func (px *Paxos) Index(args *IndexArgs, reply *IndexReply) error {
+	px.mu.Lock()
+	px.merge(args.Dones)
+	leading := px.isLeader()
+	lease := px.holdsLease()
+	reply.Seq = px.max
+	px.mu.Unlock()
+
+	if lease || (leading && px.confirm()) {
+		reply.Err = OK
+	} else {
+		reply.Err = NotLeader
+	}
+
+	px.mu.Lock()
+	reply.Dones = px.copyDones()
+	px.mu.Unlock()
+
+	return nil
+}
+
+//
+// px.mu must be held.
+//
+func (px *Paxos) holdsLease() bool {
+	return px.isLeader() && px.leaseBallot == px.ballot &&
+		time.Now().Before(px.leaseUntil)
+}
+
+//
+// has this peer promised somebody other than the owner
+// of ballot not to elect a new leader for now?
+// px.mu must be held.
+//
+func (px *Paxos) leased(ballot int) bool {
+	return time.Now().Before(px.grantedUntil) && px.owner(ballot) != px.grantedTo
+}
+
+//
+// send one round of heartbeats. returns true if a phase 2
+// quorum of every set of voting peers still follows my ballot, in
+// which case my lease is extended.
+//
+func (px *Paxos) confirm() bool {
+	px.mu.Lock()
+	if !px.isLeader() {
+		px.mu.Unlock()
+		return false
+	}
+	ballot := px.ballot
+	args := &HeartbeatArgs{ballot, px.copyDones()}
+	configs := px.active()
+	peers := px.addrs(px.activeIds())
+	px.mu.Unlock()
+
+	sent := time.Now()
+	acks := make(chan int, len(peers))
+	for id, addr := range peers {
+		go func(id int, addr string) {
+			var reply HeartbeatReply
+			ok := true
+			if id == px.me {
+				px.Heartbeat(args, &reply)
+			} else {
+				ok = call(addr, "Paxos.Heartbeat", args, &reply)
+			}
+			if ok {
+				px.mu.Lock()
+				px.merge(reply.Dones)
+				px.observe(reply.Promised)
+				px.mu.Unlock()
+			}
+			if ok && reply.Err == OK {
+				acks <- id
+			} else {
+				acks <- -1
+			}
+		}(id, addr)
+	}
+
+	votes := make(map[int]bool)
+	for i := 0; i < len(peers) && !quorums2(configs, votes); i++ {
+		if id := <-acks; id >= 0 {
+			votes[id] = true
+		}
+	}
+	if !quorums2(configs, votes) {
+		return false
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.ballot != ballot || !px.isLeader() {
+		return false
+	}
+	if px.lease {
+		until := sent.Add(leaseTime - clockDrift)
+		if px.leaseBallot != ballot || until.After(px.leaseUntil) {
+			px.leaseBallot = ballot
+			px.leaseUntil = until
+		}
+	}
+	return true
+}
+
+//
+// Heartbeat RPC handler.
+//
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	if px.me >= 0 && args.Ballot >= px.np {
+		px.observe(args.Ballot)
+		if px.lease {
+			px.grantedTo = px.owner(args.Ballot)
+			px.grantedUntil = time.Now().Add(leaseTime)
+		}
+		reply.Err = OK
+	} else {
+		reply.Err = Reject
+	}
+	reply.Promised = px.np
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// keep my lease while I am the leader.
+//
+func (px *Paxos) heartbeat() {
+	for px.dead == false {
+		px.mu.Lock()
+		leading := px.isLeader()
+		px.mu.Unlock()
+		if leading {
+			px.confirm()
+		}
+		time.Sleep(heartbeatEvery)
+	}
+}
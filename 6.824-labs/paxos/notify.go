@@ -0,0 +1,168 @@
+package paxos
+
+//
+// blocking and streaming ways to learn about decisions,
+// so that applications need not poll Status().
+//
+// px.cond is signalled whenever an instance is decided, a
+// snapshot is installed, Done() moves Min(), a value is
+// submitted (see batch.go), or the peer is killed.
+//
+
+import "time"
+
+//
+// how long Decisions() waits on an instance that it knows
+// was started, this one or a later one, before it proposes
+// nil there to find out what it holds. the Decided message
+// may have been lost, and the last instance started has no
+// later ones to give that away.
+//
+const holeWait = 500 * time.Millisecond
+
+//
+// Decisions() remembers the ids of the batches it has
+// delivered in the last dedupWindow instances, and delivers
+// a batch decided again among them as a nil Value. a repeat
+// comes from a retry soon after the first try, so is never
+// that far back.
+//
+const dedupWindow = 1000
+
+//
+// signal px.cond after d.
+//
+func (px *Paxos) wakeup(d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		px.mu.Lock()
+		px.cond.Broadcast()
+		px.mu.Unlock()
+	})
+}
+
+//
+// one entry of the Decisions() stream. either Value is the
+// value decided for instance Seq, or Snapshot is non-nil
+// and holds the application state after every instance
+// <= Seq, fetched because this peer fell behind.
+//
+type Decision struct {
+	Seq      int
+	Value    interface{}
+	Snapshot []byte
+}
+
+//
+// wait up to timeout for instance seq to be decided.
+// returns right away, with false, if seq has been
+// forgotten or the peer is killed.
+//
+func (px *Paxos) WaitDecided(seq int, timeout time.Duration) (bool, interface{}) {
+	deadline := time.Now().Add(timeout)
+	defer px.wakeup(timeout).Stop()
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	for {
+		if seq < px.floor() {
+			return false, nil
+		}
+		inst, ok := px.instances[seq]
+		if ok && inst.decided {
+			return true, inst.va
+		}
+		if px.dead || !time.Now().Before(deadline) {
+			return false, nil
+		}
+		px.cond.Wait()
+	}
+}
+
+//
+// a channel of decided instances, in order, starting at
+// Min() (preceded by the snapshot, if the peer holds one
+// that ends just before Min()). a jump over instances the
+// application has called Done() on is silent; a jump over
+// instances compacted into a fetched snapshot delivers the
+// snapshot. an instance that stays undecided while later
+// ones are decided gets proposed nil, so a hole left by a
+// crashed proposer shows up as a nil Value, as does a
+// batch decided a second time. the channel is closed when
+// the peer is killed. every call returns the same channel.
+//
+func (px *Paxos) Decisions() <-chan Decision {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.decisions == nil {
+		px.decisions = make(chan Decision)
+		next := px.floor()
+		if px.snap.Seq >= 0 && px.snap.Seq == next-1 {
+			next = px.snap.Seq
+		}
+		go px.deliver(px.decisions, next)
+	}
+	return px.decisions
+}
+
+func (px *Paxos) deliver(ch chan Decision, next int) {
+	defer close(ch)
+
+	for {
+		px.mu.Lock()
+		var d Decision
+		var stuck time.Time
+		for {
+			inst, ok := px.instances[next]
+			if px.dead {
+				px.mu.Unlock()
+				return
+			} else if next <= px.snap.Seq {
+				d = Decision{Seq: px.snap.Seq, Snapshot: px.snap.State}
+				next = px.snap.Seq + 1
+				px.delivered = make(map[int64]int)
+				for id, seq := range px.snap.Batches {
+					px.delivered[id] = seq
+				}
+				break
+			} else if next < px.floor() {
+				next = px.floor()
+			} else if ok && inst.decided {
+				d = Decision{Seq: next, Value: inst.va}
+				if b, isb := inst.va.(Batch); isb {
+					if seq, again := px.delivered[b.Id]; again && next-seq < dedupWindow {
+						d.Value = nil
+					} else {
+						px.delivered[b.Id] = next
+					}
+				}
+				if next%dedupWindow == 0 {
+					for id, seq := range px.delivered {
+						if seq <= next-2*dedupWindow {
+							delete(px.delivered, id)
+						}
+					}
+				}
+				next++
+				break
+			} else if px.max >= next && stuck.IsZero() {
+				stuck = time.Now()
+				px.wakeup(holeWait)
+				px.cond.Wait()
+			} else if px.max >= next && time.Since(stuck) >= holeWait {
+				px.startProposer(next, nil)
+				stuck = time.Time{}
+			} else {
+				px.cond.Wait()
+			}
+		}
+		px.mu.Unlock()
+
+		select {
+		case ch <- d:
+		case <-px.killed:
+			return
+		}
+	}
+}
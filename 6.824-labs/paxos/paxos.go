@@ -6,28 +6,52 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers can be changed through the log (see config.go).
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Keeps nothing on disk unless given a DataDir() option, in which
+// case promises and accepted values are logged and recovered, so
+// a peer can handle crash+restart.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = paxos.Make(peers []string, me string, rpcs *rpc.Server, opts ...Option)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Snapshot(seq int, state []byte) -- application state up to seq
+// px.Restore(seq int) (last int, state []byte, ok bool) -- catch up
+// px.Promote(seq int, peer string) -- make a learner vote (see config.go)
+// px.WaitDecided(seq int, timeout) (decided bool, v interface{}) -- block on Status()
+// px.Decisions() <-chan Decision -- decided instances, in order
+// px.Submit(v interface{}) -- put v in some instance, batched (see batch.go)
+// px.ReadIndex() (seq int, ok bool) -- for linearizable reads (see lease.go)
+//
+// This is Multi-Paxos with a distinguished leader. A peer that
+// completes phase 1 (Prepare) holds a promise from a quorum
+// for every instance, so from then on it only has to run phase 2
+// (Accept) for each new instance. Other peers forward their
+// proposals to the leader. If an instance a peer is waiting on
+// stops advancing, that peer runs phase 1 itself and takes over.
+// Quorums are majorities unless configured otherwise (see quorum.go).
 //
 
 import "net"
 import "net/rpc"
+import "transport"
 import "log"
-import "os"
-import "syscall"
 import "sync"
 import "fmt"
 import "math/rand"
+import "time"
+import "encoding/gob"
+
+// how long a follower waits on the leader before poking it again.
+const forwardWait = 300 * time.Millisecond
+
+// forwards without progress before a follower takes over.
+const maxStalls = 3
 
 type Paxos struct {
 	mu         sync.Mutex
@@ -35,10 +59,55 @@ type Paxos struct {
 	dead       bool
 	unreliable bool
 	rpcCount   int
-	peers      []string
-	me         int // index into peers[]
+	peers      []string // every peer ever added, indexed by id
+	me         int      // my id, or -1 while joining
+
+	instances map[int]*instance
+	np        int   // highest ballot promised, for all instances
+	dones     []int // highest Done() argument heard from each peer
+	max       int   // highest instance seq known
+	prefix    int   // all instances <= prefix are decided
+	configs   []config
+	joining   bool   // started with Join(), see config.go
+	self      string // my own name, while joining
+
+	leader    int                 // presumed leader, or -1
+	ballot    int                 // ballot of my last successful Prepare
+	bound     map[int]interface{} // values my ballot has to re-propose
+	proposing map[int]bool        // instances with a local proposer
+
+	snap      snapshot // latest snapshot, see snapshot.go
+	compacted int      // highest snapshot seq heard of from any peer
+
+	cond      *sync.Cond    // on mu; see notify.go
+	decisions chan Decision // nil until Decisions() is called
+	delivered map[int64]int // batch id -> instance Decisions() gave it at
+	killed    chan bool     // closed by Kill()
 
-	// Your data here.
+	maxBatch int // see batch.go
+	maxDelay time.Duration
+	depth    int
+	queue    []interface{}   // submitted values not yet in a batch
+	queuedAt time.Time       // when the oldest of them was queued
+	retry    []Batch         // my batches to propose again
+	inflight map[int][]Batch // my batches not yet decided
+	handoffs int             // batches handed to the leader, no answer yet
+	appended map[int64]int   // batch id -> instance, for Append retries
+
+	lease        bool      // see lease.go
+	leaseBallot  int       // ballot my lease is for
+	leaseUntil   time.Time // my lease as leader ends, by my clock
+	grantedTo    int       // the peer I have granted a lease to, or -1
+	grantedUntil time.Time // and when that lease ends, by my clock
+
+	dir string // where the write-ahead log lives, or ""
+	wal *wal
+}
+
+type instance struct {
+	na      int         // highest ballot accepted
+	va      interface{} // value accepted at na, or the decided value
+	decided bool
 }
 
 //
@@ -58,11 +127,10 @@ type Paxos struct {
 // please do not change this function.
 //
 func call(srv string, name string, args interface{}, reply interface{}) bool {
-	c, err := rpc.Dial("unix", srv)
+	c, err := transport.Dial(srv)
 	if err != nil {
-		err1 := err.(*net.OpError)
-		if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-			fmt.Printf("paxos Dial() failed: %v\n", err1)
+		if !transport.IsUnreachable(err) {
+			fmt.Printf("paxos Dial() failed: %v\n", err)
 		}
 		return false
 	}
@@ -75,6 +143,569 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 	return false
 }
 
+//
+// ballots are unique per peer: the low idBits of a
+// ballot are the id of the peer that chose it.
+//
+const idBits = 16
+
+func (px *Paxos) owner(ballot int) int {
+	return ballot & (1<<idBits - 1)
+}
+
+func (px *Paxos) nextBallot() int {
+	return (px.np>>idBits+1)<<idBits | px.me
+}
+
+//
+// note a ballot seen in some message. a higher ballot
+// means somebody else has (or is trying to get) the lead.
+// px.mu must be held.
+//
+func (px *Paxos) observe(ballot int) {
+	if ballot > px.np {
+		px.np = ballot
+		px.leader = px.owner(ballot)
+	}
+}
+
+//
+// am I the leader? true only while my ballot is still the
+// highest one this peer has promised. px.mu must be held.
+//
+func (px *Paxos) isLeader() bool {
+	return px.me >= 0 && px.leader == px.me && px.ballot == px.np
+}
+
+func (px *Paxos) instance(seq int) *instance {
+	inst, ok := px.instances[seq]
+	if !ok {
+		inst = &instance{na: -1}
+		px.instances[seq] = inst
+		if seq > px.max {
+			px.max = seq
+		}
+	}
+	return inst
+}
+
+//
+// Min() is taken over the peers that still vote, and this
+// one, in case it is a learner.
+//
+func (px *Paxos) min() int {
+	ids := px.activeIds()
+	if px.me >= 0 && !contains(ids, px.me) {
+		ids = append(ids, px.me)
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+	m := px.dones[ids[0]]
+	for _, id := range ids {
+		if px.dones[id] < m {
+			m = px.dones[id]
+		}
+	}
+	return m + 1
+}
+
+func (px *Paxos) addrs(ids []int) map[int]string {
+	peers := make(map[int]string)
+	for _, id := range ids {
+		peers[id] = px.peers[id]
+	}
+	return peers
+}
+
+func (px *Paxos) copyDones() []int {
+	dones := make([]int, len(px.dones))
+	copy(dones, px.dones)
+	return dones
+}
+
+//
+// fold another peer's view of the Done() values into
+// ours, and free whatever is no longer needed.
+// px.mu must be held.
+//
+func (px *Paxos) merge(dones []int) {
+	// the sender may know of more or fewer peers.
+	for i := 0; i < len(dones) && i < len(px.dones); i++ {
+		if dones[i] > px.dones[i] {
+			px.dones[i] = dones[i]
+		}
+	}
+	px.forget()
+}
+
+func (px *Paxos) forget() {
+	min := px.floor()
+	for seq := range px.instances {
+		if seq < min {
+			delete(px.instances, seq)
+		}
+	}
+	for seq := range px.bound {
+		if seq < min {
+			delete(px.bound, seq)
+		}
+	}
+	for seq := range px.inflight {
+		if seq < min {
+			px.settle(seq, nil, false)
+		}
+	}
+	for id, seq := range px.appended {
+		if seq < min {
+			delete(px.appended, id)
+		}
+	}
+}
+
+//
+// Prepare RPC handler. a promise covers all instances
+// >= args.From; the reply carries everything this
+// acceptor has accepted in that range.
+//
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	if !px.voting() || px.leased(args.Ballot) {
+		reply.Err = Reject
+	} else if args.Ballot > px.np {
+		px.observe(args.Ballot)
+		px.persist(&logRecord{Kind: recPromise, Np: px.np}, true)
+		reply.Err = OK
+		reply.Instances = make(map[int]Accepted)
+		for seq, inst := range px.instances {
+			if seq >= args.From && (inst.na >= 0 || inst.decided) {
+				reply.Instances[seq] = Accepted{inst.na, inst.va, inst.decided}
+			}
+		}
+	} else {
+		reply.Err = Reject
+	}
+	reply.Promised = px.np
+	reply.Compacted = px.snap.Seq
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// Accept RPC handler.
+//
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	if px.me < 0 || contains(px.configFor(args.Seq).Learners, px.me) {
+		reply.Err = Reject
+	} else if args.Seq < px.floor() {
+		reply.Err = Forgotten
+	} else {
+		inst := px.instance(args.Seq)
+		if inst.decided {
+			reply.Err = OK
+			reply.Decided = true
+			reply.Value = inst.va
+		} else if args.Ballot >= px.np {
+			px.observe(args.Ballot)
+			inst.na = args.Ballot
+			inst.va = args.Value
+			px.persist(&logRecord{Kind: recAccept, Seq: args.Seq, Na: inst.na, Va: inst.va}, true)
+			reply.Err = OK
+		} else {
+			reply.Err = Reject
+		}
+	}
+	reply.Promised = px.np
+	reply.Compacted = px.snap.Seq
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// Decided RPC handler.
+//
+func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	if px.me >= 0 && args.Seq >= px.floor() {
+		px.learn(args.Seq, args.Value)
+	}
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// Forward RPC handler. only the leader takes on
+// proposals from other peers.
+//
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.merge(args.Dones)
+
+	inst, ok := px.instances[args.Seq]
+	if px.me < 0 {
+		reply.Err = NotLeader
+	} else if args.Seq < px.floor() {
+		reply.Err = Forgotten
+	} else if ok && inst.decided {
+		reply.Err = OK
+		reply.Decided = true
+		reply.Value = inst.va
+	} else if px.isLeader() {
+		reply.Err = OK
+		px.startProposer(args.Seq, args.Value)
+	} else {
+		reply.Err = NotLeader
+	}
+	reply.Compacted = px.snap.Seq
+	reply.Dones = px.copyDones()
+
+	return nil
+}
+
+//
+// px.mu must be held.
+//
+func (px *Paxos) learn(seq int, v interface{}) {
+	inst := px.instance(seq)
+	if inst.decided == false {
+		inst.decided = true
+		inst.va = v
+		px.settle(seq, v, true)
+		px.persist(&logRecord{Kind: recDecide, Seq: seq, Va: v}, false)
+		px.advance()
+		px.cond.Broadcast()
+	}
+}
+
+func (px *Paxos) startProposer(seq int, v interface{}) {
+	px.instance(seq)
+	if px.proposing[seq] == false {
+		px.proposing[seq] = true
+		go px.propose(seq, v)
+	}
+}
+
+//
+// drive instance seq to a decision. the leader runs
+// phase 2 directly; everybody else hands v to the
+// leader, and takes over if the leader makes no progress.
+//
+func (px *Paxos) propose(seq int, v interface{}) {
+	defer func() {
+		px.mu.Lock()
+		delete(px.proposing, seq)
+		px.mu.Unlock()
+	}()
+
+	backoff := 10 * time.Millisecond
+	stalls := 0
+	for px.dead == false {
+		px.mu.Lock()
+		inst, ok := px.instances[seq]
+		if seq < px.floor() || (ok && inst.decided) {
+			px.mu.Unlock()
+			return
+		}
+		// a peer that has compacted seq away knows its
+		// value; nobody may propose another one.
+		gated := px.me < 0 || seq > px.prefix+Alpha || seq <= px.compacted
+		leading := px.isLeader()
+		voting := px.voting()
+		leader := ""
+		if px.leader >= 0 && px.leader != px.me && px.leader < len(px.peers) {
+			leader = px.peers[px.leader]
+		}
+		ballot := px.ballot
+		value := v
+		if bv, ok := px.bound[seq]; ok {
+			value = bv
+		}
+		dones := px.copyDones()
+		px.mu.Unlock()
+
+		if gated {
+			// still joining, too far ahead to know which
+			// peers vote on seq, or too far behind.
+			px.catchup()
+		} else if leading {
+			if px.accept(seq, ballot, value) {
+				return
+			}
+		} else if leader != "" && stalls < maxStalls {
+			args := &ForwardArgs{seq, v, dones}
+			var reply ForwardReply
+			ok := call(leader, "Paxos.Forward", args, &reply)
+			if ok {
+				px.mu.Lock()
+				px.merge(reply.Dones)
+				px.compactedTo(reply.Compacted)
+				if reply.Decided && seq >= px.floor() {
+					px.learn(seq, reply.Value)
+				}
+				px.mu.Unlock()
+			}
+			if ok && reply.Err == Forgotten && reply.Compacted >= seq {
+				continue
+			} else if ok && (reply.Decided || reply.Err == Forgotten) {
+				return
+			} else if ok && reply.Err == OK {
+				if px.wait(seq, forwardWait) {
+					return
+				}
+				stalls++
+				continue
+			} else if ok && reply.Err == NotLeader {
+				stalls = maxStalls
+			} else {
+				stalls++
+			}
+		} else if !voting {
+			// a learner cannot take over; it can only
+			// look for decisions and the leader.
+			px.catchup()
+			stalls = 0
+		} else {
+			if px.prepare() {
+				backoff = 10 * time.Millisecond
+				stalls = 0
+				continue
+			}
+			stalls = 0
+		}
+
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		if backoff < 500*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+//
+// wait up to d for instance seq to be decided.
+//
+func (px *Paxos) wait(seq int, d time.Duration) bool {
+	t0 := time.Now()
+	for px.dead == false && time.Since(t0) < d {
+		if decided, _ := px.Status(seq); decided {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+//
+// phase 1 for all instances >= Min(). it needs a phase 1
+// quorum of every set of peers that still votes. on success
+// this peer becomes the leader; values that a quorum may
+// already have chosen are bound to the new ballot and
+// re-proposed.
+//
+func (px *Paxos) prepare() bool {
+	px.mu.Lock()
+	ballot := px.nextBallot()
+	args := &PrepareArgs{ballot, px.floor(), px.copyDones()}
+	configs := px.active()
+	peers := px.addrs(px.activeIds())
+	px.mu.Unlock()
+
+	type vote struct {
+		id    int
+		reply *PrepareReply
+	}
+
+	// promise to myself first, so that a ballot is on
+	// disk before anyone else can see it.
+	replies := make(chan vote, len(peers)+1)
+	var mine PrepareReply
+	px.Prepare(args, &mine)
+	replies <- vote{px.me, &mine}
+	for id, addr := range peers {
+		if id == px.me {
+			continue
+		}
+		go func(id int, addr string) {
+			var reply PrepareReply
+			if call(addr, "Paxos.Prepare", args, &reply) {
+				replies <- vote{id, &reply}
+			} else {
+				replies <- vote{id, nil}
+			}
+		}(id, addr)
+	}
+
+	votes := make(map[int]bool)
+	accepted := make(map[int]Accepted)
+	nreplies := len(peers)
+	if _, ok := peers[px.me]; !ok {
+		nreplies++
+	}
+	for i := 0; i < nreplies && !quorums1(configs, votes); i++ {
+		v := <-replies
+		if v.reply == nil {
+			continue
+		}
+		px.mu.Lock()
+		px.merge(v.reply.Dones)
+		px.observe(v.reply.Promised)
+		px.compactedTo(v.reply.Compacted)
+		px.mu.Unlock()
+		if v.reply.Err != OK {
+			continue
+		}
+		votes[v.id] = true
+		for seq, a := range v.reply.Instances {
+			cur, ok := accepted[seq]
+			if !ok || a.Decided || (!cur.Decided && a.Na > cur.Na) {
+				accepted[seq] = a
+			}
+		}
+	}
+	if !quorums1(configs, votes) {
+		return false
+	}
+
+	px.mu.Lock()
+	if px.np != ballot {
+		// outbid while collecting promises.
+		px.mu.Unlock()
+		return false
+	}
+	px.ballot = ballot
+	px.leader = px.me
+	px.bound = make(map[int]interface{})
+	learned := make(map[int]interface{})
+	min := px.floor()
+	for seq, a := range accepted {
+		inst, ok := px.instances[seq]
+		if seq < min || (ok && inst.decided) {
+			continue
+		}
+		if a.Decided {
+			px.learn(seq, a.Va)
+			learned[seq] = a.Va
+		} else if seq > px.compacted {
+			px.bound[seq] = a.Va
+			px.startProposer(seq, a.Va)
+		}
+	}
+	px.mu.Unlock()
+
+	for seq, v := range learned {
+		px.decide(seq, v)
+	}
+	return true
+}
+
+//
+// phase 2 for one instance with the leader's ballot.
+// returns true if the instance is known to be decided.
+//
+func (px *Paxos) accept(seq int, ballot int, v interface{}) bool {
+	px.mu.Lock()
+	args := &AcceptArgs{seq, ballot, v, px.copyDones()}
+	c := px.configFor(seq)
+	peers := px.addrs(c.Ids)
+	px.mu.Unlock()
+
+	type vote struct {
+		id    int
+		reply *AcceptReply
+	}
+
+	replies := make(chan vote, len(peers))
+	for id, addr := range peers {
+		go func(id int, addr string) {
+			var reply AcceptReply
+			ok := true
+			if id == px.me {
+				px.Accept(args, &reply)
+			} else {
+				ok = call(addr, "Paxos.Accept", args, &reply)
+			}
+			if ok {
+				replies <- vote{id, &reply}
+			} else {
+				replies <- vote{id, nil}
+			}
+		}(id, addr)
+	}
+
+	votes := make(map[int]bool)
+	for i := 0; i < len(peers) && !quorum2(c, votes); i++ {
+		v := <-replies
+		if v.reply == nil {
+			continue
+		}
+		px.mu.Lock()
+		px.merge(v.reply.Dones)
+		px.observe(v.reply.Promised)
+		px.compactedTo(v.reply.Compacted)
+		px.mu.Unlock()
+		if v.reply.Decided {
+			px.decide(seq, v.reply.Value)
+			return true
+		} else if v.reply.Err == Forgotten {
+			// compacted there: catch up instead.
+			return v.reply.Compacted < seq
+		} else if v.reply.Err == OK {
+			votes[v.id] = true
+		}
+	}
+	if !quorum2(c, votes) {
+		return false
+	}
+
+	px.decide(seq, v)
+	return true
+}
+
+//
+// tell every peer that still votes or learns, this one
+// included, that seq is decided.
+//
+func (px *Paxos) decide(seq int, v interface{}) {
+	px.mu.Lock()
+	args := &DecidedArgs{seq, v, px.copyDones()}
+	ids := append(px.activeIds(), px.configFor(seq).Ids...)
+	peers := px.addrs(append(ids, px.learnerIds()...))
+	px.mu.Unlock()
+
+	var reply DecidedReply
+	px.Decided(args, &reply)
+	for id, addr := range peers {
+		if id == px.me {
+			continue
+		}
+		go func(addr string) {
+			var reply DecidedReply
+			if call(addr, "Paxos.Decided", args, &reply) {
+				px.mu.Lock()
+				px.merge(reply.Dones)
+				px.mu.Unlock()
+			}
+		}(addr)
+	}
+}
+
 //
 // the application wants paxos to start agreement on
 // instance seq, with proposed value v.
@@ -83,7 +714,12 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 // is reached.
 //
 func (px *Paxos) Start(seq int, v interface{}) {
-	// Your code here.
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq >= px.floor() {
+		px.startProposer(seq, v)
+	}
 }
 
 //
@@ -93,7 +729,15 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
-	// Your code here.
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.me >= 0 && seq > px.dones[px.me] {
+		px.dones[px.me] = seq
+		px.persist(&logRecord{Kind: recDone, Done: seq}, false)
+		px.forget()
+		px.cond.Broadcast()
+	}
 }
 
 //
@@ -102,8 +746,10 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
-	// Your code here.
-	return 0
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	return px.max
 }
 
 //
@@ -135,11 +781,14 @@ func (px *Paxos) Max() int {
 // this is that when the unreachable peer comes back to
 // life, it will need to catch up on instances that it
 // missed -- the other peers therefor cannot forget these
-// instances.
+// instances, unless the application hands its peer a
+// Snapshot() that covers them (see snapshot.go).
 //
 func (px *Paxos) Min() int {
-	// You code here.
-	return 0
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	return px.floor()
 }
 
 //
@@ -150,7 +799,16 @@ func (px *Paxos) Min() int {
 // it should not contact other Paxos peers.
 //
 func (px *Paxos) Status(seq int) (bool, interface{}) {
-	// Your code here.
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq < px.floor() {
+		return false, nil
+	}
+	inst, ok := px.instances[seq]
+	if ok && inst.decided {
+		return true, inst.va
+	}
 	return false, nil
 }
 
@@ -164,6 +822,73 @@ func (px *Paxos) Kill() {
 	if px.l != nil {
 		px.l.Close()
 	}
+	px.mu.Lock()
+	if px.wal != nil {
+		px.wal.close()
+		px.wal = nil
+	}
+	select {
+	case <-px.killed:
+	default:
+		close(px.killed)
+	}
+	px.cond.Broadcast()
+	px.mu.Unlock()
+}
+
+//
+// the application interface above, for services that can
+// run on paxos or on anything else that implements it
+// (the raft package does).
+//
+type Interface interface {
+	Start(seq int, v interface{})
+	Status(seq int) (bool, interface{})
+	Done(seq int)
+	Max() int
+	Min() int
+	Kill()
+	Snapshot(seq int, state []byte)
+	Restore(seq int) (int, []byte, bool)
+	WaitDecided(seq int, timeout time.Duration) (bool, interface{})
+	Decisions() <-chan Decision
+	Submit(v interface{})
+	ReadIndex() (int, bool)
+}
+
+//
+// how far a service's log reaches, as its Status RPC
+// reports it: the Min() and Max() of its replica. for
+// kvctl status.
+//
+type StatusArgs struct {
+}
+
+type StatusReply struct {
+	Min int
+	Max int
+}
+
+//
+// Option configures an optional feature of a Paxos
+// peer; pass any number of them to Make().
+//
+type Option func(px *Paxos)
+
+//
+// DataDir keeps this peer's promises, accepted values,
+// decisions and Done() value in a write-ahead log in dir,
+// and recovers them when Make() is called again with the
+// same dir. each peer needs a directory of its own. such a
+// peer keeps every instance after its latest Snapshot(),
+// whatever Done() says, and Min() counts from there. the
+// log holds gob-encoded values, so their types have to be
+// registered before Make() is called.
+//
+func DataDir(dir string) Option {
+	return func(px *Paxos) {
+		px.dir = dir
+	}
 }
 
 //
@@ -171,12 +896,71 @@ func (px *Paxos) Kill() {
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
 //
-func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+func Make(peers []string, me int, rpcs *rpc.Server, opts ...Option) *Paxos {
 	px := &Paxos{}
 	px.peers = peers
 	px.me = me
 
 	// Your initialization code here.
+	px.instances = make(map[int]*instance)
+	px.cond = sync.NewCond(&px.mu)
+	px.killed = make(chan bool)
+	px.maxBatch = 1
+	px.depth = 1
+	px.inflight = make(map[int][]Batch)
+	px.appended = make(map[int64]int)
+	px.delivered = make(map[int64]int)
+	px.np = -1
+	px.dones = make([]int, len(peers))
+	for i := range px.dones {
+		px.dones[i] = -1
+	}
+	px.max = -1
+	px.leader = -1
+	px.ballot = -1
+	px.leaseBallot = -1
+	px.bound = make(map[int]interface{})
+	px.proposing = make(map[int]bool)
+	px.prefix = -1
+	px.snap = snapshot{Seq: -1}
+	px.compacted = -1
+	ids := make([]int, len(peers))
+	for i := range ids {
+		ids[i] = i
+	}
+	px.configs = []config{{Start: 0, Ids: ids}}
+	for _, opt := range opts {
+		opt(px)
+	}
+	if err := px.configs[0].check(); err != nil {
+		panic(err)
+	}
+	var seeds []string
+	if px.joining {
+		seeds = append(append(seeds, peers[:me]...), peers[me+1:]...)
+		px.self = peers[me]
+		px.peers = nil
+		px.me = -1
+		px.dones = nil
+		px.configs = nil
+	}
+	// before recover(), which decodes them from the log.
+	gob.Register(Reconfig{})
+	gob.Register(Batch{})
+	if px.dir != "" {
+		px.recover()
+	}
+	px.grantedTo = -1
+	if px.lease && px.dir != "" {
+		px.grantedUntil = time.Now().Add(leaseTime)
+	}
+	if px.me < 0 {
+		go px.join(px.self, seeds)
+	}
+	go px.batcher()
+	if px.lease {
+		go px.heartbeat()
+	}
 
 	if rpcs != nil {
 		// caller will create socket &c
@@ -186,9 +970,8 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 		rpcs.Register(px)
 
 		// prepare to receive connections from clients.
-		// change "unix" to "tcp" to use over a network.
-		os.Remove(peers[me]) // only needed for "unix"
-		l, e := net.Listen("unix", peers[me])
+		// the address says which transport to use.
+		l, e := transport.Listen(peers[me])
 		if e != nil {
 			log.Fatal("listen error: ", e)
 		}
@@ -207,12 +990,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 						conn.Close()
 					} else if px.unreliable && (rand.Int63()%1000) < 200 {
 						// process the request but force discard of reply.
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-						if err != nil {
-							fmt.Printf("shutdown: %v\n", err)
-						}
+						conn = transport.DiscardReply(conn)
 						px.rpcCount++
 						go rpcs.ServeConn(conn)
 					} else {
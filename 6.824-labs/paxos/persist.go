@@ -0,0 +1,298 @@
+package paxos
+
+//
+// write-ahead log for the acceptor state, so a peer can
+// crash, restart, and still keep the promises it made.
+//
+// every record is gob-encoded on its own and framed with
+// its length and a CRC, so a torn write at the tail of the
+// log is detected and dropped on recovery. promises and
+// accepts are fsync()ed before the acceptor replies;
+// decisions and Done() values are cheap to re-learn, so
+// they are written but not forced to disk.
+//
+// once the log holds checkpointEvery records, or the
+// application hands over a Snapshot(), it is replaced by a
+// single checkpoint record with the current state.
+//
+
+import "os"
+import "fmt"
+import "log"
+import "io"
+import "bufio"
+import "bytes"
+import "encoding/gob"
+import "encoding/binary"
+import "hash/crc32"
+import "path/filepath"
+
+const (
+	recPromise = iota
+	recAccept
+	recDecide
+	recDone
+	recCheckpoint
+)
+
+const checkpointEvery = 1000
+
+type logRecord struct {
+	Kind      int
+	Np        int
+	Seq       int
+	Na        int
+	Va        interface{}
+	Done      int
+	Instances map[int]Accepted // recCheckpoint only
+	Peers     []string         // recCheckpoint only
+	Configs   []config         // recCheckpoint only
+	Prefix    int              // recCheckpoint only
+	Snap      *snapshot        // recCheckpoint only
+}
+
+type wal struct {
+	path     string
+	f        *os.File
+	nrecords int
+}
+
+func walPath(dir string) string {
+	return filepath.Join(dir, "paxos.wal")
+}
+
+//
+// open (or create) the log in dir and return the
+// records it already holds.
+//
+func openWAL(dir string) (*wal, []logRecord, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, nil, err
+	}
+	w := &wal{path: walPath(dir)}
+
+	var recs []logRecord
+	var good int64
+	if f, err := os.Open(w.path); err == nil {
+		r := bufio.NewReader(f)
+		for {
+			rec, n, err := readRecord(r)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				// whole and intact, so not a torn write;
+				// dropping it would lose what follows.
+				f.Close()
+				return nil, nil, err
+			}
+			recs = append(recs, rec)
+			good += n
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	// drop a torn record at the tail, if any.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	w.f = f
+	w.nrecords = len(recs)
+	return w, recs, nil
+}
+
+func encodeRecord(rec *logRecord) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 8+payload.Len())
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(frame[8:], payload.Bytes())
+	return frame, nil
+}
+
+func readRecord(r io.Reader) (logRecord, int64, error) {
+	var rec logRecord
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return rec, 0, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	sum := binary.LittleEndian.Uint32(hdr[4:8])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		// not io.ErrUnexpectedEOF, which gob can return too.
+		return rec, 0, fmt.Errorf("paxos log record: %v", err)
+	}
+	return rec, int64(8 + size), nil
+}
+
+func (w *wal) append(rec *logRecord, sync bool) error {
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(frame); err != nil {
+		return err
+	}
+	w.nrecords++
+	if sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+//
+// atomically replace the whole log with one record.
+//
+func (w *wal) checkpoint(rec *logRecord) error {
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(frame); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(w.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	w.f.Close()
+	w.f = f
+	w.nrecords = 1
+	return nil
+}
+
+func (w *wal) close() {
+	w.f.Close()
+}
+
+//
+// write rec to the log, if this peer has one.
+// px.mu must be held.
+//
+func (px *Paxos) persist(rec *logRecord, sync bool) {
+	if px.wal == nil || px.dead {
+		return
+	}
+	if err := px.wal.append(rec, sync); err != nil {
+		log.Fatal("paxos log: ", err)
+	}
+	if px.wal.nrecords >= checkpointEvery {
+		px.checkpoint()
+	}
+}
+
+func (px *Paxos) checkpoint() {
+	rec := &logRecord{Kind: recCheckpoint, Np: px.np, Done: -1}
+	if px.me >= 0 {
+		rec.Done = px.dones[px.me]
+	}
+	rec.Peers = px.peers
+	rec.Configs = px.configs
+	rec.Prefix = px.prefix
+	if px.snap.Seq >= 0 {
+		snap := px.snap
+		rec.Snap = &snap
+	}
+	rec.Instances = make(map[int]Accepted)
+	for seq, inst := range px.instances {
+		if inst.na >= 0 || inst.decided {
+			rec.Instances[seq] = Accepted{inst.na, inst.va, inst.decided}
+		}
+	}
+	if err := px.wal.checkpoint(rec); err != nil {
+		log.Fatal("paxos checkpoint: ", err)
+	}
+}
+
+//
+// rebuild the acceptor state from the log in px.dir.
+//
+func (px *Paxos) recover() {
+	w, recs, err := openWAL(px.dir)
+	if err != nil {
+		log.Fatal("paxos log: ", err)
+	}
+
+	for _, rec := range recs {
+		switch rec.Kind {
+		case recPromise:
+			px.observe(rec.Np)
+		case recAccept:
+			px.observe(rec.Na)
+			inst := px.instance(rec.Seq)
+			if !inst.decided {
+				inst.na = rec.Na
+				inst.va = rec.Va
+			}
+		case recDecide:
+			px.learn(rec.Seq, rec.Va)
+		case recDone:
+			if px.me >= 0 && rec.Done > px.dones[px.me] {
+				px.dones[px.me] = rec.Done
+			}
+		case recCheckpoint:
+			px.instances = make(map[int]*instance)
+			px.observe(rec.Np)
+			px.peers = rec.Peers
+			px.configs = rec.Configs
+			px.prefix = rec.Prefix
+			if rec.Snap != nil {
+				px.snap = *rec.Snap
+			}
+			if px.joining {
+				px.me = px.lookup(px.self)
+			}
+			px.dones = make([]int, len(px.peers))
+			for i := range px.dones {
+				px.dones[i] = -1
+			}
+			if px.me >= 0 {
+				px.dones[px.me] = rec.Done
+			}
+			for seq, a := range rec.Instances {
+				inst := px.instance(seq)
+				inst.na = a.Na
+				inst.va = a.Va
+				inst.decided = a.Decided
+			}
+		}
+	}
+	px.forget()
+
+	// only now, so that replaying does not log again.
+	px.wal = w
+}
@@ -0,0 +1,158 @@
+package paxos
+
+//
+// quorums.
+//
+// by default both phases need a majority of the voters.
+// Flexible Paxos only needs every phase 1 quorum to meet
+// every phase 2 quorum, so a group can make the phase 2
+// quorum that every instance needs smaller, and pay for it
+// with a larger phase 1 quorum, which only an election
+// needs.
+//
+// Quorums(q1, q2) asks for q1 voters in phase 1 and q2 in
+// phase 2; q1 + q2 must be more than the number of voters.
+// Grid(rows) lays the voters out in rows, in id order, so
+// that phase 1 needs all of one row and phase 2 all of one
+// column: with six voters in two rows, an accept needs two
+// of them and an election three.
+//
+// a configuration keeps its quorums across a Reconfig if
+// they fit the new set of voters; otherwise the new set
+// goes back to majorities.
+//
+
+import "fmt"
+
+//
+// Quorums makes phase 1 need q1 voters and phase 2 need q2.
+// every peer has to be given the same option. Make()
+// panics if the quorums need not intersect.
+//
+func Quorums(q1 int, q2 int) Option {
+	return func(px *Paxos) {
+		px.configs[0].Q1 = q1
+		px.configs[0].Q2 = q2
+	}
+}
+
+//
+// Grid lays the voters out in rows; phase 1 needs a whole
+// row, and phase 2 a whole column. every peer has to be
+// given the same option. Make() panics if the voters do
+// not fill the rows.
+//
+func Grid(rows int) Option {
+	return func(px *Paxos) {
+		px.configs[0].Rows = rows
+	}
+}
+
+//
+// the size of quorum q in c, where 0 means a majority.
+//
+func (c config) size(q int) int {
+	if q == 0 {
+		return len(c.Ids)/2 + 1
+	}
+	return q
+}
+
+//
+// an error if c's quorums need not intersect.
+//
+func (c config) check() error {
+	n := len(c.Ids)
+	if c.Rows > 0 {
+		if c.Q1 != 0 || c.Q2 != 0 {
+			return fmt.Errorf("paxos: both a grid and quorum sizes")
+		}
+		if n%c.Rows != 0 {
+			return fmt.Errorf("paxos: %v voters do not fill %v rows", n, c.Rows)
+		}
+		return nil
+	}
+	q1, q2 := c.size(c.Q1), c.size(c.Q2)
+	if q1 < 1 || q2 < 1 || q1 > n || q2 > n {
+		return fmt.Errorf("paxos: quorums of %v and %v out of %v voters", q1, q2, n)
+	}
+	if q1+q2 <= n {
+		return fmt.Errorf("paxos: phase 1 quorums of %v and phase 2 quorums of %v "+
+			"out of %v voters need not intersect", q1, q2, n)
+	}
+	return nil
+}
+
+//
+// is some whole row (if rows) or column (if !rows) of c's
+// grid in votes?
+//
+func (c config) line(rows bool, votes map[int]bool) bool {
+	cols := len(c.Ids) / c.Rows
+	lines, length := c.Rows, cols
+	if !rows {
+		lines, length = cols, c.Rows
+	}
+	for l := 0; l < lines; l++ {
+		all := true
+		for k := 0; k < length && all; k++ {
+			i := l*cols + k
+			if !rows {
+				i = k*cols + l
+			}
+			all = votes[c.Ids[i]]
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func count(c config, votes map[int]bool) int {
+	n := 0
+	for _, id := range c.Ids {
+		if votes[id] {
+			n++
+		}
+	}
+	return n
+}
+
+//
+// do the peers in votes form a phase 1 quorum of c?
+//
+func quorum1(c config, votes map[int]bool) bool {
+	if c.Rows > 0 {
+		return c.line(true, votes)
+	}
+	return count(c, votes) >= c.size(c.Q1)
+}
+
+//
+// do they form a phase 2 quorum of c?
+//
+func quorum2(c config, votes map[int]bool) bool {
+	if c.Rows > 0 {
+		return c.line(false, votes)
+	}
+	return count(c, votes) >= c.size(c.Q2)
+}
+
+func quorums1(cs []config, votes map[int]bool) bool {
+	for _, c := range cs {
+		if !quorum1(c, votes) {
+			return false
+		}
+	}
+	return true
+}
+
+func quorums2(cs []config, votes map[int]bool) bool {
+	for _, c := range cs {
+		if !quorum2(c, votes) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package paxos
+
+//
+// snapshots and state transfer.
+//
+// Done() only frees an instance once every peer is done
+// with it, so a peer that is down or partitioned for hours
+// pins the log of all the others. an application that
+// calls Snapshot(seq, state) hands its peer a serialized
+// copy of the application state after every instance
+// <= seq. the peer then drops those instances whatever the
+// other peers have done, and gives the snapshot to any
+// peer that asks for them later.
+//
+// acceptors tell proposers how far they have compacted.
+// a peer that finds it needs an instance another peer
+// has compacted away stops proposing for it and fetches
+// that peer's snapshot instead. the application learns of
+// the snapshot through Restore(), loads the state, and
+// carries on from the instance after it.
+//
+
+type snapshot struct {
+	Seq     int // the state reflects every instance <= Seq
+	State   []byte
+	Batches map[int64]int // batches delivered in the dedupWindow up to Seq
+}
+
+//
+// instances below floor() are gone from this peer, either
+// because every peer is Done() with them or because they
+// are in the snapshot. a peer with a DataDir only drops
+// what its snapshot covers: the application state that
+// Done() vouches for is not on disk, so after a restart
+// the instances since the snapshot have to be replayed.
+// px.mu must be held.
+//
+func (px *Paxos) floor() int {
+	if px.snap.Seq >= px.min() || px.dir != "" {
+		return px.snap.Seq + 1
+	}
+	return px.min()
+}
+
+//
+// note how far another peer has compacted its log.
+// px.mu must be held.
+//
+func (px *Paxos) compactedTo(seq int) {
+	if seq > px.compacted {
+		px.compacted = seq
+	}
+}
+
+//
+// the application's state after applying every instance
+// <= seq, all of which must be decided. this peer forgets
+// those instances and serves state to peers that missed
+// them. only the latest snapshot is kept.
+//
+func (px *Paxos) Snapshot(seq int, state []byte) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq <= px.snap.Seq || seq > px.prefix {
+		return
+	}
+	px.snap = snapshot{seq, state, px.recent(seq)}
+	px.forget()
+	if px.wal != nil && px.dead == false {
+		// the checkpoint holds the snapshot and drops the
+		// log records it covers.
+		px.checkpoint()
+	}
+}
+
+//
+// the batches Decisions() delivered in the dedupWindow
+// instances up to seq, so that a peer that starts from the
+// snapshot still knows them when they are decided again.
+// px.mu must be held.
+//
+func (px *Paxos) recent(seq int) map[int64]int {
+	batches := make(map[int64]int)
+	for id, s := range px.delivered {
+		if s <= seq && s > seq-dedupWindow {
+			batches[id] = s
+		}
+	}
+	return batches
+}
+
+//
+// if instance seq is covered by this peer's snapshot,
+// Restore() returns it: state is the application state
+// after every instance <= last, and last >= seq. a snapshot
+// fetched from another peer shows up here once this peer
+// has fallen behind; the application should load it and
+// continue with instance last+1.
+//
+func (px *Paxos) Restore(seq int) (int, []byte, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq > px.snap.Seq {
+		return 0, nil, false
+	}
+	return px.snap.Seq, px.snap.State, true
+}
+
+//
+// take on a snapshot, and the membership that goes with
+// it, from another peer's Fetch reply. px.mu must be held.
+//
+func (px *Paxos) install(reply *FetchReply) {
+	if reply.Snapshot == nil || reply.Snapshot.Seq <= px.prefix ||
+		reply.Prefix < reply.Snapshot.Seq || len(reply.Dones) != len(reply.Peers) {
+		return
+	}
+	px.snap = *reply.Snapshot
+	px.peers = reply.Peers
+	px.configs = reply.Configs
+	px.prefix = reply.Prefix
+	dones := reply.Dones
+	for i := 0; i < len(px.dones) && i < len(dones); i++ {
+		if px.dones[i] > dones[i] {
+			dones[i] = px.dones[i]
+		}
+	}
+	px.dones = dones
+	px.forget()
+	px.cond.Broadcast()
+	if px.wal != nil {
+		px.checkpoint()
+	}
+}
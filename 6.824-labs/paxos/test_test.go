@@ -7,6 +7,11 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "reflect"
+import "net"
+import "transport"
+import "encoding/binary"
+import "hash/crc32"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -26,7 +31,7 @@ func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
     if pxa[i] != nil {
       decided, v1 := pxa[i].Status(seq)
       if decided {
-        if count > 0 && v != v1 {
+        if count > 0 && !reflect.DeepEqual(v, v1) {
           t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
             seq, i, v, v1)
         }
@@ -489,6 +494,73 @@ func TestRPCCount(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// once a leader is established, agreements should
+// cost only phase 2, and the leader should be replaced
+// when it dies.
+//
+func TestLeader(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leader", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: Stable leader skips Prepare ...\n")
+
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+  time.Sleep(1 * time.Second)
+
+  total1 := 0
+  for j := 0; j < npaxos; j++ {
+    total1 += pxa[j].rpcCount
+  }
+
+  const ninst = 10
+  for seq := 1; seq <= ninst; seq++ {
+    pxa[1 + (seq % 2)].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+  time.Sleep(1 * time.Second)
+
+  total2 := 0
+  for j := 0; j < npaxos; j++ {
+    total2 += pxa[j].rpcCount
+  }
+  total2 -= total1
+
+  // per agreement:
+  // 1 forward to the leader
+  // 2 accepts
+  // 2 decides
+  expected := ninst * (1 + 2 * (npaxos - 1))
+  if total2 > expected {
+    t.Fatalf("too many RPCs with a stable leader; %v instances, got %v, expected %v",
+      ninst, total2, expected)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Leader failover ...\n")
+
+  pxa[0].Kill()
+  for seq := ninst + 1; seq <= ninst + 5; seq++ {
+    pxa[1 + (seq % 2)].Start(seq, seq)
+    waitn(t, pxa[1:], seq, npaxos - 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements (without failures)
 //
@@ -626,6 +698,50 @@ func TestManyUnreliable(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+func tcpport(t *testing.T) string {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("listen: %v", err)
+  }
+  defer l.Close()
+  return "tcp://" + l.Addr().String()
+}
+
+func TestTransports(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  for _, tr := range []string{"mem", "tcp"} {
+    fmt.Printf("Test: Unreliable RPC over %v transport ...\n", tr)
+
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+
+    for i := 0; i < npaxos; i++ {
+      if tr == "tcp" {
+        pxh[i] = tcpport(t)
+      } else {
+        pxh[i] = "mem://" + port("trans", i)
+      }
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i] = Make(pxh, i, nil)
+      pxa[i].unreliable = true
+    }
+
+    const ninst = 20
+    for seq := 0; seq < ninst; seq++ {
+      for i := 0; i < npaxos; i++ {
+        pxa[i].Start(seq, (seq * 10) + i)
+      }
+      waitn(t, pxa, seq, npaxos)
+    }
+
+    cleanup(pxa)
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
 func pp(tag string, src int, dst int) string {
   s := "/var/tmp/824-"
   s += strconv.Itoa(os.Getuid()) + "/"
@@ -872,3 +988,896 @@ func TestLots(t *testing.T) {
 
   fmt.Printf("  ... Passed\n")
 }
+
+func datadir(tag string, host int) string {
+  return port(tag, host) + "-data"
+}
+
+//
+// peers with a DataDir keep their promises and
+// decisions across a crash and restart.
+//
+func TestPersist(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("persist", i)
+    os.RemoveAll(datadir("persist", i))
+    defer os.RemoveAll(datadir("persist", i))
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, DataDir(datadir("persist", i)))
+  }
+
+  fmt.Printf("Test: Restarted peer remembers decisions ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % npaxos].Start(seq, seq * 100)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  pxa[2].Kill()
+  pxa[2] = Make(pxh, 2, nil, DataDir(datadir("persist", 2)))
+  for seq := 0; seq < 5; seq++ {
+    decided, v := pxa[2].Status(seq)
+    if !decided || v != seq * 100 {
+      t.Fatalf("seq %v not recovered; decided=%v v=%v", seq, decided, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted peer keeps its promises ...\n")
+
+  np := pxa[0].np
+  pxa[0].Kill()
+  pxa[0] = Make(pxh, 0, nil, DataDir(datadir("persist", 0)))
+  args := &PrepareArgs{np, 0, nil}
+  var reply PrepareReply
+  pxa[0].Prepare(args, &reply)
+  if reply.Err != Reject {
+    t.Fatalf("restarted peer accepted a Prepare for an old ballot")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Whole cluster restarts, torn log tail ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+  }
+  f, err := os.OpenFile(walPath(datadir("persist", 1)), os.O_WRONLY|os.O_APPEND, 0666)
+  if err != nil {
+    t.Fatalf("open log: %v", err)
+  }
+  f.Write([]byte{42, 0, 0, 0, 1, 2})
+  f.Close()
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, DataDir(datadir("persist", i)))
+  }
+
+  for seq := 0; seq < 5; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+  pxa[1].Start(5, "after")
+  waitn(t, pxa, 5, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Done() instances are kept until a snapshot ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Done(5)
+  }
+  pxa[0].Start(6, 600)
+  waitn(t, pxa, 6, npaxos)
+  for i := 0; i < npaxos; i++ {
+    if m := pxa[i].Min(); m != 0 {
+      t.Fatalf("peer %v Min() %v with no snapshot", i, m)
+    }
+    pxa[i].Snapshot(3, []byte("s"))
+    pxa[i].Kill()
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, DataDir(datadir("persist", i)))
+  }
+  for i := 0; i < npaxos; i++ {
+    if m := pxa[i].Min(); m != 4 {
+      t.Fatalf("peer %v Min() %v after restart, expected 4", i, m)
+    }
+    if last, state, ok := pxa[i].Restore(3); !ok || last != 3 || string(state) != "s" {
+      t.Fatalf("peer %v lost its snapshot", i)
+    }
+    for seq := 4; seq <= 6; seq++ {
+      if decided, _ := pxa[i].Status(seq); !decided {
+        t.Fatalf("peer %v forgot seq %v", i, seq)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Undecodable record is not taken for a torn tail ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+  }
+  path := walPath(datadir("persist", 1))
+  junk := []byte("not a gob")
+  frame := make([]byte, 8 + len(junk))
+  binary.LittleEndian.PutUint32(frame[0:4], uint32(len(junk)))
+  binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(junk))
+  copy(frame[8:], junk)
+  f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+  if err != nil {
+    t.Fatalf("open log: %v", err)
+  }
+  f.Write(frame)
+  f.Close()
+  before, _ := os.Stat(path)
+  if _, _, err := openWAL(datadir("persist", 1)); err == nil {
+    t.Fatalf("openWAL accepted an undecodable record")
+  }
+  if after, _ := os.Stat(path); after.Size() != before.Size() {
+    t.Fatalf("log truncated from %v to %v", before.Size(), after.Size())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// replace a peer through the log itself. the Reconfig
+// decided at instance n lets the new peer vote from
+// n+Alpha on; the peer it replaces is no longer needed.
+//
+func TestReconfig(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("reconfig", i)
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = Make(pxh[0:3], i, nil)
+  }
+
+  fmt.Printf("Test: New peer joins and catches up ...\n")
+
+  seq := 0
+  for ; seq < 5; seq++ {
+    pxa[0].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 3)
+  }
+
+  pxa[3] = Make([]string{pxh[0], pxh[3]}, 1, nil, Join())
+  n := seq
+  pxa[1].Start(n, Reconfig{Peers: []string{pxh[0], pxh[1], pxh[3]}})
+  waitn(t, pxa, n, 3)
+  for s := 0; s <= n; s++ {
+    waitn(t, pxa, s, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: New set decides without the removed peer ...\n")
+
+  for seq = n + 1; seq < n + Alpha; seq++ {
+    pxa[seq % 2].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 3)
+  }
+
+  pxa[1].Kill()
+  pxa[2].Kill()
+  for i := 0; i < 5; i++ {
+    pxa[3].Start(seq, seq * 10)
+    waitn(t, []*Paxos{pxa[0], pxa[3]}, seq, 2)
+    seq++
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLearners(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 5
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("learners", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, Learners(3, 4))
+  }
+
+  fmt.Printf("Test: Learners hear every decision ...\n")
+
+  pxa[0].Start(0, "a")
+  waitn(t, pxa, 0, npaxos)
+
+  // a learner hands its value to the leader.
+  pxa[4].Start(1, "b")
+  waitn(t, pxa, 1, npaxos)
+  if _, v := pxa[0].Status(1); v != "b" {
+    t.Fatalf("learner's value was not decided: %v", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Learners do not vote ...\n")
+
+  // voters 0 and 1 are a majority of three.
+  pxa[2].Kill()
+  pxa[0].Start(2, "c")
+  waitn(t, []*Paxos{pxa[0], pxa[1], pxa[3], pxa[4]}, 2, 4)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A promoted learner votes ...\n")
+
+  pxa[0].Promote(3, pxh[3])
+  waitn(t, pxa, 3, 4)
+  seq := 4
+  for ; seq <= 3 + Alpha; seq++ {
+    pxa[seq % 2].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 4)
+  }
+
+  // now 0, 1 and 3 are a majority of the four voters.
+  pxa[0].Start(seq, "d")
+  waitn(t, pxa, seq, 4)
+  seq++
+
+  // but 0 and 3 are not, although 4 is up too.
+  pxa[1].Kill()
+  pxa[0].Start(seq, "e")
+  pxa[4].Start(seq, "f")
+  checkmax(t, pxa, seq, 0)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestFlexibleQuorums(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  start := func(tag string, n int, opts ...Option) ([]*Paxos, []string) {
+    var pxa []*Paxos = make([]*Paxos, n)
+    var pxh []string = make([]string, n)
+    for i := 0; i < n; i++ {
+      pxh[i] = port(tag, i)
+    }
+    for i := 0; i < n; i++ {
+      pxa[i] = Make(pxh, i, nil, opts...)
+    }
+    return pxa, pxh
+  }
+
+  fmt.Printf("Test: Quorums that need not intersect are refused ...\n")
+
+  refused := func(n int, opts ...Option) (panicked bool) {
+    defer func() { panicked = recover() != nil }()
+    pxh := make([]string, n)
+    for i := 0; i < n; i++ {
+      pxh[i] = port("badquorum", i)
+    }
+    Make(pxh, 0, nil, opts...).Kill()
+    return false
+  }
+  if !refused(5, Quorums(2, 3)) || !refused(5, Quorums(6, 1)) || !refused(5, Grid(2)) {
+    t.Fatalf("Make() accepted quorums that need not intersect")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Phase 2 with two of five ...\n")
+
+  pxa, _ := start("fq2", 5, Quorums(4, 2))
+  defer cleanup(pxa)
+  pxa[0].Start(0, "a")
+  waitn(t, pxa, 0, 5)
+  pxa[2].Kill()
+  pxa[3].Kill()
+  pxa[4].Kill()
+  pxa[1].Start(1, "b")
+  waitn(t, pxa, 1, 2)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Phase 1 needs four of five ...\n")
+
+  pxb, _ := start("fq1", 5, Quorums(4, 2))
+  defer cleanup(pxb)
+  pxb[3].Kill()
+  pxb[4].Kill()
+  pxb[0].Start(0, "a")
+  checkmax(t, pxb, 0, 0)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Grid quorums ...\n")
+
+  // rows {0,1,2} and {3,4,5}; columns {0,3}, {1,4}, {2,5}.
+  pxc, _ := start("grid", 6, Grid(2))
+  defer cleanup(pxc)
+  pxc[0].Start(0, "a")
+  waitn(t, pxc, 0, 6)
+  pxc[1].Kill()
+  pxc[2].Kill()
+  pxc[4].Kill()
+  pxc[5].Kill()
+  pxc[3].Start(1, "b")
+  waitn(t, pxc, 1, 2)
+
+  // four of six are up, but no row is.
+  pxd, _ := start("gridrow", 6, Grid(2))
+  defer cleanup(pxd)
+  pxd[1].Kill()
+  pxd[4].Kill()
+  pxd[0].Start(0, "a")
+  checkmax(t, pxd, 0, 0)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "snapshot"
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  defer cleanup(pxa)
+  defer cleanpp(tag, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    var pxh []string = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[j] = port(tag, i)
+      } else {
+        pxh[j] = pp(tag, i, j)
+      }
+    }
+    pxa[i] = Make(pxh, i, nil)
+  }
+  defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: Snapshot lets peers forget without a lagging peer ...\n")
+
+  part(t, tag, npaxos, []int{0,1}, []int{2}, []int{})
+
+  const ninst = 60
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq * 10)
+    waitn(t, pxa[:2], seq, 2)
+  }
+  for i := 0; i < 2; i++ {
+    pxa[i].Done(ninst - 1)
+  }
+  pxa[0].Start(ninst, "x")
+  waitn(t, pxa[:2], ninst, 2)
+  if pxa[0].Min() != 0 {
+    t.Fatalf("Min() advanced past a peer that never called Done()")
+  }
+
+  for i := 0; i < 2; i++ {
+    pxa[i].Snapshot(ninst - 1, []byte("state"))
+    if pxa[i].Min() != ninst {
+      t.Fatalf("Min() is %v after Snapshot(), expected %v", pxa[i].Min(), ninst)
+    }
+    if decided, _ := pxa[i].Status(10); decided {
+      t.Fatalf("Status() of an instance in the snapshot")
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lagging peer fetches the snapshot ...\n")
+
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+  pxa[2].Start(0, "late")
+
+  ok := false
+  for iters := 0; iters < 50 && !ok; iters++ {
+    last, state, restored := pxa[2].Restore(0)
+    if restored {
+      if last != ninst - 1 || string(state) != "state" {
+        t.Fatalf("Restore() returned %v %v", last, string(state))
+      }
+      ok = true
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !ok {
+    t.Fatalf("lagging peer never got the snapshot")
+  }
+  if decided, _ := pxa[2].Status(0); decided {
+    t.Fatalf("lagging peer decided an instance covered by the snapshot")
+  }
+
+  waitn(t, pxa, ninst, npaxos)
+  pxa[2].Start(ninst + 1, "y")
+  waitn(t, pxa, ninst + 1, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWaitDecided(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("wait", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: WaitDecided() ...\n")
+
+  t0 := time.Now()
+  if decided, _ := pxa[0].WaitDecided(0, 200 * time.Millisecond); decided {
+    t.Fatalf("WaitDecided() on an instance nobody started")
+  }
+  if d := time.Since(t0); d < 200 * time.Millisecond || d > time.Second {
+    t.Fatalf("WaitDecided() timed out after %v", d)
+  }
+
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    pxa[1].Start(0, "x")
+  }()
+  decided, v := pxa[2].WaitDecided(0, 10 * time.Second)
+  if !decided || v != "x" {
+    t.Fatalf("WaitDecided() = %v %v", decided, v)
+  }
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Done(0)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Start(1 + i, "y")
+    waitn(t, pxa, 1 + i, npaxos)
+  }
+  for iters := 0; pxa[0].Min() < 1; iters++ {
+    if iters > 100 {
+      t.Fatalf("Min() did not advance")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if decided, _ := pxa[0].WaitDecided(0, 10 * time.Second); decided {
+    t.Fatalf("WaitDecided() on a forgotten instance")
+  }
+
+  ch := make(chan bool)
+  go func() {
+    decided, _ := pxa[0].WaitDecided(5, 10 * time.Second)
+    ch <- decided
+  }()
+  time.Sleep(100 * time.Millisecond)
+  pxa[0].Kill()
+  select {
+  case decided := <-ch:
+    if decided {
+      t.Fatalf("WaitDecided() after Kill()")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Kill() did not wake up WaitDecided()")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDecisions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("decisions", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: Decisions() delivers in order ...\n")
+
+  ch := pxa[1].Decisions()
+  if pxa[1].Decisions() != ch {
+    t.Fatalf("Decisions() returned a different channel")
+  }
+
+  const ninst = 10
+  for seq := ninst - 1; seq >= 0; seq-- {
+    pxa[seq % npaxos].Start(seq, seq * 100)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    select {
+    case d := <-ch:
+      if d.Seq != seq || d.Value != seq * 100 {
+        t.Fatalf("got decision %v=%v, expected %v=%v", d.Seq, d.Value, seq, seq * 100)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("no decision for %v", seq)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decisions() skips what Done() forgot ...\n")
+
+  for seq := ninst; seq < 2 * ninst; seq++ {
+    pxa[0].Start(seq, seq * 100)
+    waitn(t, pxa, seq, npaxos)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Done(2 * ninst - 2)
+  }
+  // every peer has to say something for Done() to spread.
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Start(2 * ninst + i, i)
+    waitn(t, pxa, 2 * ninst + i, npaxos)
+  }
+  for iters := 0; pxa[1].Min() < 2 * ninst - 1; iters++ {
+    if iters > 100 {
+      t.Fatalf("Min() did not advance")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  for {
+    d := <-ch
+    if d.Seq >= 2 * ninst - 1 {
+      if d.Seq != 2 * ninst - 1 {
+        t.Fatalf("Decisions() skipped instance %v", 2 * ninst - 1)
+      }
+      break
+    }
+  }
+  for i := 0; i < npaxos; i++ {
+    if d := <-ch; d.Seq != 2 * ninst + i || d.Value != i {
+      t.Fatalf("got decision %v=%v after Done()", d.Seq, d.Value)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decisions() delivers a repeated batch once ...\n")
+
+  // as when a follower proposes a batch the leader took.
+  b := Batch{77, []interface{}{"x"}}
+  for seq := 2 * ninst + npaxos; seq < 2 * ninst + npaxos + 2; seq++ {
+    pxa[0].Start(seq, b)
+    waitn(t, pxa, seq, npaxos)
+  }
+  if d := <-ch; d.Seq != 2 * ninst + npaxos {
+    t.Fatalf("got decision %v, expected %v", d.Seq, 2 * ninst + npaxos)
+  } else if x, ok := d.Value.(Batch); !ok || x.Id != b.Id {
+    t.Fatalf("got %v for the batch", d.Value)
+  }
+  if d := <-ch; d.Seq != 2 * ninst + npaxos + 1 || d.Value != nil {
+    t.Fatalf("got decision %v=%v for the repeat, expected nil", d.Seq, d.Value)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Kill() closes Decisions() ...\n")
+
+  pxa[1].Kill()
+  select {
+  case _, ok := <-ch:
+    if ok {
+      t.Fatalf("decision after Kill()")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Decisions() still open after Kill()")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// read the values of n submitted values from ch, and the
+// number of instances they took.
+//
+func collect(t testing.TB, ch <-chan Decision, n int) (map[interface{}]int, int) {
+  seen := map[interface{}]int{}
+  ninst := 0
+  for len(seen) < n {
+    select {
+    case d := <-ch:
+      if b, ok := d.Value.(Batch); ok {
+        ninst++
+        for _, v := range b.Values {
+          seen[v]++
+        }
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("only %v of %v submitted values decided", len(seen), n)
+    }
+  }
+  return seen, ninst
+}
+
+func TestSubmit(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("submit", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, Batching(10, 20 * time.Millisecond), Pipeline(4))
+  }
+  ch := pxa[0].Decisions()
+
+  for _, unreliable := range []bool{false, true} {
+    if unreliable {
+      fmt.Printf("Test: Batched Submit(), unreliable ...\n")
+    } else {
+      fmt.Printf("Test: Batched Submit() ...\n")
+    }
+
+    base := 0
+    if unreliable {
+      base = 100000
+      for i := 0; i < npaxos; i++ {
+        pxa[i].unreliable = true
+      }
+    }
+
+    const nvals = 100
+    for i := 0; i < npaxos; i++ {
+      go func(i int) {
+        for j := 0; j < nvals; j++ {
+          pxa[i].Submit(base + i * 1000 + j)
+        }
+      }(i)
+    }
+
+    seen, ninst := collect(t, ch, npaxos * nvals)
+    for i := 0; i < npaxos; i++ {
+      for j := 0; j < nvals; j++ {
+        if seen[base + i * 1000 + j] != 1 {
+          t.Fatalf("value %v decided %v times", base + i * 1000 + j, seen[base + i * 1000 + j])
+        }
+      }
+    }
+    if ninst >= npaxos * nvals / 2 {
+      t.Fatalf("%v values took %v instances", npaxos * nvals, ninst)
+    }
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func benchSubmit(b *testing.B, tag string, opts ...Option) {
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("bench-" + tag, i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, opts...)
+  }
+  ch := pxa[0].Decisions()
+
+  b.ResetTimer()
+  for i := 0; i < npaxos; i++ {
+    go func(i int) {
+      for j := i; j < b.N; j += npaxos {
+        pxa[i].Submit(j)
+      }
+    }(i)
+  }
+  _, ninst := collect(b, ch, b.N)
+  b.StopTimer()
+
+  b.ReportMetric(float64(b.N) / b.Elapsed().Seconds(), "values/s")
+  b.ReportMetric(float64(ninst) / float64(b.N), "instances/value")
+}
+
+//
+// go test -run XXX -bench Submit
+//
+func BenchmarkSubmit(b *testing.B) {
+  b.Run("single", func(b *testing.B) {
+    benchSubmit(b, "single")
+  })
+  b.Run("pipelined", func(b *testing.B) {
+    benchSubmit(b, "pipelined", Pipeline(8))
+  })
+  b.Run("batched", func(b *testing.B) {
+    benchSubmit(b, "batched", Batching(100, 2 * time.Millisecond))
+  })
+  b.Run("batched+pipelined", func(b *testing.B) {
+    benchSubmit(b, "both", Batching(100, 2 * time.Millisecond), Pipeline(8))
+  })
+}
+
+func TestLease(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "lease"
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  defer cleanup(pxa)
+  defer cleanpp(tag, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    var pxh []string = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[j] = port(tag, i)
+      } else {
+        pxh[j] = pp(tag, i, j)
+      }
+    }
+    pxa[i] = Make(pxh, i, nil, Leases())
+  }
+  defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: ReadIndex() on the lease holder and followers ...\n")
+
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+  time.Sleep(2 * heartbeatEvery)
+
+  leader := -1
+  for i := 0; i < npaxos; i++ {
+    pxa[i].mu.Lock()
+    if pxa[i].holdsLease() {
+      leader = i
+    }
+    pxa[i].mu.Unlock()
+  }
+  if leader < 0 {
+    t.Fatalf("no peer holds a lease")
+  }
+  for i := 0; i < npaxos; i++ {
+    if seq, ok := pxa[i].ReadIndex(); !ok || seq < 0 {
+      t.Fatalf("ReadIndex() on peer %v = %v, %v", i, seq, ok)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Lease holds off a new leader ...\n")
+
+  others := []int{}
+  for i := 0; i < npaxos; i++ {
+    if i != leader {
+      others = append(others, i)
+    }
+  }
+  part(t, tag, npaxos, []int{leader}, others, []int{})
+  pxa[others[0]].Start(1, "y")
+
+  decided := false
+  for iters := 0; iters < 500 && !decided; iters++ {
+    decided = ndecided(t, pxa, 1) >= 2
+    pxa[leader].mu.Lock()
+    held := pxa[leader].holdsLease()
+    pxa[leader].mu.Unlock()
+    if decided && held {
+      t.Fatalf("new value decided while the old leader held its lease")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if !decided {
+    t.Fatalf("majority never decided after the lease ran out")
+  }
+  if _, ok := pxa[leader].ReadIndex(); ok {
+    t.Fatalf("partitioned leader answered ReadIndex()")
+  }
+  if seq, ok := pxa[others[1]].ReadIndex(); !ok || seq < 1 {
+    t.Fatalf("ReadIndex() in the majority = %v, %v", seq, ok)
+  }
+
+  part(t, tag, npaxos, []int{0,1,2}, []int{}, []int{})
+  pxa[leader].Start(2, "z")
+  waitn(t, pxa, 2, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// names of the peers on a simulated network.
+//
+func simnodes(n int) []string {
+  nodes := make([]string, n)
+  for i := 0; i < n; i++ {
+    nodes[i] = strconv.Itoa(i)
+  }
+  return nodes
+}
+
+func simpart(nw *transport.Network, groups ...[]int) {
+  var gs [][]string
+  for _, g := range groups {
+    var nodes []string
+    for _, i := range g {
+      nodes = append(nodes, strconv.Itoa(i))
+    }
+    gs = append(gs, nodes)
+  }
+  nw.Partition(gs...)
+}
+
+func TestSimulated(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 5
+  nw := transport.MakeNetwork(transport.Seed())
+  defer func() {
+    if t.Failed() {
+      fmt.Printf("  ... failed with TRANSPORT_SEED=%v\n", nw.Seed())
+    }
+  }()
+
+  nodes := simnodes(npaxos)
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  defer cleanup(pxa)
+  for i := 0; i < npaxos; i++ {
+    var pxh []string = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[j] = nw.Addr(nodes[i])
+      } else {
+        pxh[j] = nw.Link(nodes[i], nodes[j])
+      }
+    }
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  fmt.Printf("Test: Simulated network, lossy and partitioned ...\n")
+
+  nw.SetFaults(transport.Faults{Loss: 0.1, LoseReply: 0.1, Duplicate: 0.1,
+    Delay: 20 * time.Millisecond})
+
+  for seq := 0; seq < 10; seq++ {
+    simpart(nw, []int{0,1,2}, []int{3,4})
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 10) + i)
+    }
+    waitn(t, pxa, seq, 3)
+    if ndecided(t, pxa, seq) > 3 {
+      t.Fatalf("too many decided")
+    }
+
+    simpart(nw, []int{0,1}, []int{2,3,4})
+    waitn(t, pxa, seq, 5)
+  }
+
+  nw.Partition()
+  nw.SetFaults(transport.Faults{})
+  pxa[0].Start(10, "last")
+  waitn(t, pxa, 10, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,7 +1,7 @@
 package pbservice
 
 import "github.com/kedebug/golang-programming/6.824-labs/viewservice"
-import "net/rpc"
+import "transport"
 
 // You'll probably need to uncomment this:
 // import "time"
@@ -35,7 +35,7 @@ func MakeClerk(vshost string, me string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
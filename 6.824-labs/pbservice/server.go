@@ -4,11 +4,10 @@ import "net"
 import "fmt"
 import "github.com/kedebug/golang-programming/6.824-labs/viewservice"
 import "net/rpc"
+import "transport"
 import "log"
 import "time"
 import "sync"
-import "os"
-import "syscall"
 import "math/rand"
 
 type PBServer struct {
@@ -178,8 +177,7 @@ func StartServer(vshost string, me string) *PBServer {
 	rpcs := rpc.NewServer()
 	rpcs.Register(pb)
 
-	os.Remove(pb.me)
-	l, e := net.Listen("unix", pb.me)
+	l, e := transport.Listen(pb.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -197,12 +195,7 @@ func StartServer(vshost string, me string) *PBServer {
 					conn.Close()
 				} else if pb.unreliable && (rand.Int63()%1000) < 200 {
 					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-					if err != nil {
-						fmt.Printf("shutdown: %v\n", err)
-					}
+					conn = transport.DiscardReply(conn)
 					go rpcs.ServeConn(conn)
 				} else {
 					go rpcs.ServeConn(conn)
@@ -11,6 +11,7 @@ import "runtime"
 import "math/rand"
 import "os"
 import "strconv"
+import "sync"
 
 func check(ck *Clerk, key string, value string) {
 	v := ck.Get(key)
@@ -644,6 +645,15 @@ func proxy(t *testing.T, port string, delay *int) {
 	if err != nil {
 		t.Fatalf("proxy listen failed: %v", err)
 	}
+	// delayed chunks can come due after the test is over,
+	// when the servers are gone and t can take no errors.
+	var mu sync.Mutex
+	over := false
+	t.Cleanup(func() {
+		mu.Lock()
+		over = true
+		mu.Unlock()
+	})
 	go func() {
 		defer l.Close()
 		defer os.Remove(portx)
@@ -653,7 +663,6 @@ func proxy(t *testing.T, port string, delay *int) {
 			if err != nil {
 				t.Fatalf("proxy accept failed: %v\n", err)
 			}
-			time.Sleep(time.Duration(*delay) * time.Second)
 			c2, err := net.Dial("unix", portx)
 			if err != nil {
 				t.Fatalf("proxy dial failed: %v\n", err)
@@ -672,6 +681,34 @@ func proxy(t *testing.T, port string, delay *int) {
 					}
 				}
 			}()
+
+			// clients keep their connections open across RPCs,
+			// so delay each chunk of requests, not just the
+			// first, by however long delay says when it arrives.
+			type chunk struct {
+				buf []byte
+				at  time.Time
+			}
+			chunks := make(chan chunk, 1000)
+			written := make(chan bool)
+			go func() {
+				defer close(written)
+				ok := true
+				for c := range chunks {
+					time.Sleep(c.at.Sub(time.Now()))
+					if ok {
+						n1, err1 := c2.Write(c.buf)
+						if err1 != nil || n1 != len(c.buf) {
+							mu.Lock()
+							if over == false {
+								t.Errorf("proxy c2.Write: %v\n", err1)
+							}
+							mu.Unlock()
+							ok = false
+						}
+					}
+				}
+			}()
 			for {
 				buf := make([]byte, 1000)
 				n, err := c1.Read(buf)
@@ -681,11 +718,10 @@ func proxy(t *testing.T, port string, delay *int) {
 				if n == 0 {
 					break
 				}
-				n1, err1 := c2.Write(buf[0:n])
-				if err1 != nil || n1 != n {
-					t.Fatalf("proxy c2.Write: %v\n", err1)
-				}
+				chunks <- chunk{buf[0:n], time.Now().Add(time.Duration(*delay) * time.Second)}
 			}
+			close(chunks)
+			<-written
 
 			c1.Close()
 			c2.Close()
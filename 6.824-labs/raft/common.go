@@ -0,0 +1,109 @@
+package raft
+
+//
+// RPC definitions for the Raft peers.
+//
+// As in paxos, every message carries the sender's view of
+// the highest Done() argument of each peer, so that Min()
+// can advance without any extra traffic.
+//
+
+const (
+	OK        = "OK"
+	NotLeader = "NotLeader"
+)
+
+type Err string
+
+type Entry struct {
+	Term  int
+	Value interface{}
+}
+
+type RequestVoteArgs struct {
+	Term      int
+	Candidate int
+	LastIndex int // index and term of the candidate's last entry
+	LastTerm  int
+	Dones     []int
+}
+
+type RequestVoteReply struct {
+	Term    int
+	Granted bool
+	Dones   []int
+}
+
+//
+// AppendEntries: Entries go after entry Prev, whose term is
+// PrevTerm. with no Entries, it is a heartbeat.
+//
+type AppendEntriesArgs struct {
+	Term     int
+	Leader   int
+	Prev     int
+	PrevTerm int
+	Entries  []Entry
+	Commit   int // the leader's commit index
+	Dones    []int
+}
+
+type AppendEntriesReply struct {
+	Term     int
+	Success  bool
+	Conflict int // if not Success, the entry to back up to
+	Starts   map[int]interface{} // values waiting on the follower,
+	Values   []interface{}       // as in ForwardArgs
+	Dones    []int
+}
+
+//
+// InstallSnapshot: the leader no longer has the entries a
+// follower needs; it sends its snapshot instead.
+//
+type InstallSnapshotArgs struct {
+	Term   int
+	Leader int
+	Snap   snapshot
+	Dones  []int
+}
+
+type InstallSnapshotReply struct {
+	Term  int
+	Dones []int
+}
+
+//
+// Forward: a follower hands the values Start()ed and
+// Submit()ted on it to the leader. whoever gets it sends
+// back the committed entries from From on, or its snapshot
+// if it has forgotten them.
+//
+type ForwardArgs struct {
+	Starts map[int]interface{}
+	Values []interface{}
+	From   int
+	Dones  []int
+}
+
+type ForwardReply struct {
+	Err     Err
+	Leader  int // the leader, if known, or -1
+	Snap    *snapshot
+	From    int
+	Entries []Entry
+	Dones   []int
+}
+
+//
+// Index: a follower asks the leader for a read index.
+//
+type IndexArgs struct {
+	Dones []int
+}
+
+type IndexReply struct {
+	Err   Err
+	Seq   int
+	Dones []int
+}
@@ -0,0 +1,133 @@
+package raft
+
+//
+// read indexes and the leader lease.
+//
+// once the leader has committed an entry of its own term,
+// its commit index is a read index: every entry decided
+// anywhere is <= it, as long as it is still the leader. it
+// makes sure of that by hearing from a majority after the
+// read began, through the heartbeats it sends anyway.
+//
+// a follower refuses to vote for electionMin after it hears
+// from the leader (see RequestVote), so when a majority has
+// answered heartbeats sent at time t, nobody else can
+// become leader before t + electionMin. the leader holds a
+// lease until then, less clockDrift, and during the lease
+// ReadIndex() answers without waiting for anybody.
+//
+
+import "sort"
+import "time"
+
+//
+// how far the clocks of two peers may drift apart over
+// electionMin.
+//
+const clockDrift = electionMin / 10
+
+//
+// an entry that a linearizable read starting now may be
+// served at: once the application has applied every entry
+// <= seq, its state reflects every value decided before the
+// call. ok is false if no leader could vouch for seq; the
+// application should then put the read in the log.
+//
+func (rf *Raft) ReadIndex() (int, bool) {
+	rf.mu.Lock()
+	if rf.role == leader {
+		defer rf.mu.Unlock()
+		return rf.leaderRead()
+	}
+	if rf.leader < 0 {
+		rf.mu.Unlock()
+		return -1, false
+	}
+	leader := rf.peers[rf.leader]
+	args := &IndexArgs{rf.copyDones()}
+	rf.mu.Unlock()
+
+	var reply IndexReply
+	if call(leader, "Raft.Index", args, &reply) == false {
+		return -1, false
+	}
+	rf.mu.Lock()
+	rf.merge(reply.Dones)
+	rf.mu.Unlock()
+	return reply.Seq, reply.Err == OK
+}
+
+//
+// Index RPC handler: ReadIndex() on behalf of a follower.
+//
+func (rf *Raft) Index(args *IndexArgs, reply *IndexReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(args.Dones)
+
+	reply.Err = NotLeader
+	if rf.role == leader {
+		if seq, ok := rf.leaderRead(); ok {
+			reply.Err = OK
+			reply.Seq = seq
+		}
+	}
+	reply.Dones = rf.copyDones()
+
+	return nil
+}
+
+//
+// rf.mu must be held; leaderRead() may release it while it
+// waits for heartbeats.
+//
+func (rf *Raft) leaderRead() (int, bool) {
+	if rf.termAt(rf.commit) != rf.term {
+		return -1, false
+	}
+	seq := rf.commit
+	if rf.holdsLease() {
+		return seq, true
+	}
+
+	start := time.Now()
+	term := rf.term
+	rf.kick()
+	defer rf.wakeup(4 * heartbeatEvery).Stop()
+	for rf.role == leader && rf.term == term && rf.dead == false {
+		if !rf.quorumAcked().Before(start) {
+			return seq, true
+		}
+		if time.Since(start) >= 4*heartbeatEvery {
+			break
+		}
+		rf.cond.Wait()
+	}
+	return -1, false
+}
+
+//
+// the time by which a majority, me included, has answered
+// a heartbeat sent then or later. rf.mu must be held.
+//
+func (rf *Raft) quorumAcked() time.Time {
+	times := make([]time.Time, 0, len(rf.peers))
+	for i := range rf.peers {
+		if i == rf.me {
+			times = append(times, time.Now())
+		} else {
+			times = append(times, rf.acked[i])
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times[rf.majority()-1]
+}
+
+//
+// rf.mu must be held.
+//
+func (rf *Raft) holdsLease() bool {
+	return rf.role == leader && rf.termAt(rf.commit) == rf.term &&
+		time.Now().Before(rf.quorumAcked().Add(electionMin-clockDrift))
+}
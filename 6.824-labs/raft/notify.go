@@ -0,0 +1,107 @@
+package raft
+
+//
+// blocking and streaming ways to learn about committed
+// entries, as in paxos.
+//
+
+import "paxos"
+import "time"
+
+//
+// signal rf.cond after d.
+//
+func (rf *Raft) wakeup(d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		rf.mu.Lock()
+		rf.cond.Broadcast()
+		rf.mu.Unlock()
+	})
+}
+
+//
+// wait up to timeout for entry seq to be decided.
+// returns right away, with false, if seq has been
+// forgotten or the peer is killed.
+//
+func (rf *Raft) WaitDecided(seq int, timeout time.Duration) (bool, interface{}) {
+	deadline := time.Now().Add(timeout)
+	defer rf.wakeup(timeout).Stop()
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for {
+		if seq < rf.floor() || seq < rf.base {
+			return false, nil
+		}
+		if seq <= rf.commit {
+			return true, rf.log[seq-rf.base].Value
+		}
+		if rf.dead || !time.Now().Before(deadline) {
+			return false, nil
+		}
+		rf.cond.Wait()
+	}
+}
+
+//
+// a channel of committed entries, in order, starting at
+// Min() (preceded by the snapshot, if the peer holds one
+// that ends just before Min()). a jump over entries the
+// application has called Done() on is silent; a jump over
+// entries covered by a snapshot from the leader delivers
+// the snapshot. the channel is closed when the peer is
+// killed. every call returns the same channel.
+//
+func (rf *Raft) Decisions() <-chan paxos.Decision {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.decisions == nil {
+		rf.decisions = make(chan paxos.Decision)
+		next := rf.floor()
+		if rf.snap.Index >= 0 && rf.snap.Index == next-1 {
+			next = rf.snap.Index
+		}
+		go rf.deliver(rf.decisions, next)
+	}
+	return rf.decisions
+}
+
+func (rf *Raft) deliver(ch chan paxos.Decision, next int) {
+	defer close(ch)
+
+	for {
+		rf.mu.Lock()
+		var d paxos.Decision
+		for {
+			if rf.dead {
+				rf.mu.Unlock()
+				return
+			} else if next <= rf.snap.Index {
+				d = paxos.Decision{Seq: rf.snap.Index, Snapshot: rf.snap.State}
+				next = rf.snap.Index + 1
+				break
+			} else if next < rf.floor() || next < rf.base {
+				next = rf.floor()
+				if next < rf.base {
+					next = rf.base
+				}
+			} else if next <= rf.commit {
+				d = paxos.Decision{Seq: next, Value: rf.log[next-rf.base].Value}
+				next++
+				break
+			} else {
+				rf.cond.Wait()
+			}
+		}
+		rf.mu.Unlock()
+
+		select {
+		case ch <- d:
+		case <-rf.killed:
+			return
+		}
+	}
+}
@@ -0,0 +1,698 @@
+package raft
+
+//
+// Raft, behind the same application interface as paxos
+// (see paxos.Interface), so that a service can run on
+// either one.
+//
+// px = raft.Make(peers []string, me int, rpcs *rpc.Server)
+// px.Start(seq int, v interface{}) -- ask for v at entry seq
+// px.Status(seq int) (decided bool, v interface{})
+// px.Done(seq int) -- ok to forget all entries <= seq
+// px.Max() int -- index of the last entry in the log, or -1
+// px.Min() int -- entries before this one have been forgotten
+// px.Snapshot(seq int, state []byte) -- application state up to seq
+// px.Restore(seq int) (last int, state []byte, ok bool) -- catch up
+// px.WaitDecided(seq int, timeout) (decided bool, v interface{})
+// px.Decisions() <-chan paxos.Decision -- committed entries, in order
+// px.Submit(v interface{}) -- put v in some entry
+// px.ReadIndex() (seq int, ok bool) -- for linearizable reads
+//
+// a paxos instance is a Raft log entry, and an entry is
+// decided once it is committed. the leader appends values
+// to its log and replicates them; a newly elected leader
+// first appends a nil entry of its own term, so that the
+// entries before it commit.
+//
+// Start(seq, v) only puts v at seq if the leader's log ends
+// just before seq (padding it with nil entries if it ends
+// further back). otherwise whatever is at seq is what will
+// be decided there, as with a paxos instance somebody else
+// proposed for first. followers forward Start() and
+// Submit() values to the leader (see submit.go).
+//
+// entries are forgotten just as paxos instances are: once
+// every peer is Done() with them, or once a Snapshot()
+// covers them. a follower that needs entries the leader has
+// forgotten gets the leader's snapshot (see snapshot.go).
+//
+// nothing is kept on disk: a peer that crashes must not
+// come back under the same name.
+//
+
+import "net"
+import "net/rpc"
+import "transport"
+import "paxos"
+import "log"
+import "sync"
+import "fmt"
+import "math/rand"
+import "time"
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+const heartbeatEvery = 50 * time.Millisecond
+
+//
+// a follower that has heard nothing from a leader for
+// between electionMin and 2*electionMin starts an election.
+//
+const electionMin = 300 * time.Millisecond
+
+// at most this many entries per AppendEntries.
+const maxEntries = 100
+
+type Raft struct {
+	mu         sync.Mutex
+	l          net.Listener
+	dead       bool
+	unreliable bool
+	rpcCount   int
+	peers      []string
+	me         int // index into peers[]
+
+	term     int
+	votedFor int // in term, or -1
+	role     int
+	leader   int           // leader of term, or -1
+	heard    time.Time     // last word from the leader, or vote granted
+	timeout  time.Duration // how long to wait for word before an election
+	beat     time.Time     // when I last sent heartbeats, as leader
+	retried  time.Time     // when I last called flush()
+	fed      time.Time     // last AppendEntries or InstallSnapshot
+	hint     int           // who to flush() to if there is no leader
+
+	log      []Entry // log[i] is entry base+i
+	base     int
+	baseTerm int // term of entry base-1
+	commit   int // entries <= commit are decided
+	snap     snapshot
+	dones    []int // highest Done() argument heard from each peer
+
+	next  []int       // leader: next entry to send to each peer
+	match []int       // leader: last entry known to be on each peer
+	busy  []bool      // leader: AppendEntries to the peer under way
+	acked []time.Time // leader: send time of the last one each peer answered
+
+	starts   map[int]interface{} // Start()ed here and not decided yet
+	queue    []interface{}       // Submit()ted here, not yet with the leader
+	handed   int                 // how many values have left the queue
+	flushing bool
+
+	cond      *sync.Cond // on mu; signalled when commit, Min() or acked move
+	decisions chan paxos.Decision
+	killed    chan bool
+}
+
+//
+// call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if call() was not able to contact the server. in particular,
+// the replys contents are only valid if call() returned true.
+//
+func call(srv string, name string, args interface{}, reply interface{}) bool {
+	c, err := transport.Dial(srv)
+	if err != nil {
+		if !transport.IsUnreachable(err) {
+			fmt.Printf("raft Dial() failed: %v\n", err)
+		}
+		return false
+	}
+	defer c.Close()
+
+	err = c.Call(name, args, reply)
+	if err == nil {
+		return true
+	}
+	return false
+}
+
+func (rf *Raft) last() int {
+	return rf.base + len(rf.log) - 1
+}
+
+//
+// the term of entry i, or -1 if it is not in the log.
+//
+func (rf *Raft) termAt(i int) int {
+	if i == rf.base-1 {
+		return rf.baseTerm
+	}
+	if i < rf.base || i > rf.last() {
+		return -1
+	}
+	return rf.log[i-rf.base].Term
+}
+
+func (rf *Raft) majority() int {
+	return len(rf.peers)/2 + 1
+}
+
+func (rf *Raft) electionTimeout() time.Duration {
+	return electionMin + time.Duration(rand.Int63n(int64(electionMin)))
+}
+
+func (rf *Raft) copyDones() []int {
+	dones := make([]int, len(rf.dones))
+	copy(dones, rf.dones)
+	return dones
+}
+
+//
+// fold another peer's view of the Done() values into
+// ours, and free whatever is no longer needed.
+// rf.mu must be held.
+//
+func (rf *Raft) merge(dones []int) {
+	for i := 0; i < len(dones) && i < len(rf.dones); i++ {
+		if dones[i] > rf.dones[i] {
+			rf.dones[i] = dones[i]
+		}
+	}
+	rf.forget()
+}
+
+func (rf *Raft) min() int {
+	m := rf.dones[0]
+	for _, d := range rf.dones {
+		if d < m {
+			m = d
+		}
+	}
+	return m + 1
+}
+
+//
+// entries below floor() are gone from this peer.
+// rf.mu must be held.
+//
+func (rf *Raft) floor() int {
+	if rf.snap.Index >= rf.min() {
+		return rf.snap.Index + 1
+	}
+	return rf.min()
+}
+
+func (rf *Raft) forget() {
+	f := rf.floor()
+	if f > rf.commit+1 {
+		f = rf.commit + 1
+	}
+	if f > rf.base {
+		rf.baseTerm = rf.termAt(f - 1)
+		rf.log = append([]Entry(nil), rf.log[f-rf.base:]...)
+		rf.base = f
+		rf.cond.Broadcast()
+	}
+}
+
+//
+// a higher term, or a leader for mine: back to following.
+// rf.mu must be held.
+//
+func (rf *Raft) stepDown(term int) {
+	if term > rf.term {
+		rf.term = term
+		rf.votedFor = -1
+		rf.leader = -1
+	}
+	rf.role = follower
+}
+
+//
+// RequestVote RPC handler.
+//
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(args.Dones)
+
+	// a peer that follows a live leader does not help
+	// depose it; leases depend on that (see lease.go).
+	sticky := rf.role == leader ||
+		(rf.leader >= 0 && rf.leader != args.Candidate && time.Since(rf.heard) < electionMin)
+	if args.Term > rf.term && !sticky {
+		rf.stepDown(args.Term)
+	}
+	last := rf.last()
+	uptodate := args.LastTerm > rf.termAt(last) ||
+		(args.LastTerm == rf.termAt(last) && args.LastIndex >= last)
+	if args.Term == rf.term && !sticky && uptodate &&
+		(rf.votedFor < 0 || rf.votedFor == args.Candidate) {
+		rf.votedFor = args.Candidate
+		rf.heard = time.Now()
+		reply.Granted = true
+	}
+	reply.Term = rf.term
+	reply.Dones = rf.copyDones()
+
+	return nil
+}
+
+//
+// AppendEntries RPC handler.
+//
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(args.Dones)
+	defer func() {
+		reply.Term = rf.term
+		reply.Dones = rf.copyDones()
+	}()
+
+	if args.Term < rf.term {
+		return nil
+	}
+	rf.stepDown(args.Term)
+	rf.leader = args.Leader
+	rf.heard = time.Now()
+	rf.fed = rf.heard
+	rf.handBack(reply)
+
+	prev, prevTerm, entries := args.Prev, args.PrevTerm, args.Entries
+	if prev < rf.base-1 {
+		// entries before my base are committed, so the
+		// leader has the same ones.
+		n := rf.base - 1 - prev
+		if n > len(entries) {
+			n = len(entries)
+		}
+		entries = entries[n:]
+		prev += n
+		prevTerm = rf.termAt(prev)
+	}
+	if prev > rf.last() {
+		reply.Conflict = rf.last() + 1
+		return nil
+	}
+	if t := rf.termAt(prev); t != prevTerm {
+		// skip back over the whole conflicting term.
+		i := prev
+		for i > rf.base && rf.termAt(i-1) == t {
+			i--
+		}
+		reply.Conflict = i
+		return nil
+	}
+
+	for i, e := range entries {
+		idx := prev + 1 + i
+		if idx <= rf.last() && rf.termAt(idx) == e.Term {
+			continue
+		}
+		rf.log = append(rf.log[:idx-rf.base], entries[i:]...)
+		break
+	}
+	if match := prev + len(entries); args.Commit > rf.commit && match > rf.commit {
+		rf.commit = args.Commit
+		if match < rf.commit {
+			rf.commit = match
+		}
+		rf.cond.Broadcast()
+	}
+	reply.Success = true
+
+	return nil
+}
+
+//
+// send the entries a follower is missing, or a heartbeat
+// if it has them all. one at a time per follower.
+//
+func (rf *Raft) replicate(i int) {
+	defer func() {
+		rf.mu.Lock()
+		rf.busy[i] = false
+		rf.mu.Unlock()
+	}()
+
+	for rf.dead == false {
+		rf.mu.Lock()
+		if rf.role != leader {
+			rf.mu.Unlock()
+			return
+		}
+		if rf.next[i] < rf.base {
+			if rf.snap.Index == rf.base-1 {
+				rf.mu.Unlock()
+				if rf.sendSnapshot(i) {
+					continue
+				}
+				return
+			}
+			// forgotten because every peer is Done() with
+			// them, so the follower has them.
+			rf.next[i] = rf.base
+		}
+		term := rf.term
+		prev := rf.next[i] - 1
+		n := rf.last() - prev
+		if n > maxEntries {
+			n = maxEntries
+		}
+		args := &AppendEntriesArgs{term, rf.me, prev, rf.termAt(prev),
+			append([]Entry(nil), rf.log[prev+1-rf.base:prev+1-rf.base+n]...),
+			rf.commit, rf.copyDones()}
+		rf.mu.Unlock()
+
+		sent := time.Now()
+		var reply AppendEntriesReply
+		if call(rf.peers[i], "Raft.AppendEntries", args, &reply) == false {
+			return
+		}
+
+		rf.mu.Lock()
+		rf.merge(reply.Dones)
+		if reply.Term > rf.term {
+			rf.stepDown(reply.Term)
+		}
+		if rf.role != leader || rf.term != term {
+			rf.mu.Unlock()
+			return
+		}
+		if sent.After(rf.acked[i]) {
+			rf.acked[i] = sent
+			rf.cond.Broadcast()
+		}
+		if len(reply.Starts) > 0 || len(reply.Values) > 0 {
+			rf.place(reply.Starts, reply.Values)
+		}
+		more := false
+		if reply.Success {
+			if m := prev + n; m > rf.match[i] {
+				rf.match[i] = m
+			}
+			rf.next[i] = prev + n + 1
+			rf.advance()
+			more = rf.next[i] <= rf.last()
+		} else {
+			rf.next[i] = reply.Conflict
+			more = true
+		}
+		rf.mu.Unlock()
+
+		if !more {
+			return
+		}
+	}
+}
+
+//
+// commit whatever entries of my term a majority has.
+// rf.mu must be held.
+//
+func (rf *Raft) advance() {
+	for n := rf.last(); n > rf.commit && rf.termAt(n) == rf.term; n-- {
+		count := 1
+		for i := range rf.peers {
+			if i != rf.me && rf.match[i] >= n {
+				count++
+			}
+		}
+		if count >= rf.majority() {
+			rf.commit = n
+			rf.cond.Broadcast()
+			return
+		}
+	}
+}
+
+//
+// start replicating to every follower that is not
+// already being sent something. rf.mu must be held.
+//
+func (rf *Raft) kick() {
+	rf.beat = time.Now()
+	for i := range rf.peers {
+		if i != rf.me && rf.busy[i] == false {
+			rf.busy[i] = true
+			go rf.replicate(i)
+		}
+	}
+}
+
+//
+// append values to my log, as leader. rf.mu must be held.
+//
+func (rf *Raft) add(vs ...interface{}) {
+	for _, v := range vs {
+		rf.log = append(rf.log, Entry{rf.term, v})
+	}
+	rf.advance()
+	rf.kick()
+}
+
+func (rf *Raft) elect() {
+	rf.mu.Lock()
+	rf.term++
+	rf.role = candidate
+	rf.votedFor = rf.me
+	rf.leader = -1
+	term := rf.term
+	args := &RequestVoteArgs{term, rf.me, rf.last(), rf.termAt(rf.last()), rf.copyDones()}
+	rf.mu.Unlock()
+
+	replies := make(chan *RequestVoteReply, len(rf.peers))
+	for i, addr := range rf.peers {
+		if i == rf.me {
+			continue
+		}
+		go func(addr string) {
+			var reply RequestVoteReply
+			if call(addr, "Raft.RequestVote", args, &reply) {
+				replies <- &reply
+			} else {
+				replies <- nil
+			}
+		}(addr)
+	}
+
+	votes := 1
+	for i := 0; i < len(rf.peers)-1 && votes < rf.majority(); i++ {
+		reply := <-replies
+		if reply == nil {
+			continue
+		}
+		rf.mu.Lock()
+		rf.merge(reply.Dones)
+		if reply.Term > rf.term {
+			rf.stepDown(reply.Term)
+		}
+		rf.mu.Unlock()
+		if reply.Granted {
+			votes++
+		}
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if votes >= rf.majority() && rf.role == candidate && rf.term == term {
+		rf.role = leader
+		rf.leader = rf.me
+		for i := range rf.peers {
+			rf.next[i] = rf.last() + 1
+			rf.match[i] = -1
+			rf.acked[i] = time.Time{}
+		}
+		// commits the entries of earlier terms.
+		rf.add(nil)
+		rf.place(rf.starts, rf.queue)
+		rf.handed += len(rf.queue)
+		rf.queue = nil
+	}
+}
+
+//
+// heartbeats, elections, and retries of forwarded values.
+//
+func (rf *Raft) ticker() {
+	for rf.dead == false {
+		rf.mu.Lock()
+		if rf.role == leader {
+			if time.Since(rf.beat) >= heartbeatEvery {
+				rf.kick()
+			}
+		} else if time.Since(rf.heard) >= rf.timeout {
+			rf.heard = time.Now()
+			rf.timeout = rf.electionTimeout()
+			go rf.elect()
+		}
+		for seq := range rf.starts {
+			if seq <= rf.commit || seq < rf.floor() {
+				delete(rf.starts, seq)
+			}
+		}
+		// keep forwarding values until they make it, and
+		// catch up by hand if the leader cannot reach me.
+		pending := len(rf.starts) > 0 || len(rf.queue) > 0
+		starved := rf.role != leader && time.Since(rf.fed) >= electionMin
+		if time.Since(rf.retried) >= heartbeatEvery && (pending || starved) {
+			rf.retried = time.Now()
+			go rf.flush()
+		}
+		rf.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// the application wants to know whether this peer thinks
+// entry seq is decided, and if so what it holds. Status()
+// only inspects the local peer state.
+//
+func (rf *Raft) Status(seq int) (bool, interface{}) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if seq < rf.floor() || seq < rf.base || seq > rf.commit {
+		return false, nil
+	}
+	return true, rf.log[seq-rf.base].Value
+}
+
+//
+// the application on this machine is done with
+// all entries <= seq.
+//
+func (rf *Raft) Done(seq int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if seq > rf.dones[rf.me] {
+		rf.dones[rf.me] = seq
+		rf.forget()
+		rf.cond.Broadcast()
+	}
+}
+
+//
+// the highest entry this peer has, decided or not.
+//
+func (rf *Raft) Max() int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.last()
+}
+
+//
+// one more than the lowest Done() argument of any peer, or
+// one past this peer's snapshot, whichever is higher. as
+// in paxos, entries below Min() are forgotten.
+//
+func (rf *Raft) Min() int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.floor()
+}
+
+//
+// tell the peer to shut itself down.
+// for testing.
+//
+func (rf *Raft) Kill() {
+	rf.dead = true
+	if rf.l != nil {
+		rf.l.Close()
+	}
+	rf.mu.Lock()
+	select {
+	case <-rf.killed:
+	default:
+		close(rf.killed)
+	}
+	rf.cond.Broadcast()
+	rf.mu.Unlock()
+}
+
+//
+// the application wants to create a raft peer.
+// the ports of all the raft peers (including this one)
+// are in peers[]. this servers port is peers[me].
+//
+func Make(peers []string, me int, rpcs *rpc.Server) *Raft {
+	rf := &Raft{}
+	rf.peers = peers
+	rf.me = me
+
+	rf.votedFor = -1
+	rf.leader = -1
+	rf.hint = -1
+	rf.role = follower
+	rf.heard = time.Now()
+	rf.timeout = rf.electionTimeout()
+	rf.baseTerm = -1
+	rf.commit = -1
+	rf.snap = snapshot{Index: -1, Term: -1}
+	rf.dones = make([]int, len(peers))
+	for i := range rf.dones {
+		rf.dones[i] = -1
+	}
+	rf.next = make([]int, len(peers))
+	rf.match = make([]int, len(peers))
+	rf.busy = make([]bool, len(peers))
+	rf.acked = make([]time.Time, len(peers))
+	rf.starts = make(map[int]interface{})
+	rf.cond = sync.NewCond(&rf.mu)
+	rf.killed = make(chan bool)
+
+	go rf.ticker()
+
+	if rpcs != nil {
+		// caller will create socket &c
+		rpcs.Register(rf)
+	} else {
+		rpcs = rpc.NewServer()
+		rpcs.Register(rf)
+
+		// prepare to receive connections from clients.
+		// the address says which transport to use.
+		l, e := transport.Listen(peers[me])
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		rf.l = l
+
+		// create a thread to accept RPC connections
+		go func() {
+			for rf.dead == false {
+				conn, err := rf.l.Accept()
+				if err == nil && rf.dead == false {
+					if rf.unreliable && (rand.Int63()%1000) < 100 {
+						// discard the request.
+						conn.Close()
+					} else if rf.unreliable && (rand.Int63()%1000) < 200 {
+						// process the request but force discard of reply.
+						conn = transport.DiscardReply(conn)
+						rf.rpcCount++
+						go rpcs.ServeConn(conn)
+					} else {
+						rf.rpcCount++
+						go rpcs.ServeConn(conn)
+					}
+				} else if err == nil {
+					conn.Close()
+				}
+				if err != nil && rf.dead == false {
+					fmt.Printf("Raft(%v) accept: %v\n", me, err.Error())
+				}
+			}
+		}()
+	}
+
+	return rf
+}
@@ -0,0 +1,126 @@
+package raft
+
+//
+// snapshots, as in paxos: Snapshot(seq, state) lets a
+// peer forget the entries <= seq whatever the other peers
+// have done. a leader that has forgotten entries a
+// follower still needs sends its snapshot instead
+// (InstallSnapshot), and the follower's application
+// finds it through Restore() or Decisions().
+//
+
+import "time"
+
+type snapshot struct {
+	Index int // the state reflects every entry <= Index
+	Term  int // the term of entry Index
+	State []byte
+}
+
+//
+// the application's state after applying every entry
+// <= seq, all of which must be decided. only the latest
+// snapshot is kept.
+//
+func (rf *Raft) Snapshot(seq int, state []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if seq <= rf.snap.Index || seq > rf.commit {
+		return
+	}
+	rf.snap = snapshot{seq, rf.termAt(seq), state}
+	rf.forget()
+}
+
+//
+// if entry seq is covered by this peer's snapshot,
+// Restore() returns it: state is the application state
+// after every entry <= last, and last >= seq.
+//
+func (rf *Raft) Restore(seq int) (int, []byte, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if seq > rf.snap.Index {
+		return 0, nil, false
+	}
+	return rf.snap.Index, rf.snap.State, true
+}
+
+//
+// send my snapshot to follower i. returns true if it got
+// there and I am still the leader.
+//
+func (rf *Raft) sendSnapshot(i int) bool {
+	rf.mu.Lock()
+	term := rf.term
+	args := &InstallSnapshotArgs{term, rf.me, rf.snap, rf.copyDones()}
+	rf.mu.Unlock()
+
+	var reply InstallSnapshotReply
+	if call(rf.peers[i], "Raft.InstallSnapshot", args, &reply) == false {
+		return false
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(reply.Dones)
+	if reply.Term > rf.term {
+		rf.stepDown(reply.Term)
+	}
+	if rf.role != leader || rf.term != term {
+		return false
+	}
+	if args.Snap.Index > rf.match[i] {
+		rf.match[i] = args.Snap.Index
+	}
+	rf.next[i] = rf.match[i] + 1
+	return true
+}
+
+//
+// InstallSnapshot RPC handler.
+//
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(args.Dones)
+
+	if args.Term >= rf.term {
+		rf.stepDown(args.Term)
+		rf.leader = args.Leader
+		rf.heard = time.Now()
+		rf.fed = rf.heard
+
+		rf.install(args.Snap)
+	}
+	reply.Term = rf.term
+	reply.Dones = rf.copyDones()
+
+	return nil
+}
+
+//
+// take on a snapshot from another peer, unless I am
+// already past it. rf.mu must be held.
+//
+func (rf *Raft) install(s snapshot) {
+	if s.Index <= rf.commit {
+		return
+	}
+	if s.Index <= rf.last() && rf.termAt(s.Index) == s.Term {
+		// keep what follows it.
+		rf.log = append([]Entry(nil), rf.log[s.Index+1-rf.base:]...)
+	} else {
+		rf.log = nil
+	}
+	rf.base = s.Index + 1
+	rf.baseTerm = s.Term
+	rf.commit = s.Index
+	rf.snap = s
+	rf.forget()
+	rf.cond.Broadcast()
+}
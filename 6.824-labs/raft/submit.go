@@ -0,0 +1,217 @@
+package raft
+
+//
+// getting values into the log. only the leader appends;
+// everybody else hands its values to the leader, and keeps
+// doing so for a Start()ed value until its entry is
+// decided, since a new leader may drop uncommitted
+// entries. Submit()ted values are handed over once, so,
+// as in paxos, a lost reply can put one in the log twice.
+//
+// a follower that cannot reach the leader (it may be able
+// to call us but not be called) also hands its values back
+// in its AppendEntries replies. a Submit()ted value in a
+// reply that is lost is lost with it; the application has
+// to retry, as it would if the leader failed.
+//
+
+import "sort"
+import "math/rand"
+
+//
+// the application wants v at entry seq. Start() returns
+// right away; the application calls Status() to find out
+// what was decided there.
+//
+func (rf *Raft) Start(seq int, v interface{}) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if seq < rf.floor() || seq <= rf.commit {
+		return
+	}
+	rf.starts[seq] = v
+	if rf.role == leader {
+		rf.place(map[int]interface{}{seq: v}, nil)
+	} else {
+		go rf.flush()
+	}
+}
+
+//
+// the application wants v in the log, and does not care
+// where. Submit() returns right away.
+//
+func (rf *Raft) Submit(v interface{}) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.role == leader {
+		rf.add(v)
+	} else {
+		rf.queue = append(rf.queue, v)
+		go rf.flush()
+	}
+}
+
+//
+// as leader, put each of starts at its entry if my log
+// ends before it, and values at the end of the log.
+// rf.mu must be held.
+//
+func (rf *Raft) place(starts map[int]interface{}, values []interface{}) {
+	var seqs []int
+	for seq := range starts {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		for rf.last() < seq-1 {
+			rf.add(nil)
+		}
+		if rf.last() == seq-1 {
+			rf.add(starts[seq])
+		}
+	}
+	if len(values) > 0 {
+		rf.add(values...)
+	}
+}
+
+//
+// hand my Start()ed and Submit()ted values to the leader,
+// and pick up committed entries that AppendEntries has not
+// brought me. if I do not know the leader, any peer will
+// do for the latter.
+//
+func (rf *Raft) flush() {
+	rf.mu.Lock()
+	if rf.role == leader {
+		rf.place(rf.starts, rf.queue)
+		rf.handed += len(rf.queue)
+		rf.queue = nil
+		rf.mu.Unlock()
+		return
+	}
+	if rf.flushing || len(rf.peers) < 2 {
+		rf.mu.Unlock()
+		return
+	}
+	rf.flushing = true
+	to := rf.leader
+	if to < 0 || to == rf.me {
+		to = rf.hint
+	}
+	for to < 0 || to == rf.me {
+		to = rand.Intn(len(rf.peers))
+	}
+	starts := make(map[int]interface{})
+	for seq, v := range rf.starts {
+		starts[seq] = v
+	}
+	args := &ForwardArgs{starts, append([]interface{}(nil), rf.queue...),
+		rf.commit + 1, rf.copyDones()}
+	handed := rf.handed
+	rf.mu.Unlock()
+
+	var reply ForwardReply
+	ok := call(rf.peers[to], "Raft.Forward", args, &reply)
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.flushing = false
+	rf.hint = -1
+	if !ok {
+		return
+	}
+	rf.merge(reply.Dones)
+	if reply.Snap != nil {
+		rf.install(*reply.Snap)
+	}
+	rf.learn(reply.From, reply.Entries)
+	if reply.Err == OK {
+		// handBack() may have taken some of them meanwhile.
+		if n := handed + len(args.Values) - rf.handed; n > 0 {
+			rf.queue = rf.queue[n:]
+			rf.handed += n
+		}
+	} else {
+		rf.hint = reply.Leader
+	}
+}
+
+//
+// as a follower, put my waiting values in an AppendEntries
+// reply. rf.mu must be held.
+//
+func (rf *Raft) handBack(reply *AppendEntriesReply) {
+	if len(rf.starts) > 0 {
+		reply.Starts = make(map[int]interface{})
+		for seq, v := range rf.starts {
+			reply.Starts[seq] = v
+		}
+	}
+	reply.Values = rf.queue
+	rf.handed += len(rf.queue)
+	rf.queue = nil
+}
+
+//
+// entries from, from+1, ... are committed. rf.mu must be
+// held.
+//
+func (rf *Raft) learn(from int, entries []Entry) {
+	for i, e := range entries {
+		idx := from + i
+		if idx <= rf.commit {
+			continue
+		}
+		if idx > rf.last()+1 {
+			break
+		}
+		if rf.termAt(idx) != e.Term {
+			rf.log = append(rf.log[:idx-rf.base], e)
+		}
+		rf.commit = idx
+		rf.cond.Broadcast()
+	}
+}
+
+//
+// Forward RPC handler.
+//
+func (rf *Raft) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.merge(args.Dones)
+
+	if rf.role == leader {
+		rf.place(args.Starts, args.Values)
+		reply.Err = OK
+	} else {
+		reply.Err = NotLeader
+	}
+	reply.Leader = rf.leader
+
+	from := args.From
+	if from < rf.base && rf.snap.Index == rf.base-1 {
+		snap := rf.snap
+		reply.Snap = &snap
+		from = rf.base
+	}
+	if from >= rf.base {
+		n := rf.commit + 1 - from
+		if n > maxEntries {
+			n = maxEntries
+		}
+		if n > 0 {
+			reply.From = from
+			reply.Entries = append([]Entry(nil), rf.log[from-rf.base:from-rf.base+n]...)
+		}
+	}
+	reply.Dones = rf.copyDones()
+
+	return nil
+}
@@ -0,0 +1,440 @@
+package raft
+
+import "testing"
+import "runtime"
+import "strconv"
+import "os"
+import "time"
+import "fmt"
+import "reflect"
+
+func port(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "rf-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+func ndecided(t *testing.T, rfa []*Raft, seq int) int {
+  count := 0
+  var v interface{}
+  for i := 0; i < len(rfa); i++ {
+    if rfa[i] != nil {
+      decided, v1 := rfa[i].Status(seq)
+      if decided {
+        if count > 0 && !reflect.DeepEqual(v, v1) {
+          t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+            seq, i, v, v1)
+        }
+        count++
+        v = v1
+      }
+    }
+  }
+  return count
+}
+
+func waitn(t *testing.T, rfa []*Raft, seq int, wanted int) {
+  to := 10 * time.Millisecond
+  for iters := 0; iters < 30; iters++ {
+    if ndecided(t, rfa, seq) >= wanted {
+      break
+    }
+    time.Sleep(to)
+    if to < time.Second {
+      to *= 2
+    }
+  }
+  nd := ndecided(t, rfa, seq)
+  if nd < wanted {
+    t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+  }
+}
+
+func waitmajority(t *testing.T, rfa []*Raft, seq int) {
+  waitn(t, rfa, seq, (len(rfa) / 2) + 1)
+}
+
+func cleanup(rfa []*Raft) {
+  for i := 0; i < len(rfa); i++ {
+    if rfa[i] != nil {
+      rfa[i].Kill()
+    }
+  }
+}
+
+func pp(tag string, src int, dst int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  s += "rf-" + tag + "-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += strconv.Itoa(src) + "-"
+  s += strconv.Itoa(dst)
+  return s
+}
+
+func cleanpp(tag string, n int) {
+  for i := 0; i < n; i++ {
+    for j := 0; j < n; j++ {
+      ij := pp(tag, i, j)
+      os.Remove(ij)
+    }
+  }
+}
+
+func part(t *testing.T, tag string, npeers int, p1 []int, p2 []int, p3 []int) {
+  cleanpp(tag, npeers)
+
+  pa := [][]int{p1, p2, p3}
+  for pi := 0; pi < len(pa); pi++ {
+    p := pa[pi]
+    for i := 0; i < len(p); i++ {
+      for j := 0; j < len(p); j++ {
+        ij := pp(tag, p[i], p[j])
+        pj := port(tag, p[j])
+        err := os.Link(pj, ij)
+        if err != nil {
+          t.Fatalf("os.Link(%v, %v): %v\n", pj, ij, err)
+        }
+      }
+    }
+  }
+}
+
+//
+// peers that reach each other through pp() links, so
+// that part() can partition them.
+//
+func makepart(tag string, npeers int) []*Raft {
+  rfa := make([]*Raft, npeers)
+  for i := 0; i < npeers; i++ {
+    var rfh []string = make([]string, npeers)
+    for j := 0; j < npeers; j++ {
+      if j == i {
+        rfh[j] = port(tag, i)
+      } else {
+        rfh[j] = pp(tag, i, j)
+      }
+    }
+    rfa[i] = Make(rfh, i, nil)
+  }
+  return rfa
+}
+
+func leaderOf(rfa []*Raft) int {
+  for i := 0; i < len(rfa); i++ {
+    rfa[i].mu.Lock()
+    l := rfa[i].role == leader
+    rfa[i].mu.Unlock()
+    if l {
+      return i
+    }
+  }
+  return -1
+}
+
+func TestBasic(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  var rfa []*Raft = make([]*Raft, npeers)
+  var rfh []string = make([]string, npeers)
+  defer cleanup(rfa)
+
+  for i := 0; i < npeers; i++ {
+    rfh[i] = port("basic", i)
+  }
+  for i := 0; i < npeers; i++ {
+    rfa[i] = Make(rfh, i, nil)
+  }
+
+  fmt.Printf("Test: Single proposer ...\n")
+
+  rfa[0].Start(0, "hello")
+  waitn(t, rfa, 0, npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, same value ...\n")
+
+  for i := 0; i < npeers; i++ {
+    rfa[i].Start(1, 77)
+  }
+  waitn(t, rfa, 1, npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, different values ...\n")
+
+  rfa[0].Start(2, 100)
+  rfa[1].Start(2, 101)
+  rfa[2].Start(2, 102)
+  waitn(t, rfa, 2, npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Out-of-order instances ...\n")
+
+  rfa[0].Start(7, 700)
+  rfa[0].Start(6, 600)
+  rfa[1].Start(5, 500)
+  waitn(t, rfa, 7, npeers)
+  rfa[0].Start(4, 400)
+  rfa[1].Start(3, 300)
+  for seq := 3; seq <= 7; seq++ {
+    waitn(t, rfa, seq, npeers)
+  }
+  if rfa[0].Max() < 7 {
+    t.Fatalf("wrong Max()")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestForget(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  var rfa []*Raft = make([]*Raft, npeers)
+  var rfh []string = make([]string, npeers)
+  defer cleanup(rfa)
+
+  for i := 0; i < npeers; i++ {
+    rfh[i] = port("forget", i)
+  }
+  for i := 0; i < npeers; i++ {
+    rfa[i] = Make(rfh, i, nil)
+  }
+
+  fmt.Printf("Test: Forgetting ...\n")
+
+  for seq := 0; seq < 10; seq++ {
+    rfa[seq % npeers].Start(seq, seq)
+    waitn(t, rfa, seq, npeers)
+  }
+  for i := 0; i < npeers; i++ {
+    if m := rfa[i].Min(); m != 0 {
+      t.Fatalf("wrong initial Min() %v", m)
+    }
+  }
+
+  rfa[0].Done(4)
+  rfa[1].Done(5)
+  rfa[2].Done(6)
+  rfa[0].Start(10, "x")
+  waitn(t, rfa, 10, npeers)
+
+  ok := false
+  for iters := 0; iters < 20 && !ok; iters++ {
+    ok = true
+    for i := 0; i < npeers; i++ {
+      if rfa[i].Min() != 5 {
+        ok = false
+      }
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !ok {
+    t.Fatalf("Min() did not advance to 5")
+  }
+  if decided, _ := rfa[0].Status(4); decided {
+    t.Fatalf("Status() of a forgotten entry")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestFailover(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "failover"
+  const npeers = 5
+  defer cleanpp(tag, npeers)
+  part(t, tag, npeers, []int{}, []int{}, []int{})
+  rfa := makepart(tag, npeers)
+  defer cleanup(rfa)
+  defer part(t, tag, npeers, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: No decision if partitioned ...\n")
+
+  part(t, tag, npeers, []int{0,2}, []int{1,3}, []int{4})
+  rfa[1].Start(0, 111)
+  time.Sleep(2 * time.Second)
+  if nd := ndecided(t, rfa, 0); nd > 0 {
+    t.Fatalf("decided without a majority")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decision in majority partition ...\n")
+
+  part(t, tag, npeers, []int{0}, []int{1,2,3}, []int{4})
+  waitmajority(t, rfa, 0)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: All agree after full heal ...\n")
+
+  part(t, tag, npeers, []int{0,1,2,3,4}, []int{}, []int{})
+  rfa[0].Start(1, "heal")
+  waitn(t, rfa, 0, npeers)
+  waitn(t, rfa, 1, npeers)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Leader cut off ...\n")
+
+  for iters := 0; iters < 5; iters++ {
+    seq := 2 + iters
+    l := -1
+    for l < 0 {
+      l = leaderOf(rfa)
+      time.Sleep(50 * time.Millisecond)
+    }
+    rest := []int{}
+    for i := 0; i < npeers; i++ {
+      if i != l {
+        rest = append(rest, i)
+      }
+    }
+    part(t, tag, npeers, []int{l}, rest, []int{})
+    rfa[l].Start(seq, -1)
+    rfa[rest[0]].Start(seq, seq)
+    waitn(t, rfa, seq, npeers - 1)
+    part(t, tag, npeers, []int{0,1,2,3,4}, []int{}, []int{})
+    waitn(t, rfa, seq, npeers)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestUnreliable(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  var rfa []*Raft = make([]*Raft, npeers)
+  var rfh []string = make([]string, npeers)
+  defer cleanup(rfa)
+
+  for i := 0; i < npeers; i++ {
+    rfh[i] = port("unreliable", i)
+  }
+  for i := 0; i < npeers; i++ {
+    rfa[i] = Make(rfh, i, nil)
+    rfa[i].unreliable = true
+  }
+
+  fmt.Printf("Test: Many entries, unreliable ...\n")
+
+  const nseq = 50
+  for seq := 0; seq < nseq; seq++ {
+    for i := 0; i < npeers; i++ {
+      rfa[i].Start(seq, seq * 10 + i)
+    }
+  }
+  for seq := 0; seq < nseq; seq++ {
+    waitn(t, rfa, seq, npeers)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "snapshot"
+  const npeers = 3
+  defer cleanpp(tag, npeers)
+  part(t, tag, npeers, []int{}, []int{}, []int{})
+  rfa := makepart(tag, npeers)
+  defer cleanup(rfa)
+  defer part(t, tag, npeers, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: Lagging follower gets the snapshot ...\n")
+
+  part(t, tag, npeers, []int{0,1}, []int{2}, []int{})
+
+  const nseq = 60
+  for seq := 0; seq < nseq; seq++ {
+    rfa[0].Start(seq, seq * 10)
+    waitn(t, rfa[:2], seq, 2)
+  }
+  for i := 0; i < 2; i++ {
+    rfa[i].Snapshot(nseq - 1, []byte("state"))
+    if rfa[i].Min() != nseq {
+      t.Fatalf("Min() is %v after Snapshot(), expected %v", rfa[i].Min(), nseq)
+    }
+  }
+
+  part(t, tag, npeers, []int{0,1,2}, []int{}, []int{})
+  rfa[0].Start(nseq, "x")
+  waitn(t, rfa, nseq, npeers)
+
+  last, state, ok := rfa[2].Restore(0)
+  if !ok || last < nseq - 1 || string(state) != "state" {
+    t.Fatalf("Restore() on the lagging follower = %v %v %v", last, string(state), ok)
+  }
+  if decided, _ := rfa[2].Status(10); decided {
+    t.Fatalf("lagging follower has an entry covered by the snapshot")
+  }
+
+  ch := rfa[2].Decisions()
+  d := <-ch
+  if d.Snapshot == nil || d.Seq < nseq - 1 {
+    t.Fatalf("Decisions() started with %v, not the snapshot", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSubmitRead(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npeers = 3
+  var rfa []*Raft = make([]*Raft, npeers)
+  var rfh []string = make([]string, npeers)
+  defer cleanup(rfa)
+
+  for i := 0; i < npeers; i++ {
+    rfh[i] = port("submit", i)
+  }
+  for i := 0; i < npeers; i++ {
+    rfa[i] = Make(rfh, i, nil)
+  }
+
+  fmt.Printf("Test: Submit() and ReadIndex() ...\n")
+
+  ch := rfa[0].Decisions()
+  const nvals = 30
+  for i := 0; i < npeers; i++ {
+    for j := 0; j < nvals; j++ {
+      rfa[i].Submit(i * 100 + j)
+    }
+  }
+  seen := map[interface{}]bool{}
+  last := -1
+  for len(seen) < npeers * nvals {
+    select {
+    case d := <-ch:
+      if d.Value != nil {
+        seen[d.Value] = true
+      }
+      last = d.Seq
+    case <-time.After(10 * time.Second):
+      t.Fatalf("only %v of %v submitted values decided", len(seen), npeers * nvals)
+    }
+  }
+
+  for i := 0; i < npeers; i++ {
+    seq, ok := rfa[i].ReadIndex()
+    if !ok || seq < last {
+      t.Fatalf("ReadIndex() on %v = %v %v, expected >= %v", i, seq, ok, last)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,426 @@
+package rsm
+
+//
+// a replicated state machine: the part of a service like
+// kvpaxos or shardmaster that gets client operations into
+// the log and applies them in order.
+//
+// rs = rsm.Make(px paxos.Interface, app App, mu sync.Locker, opts ...Option)
+// rs.Submit(client int64, seq int, op interface{}) (interface{}, error) -- apply op, and wait for its result
+// rs.Propose(op interface{}) -- apply op, without a session, and without waiting
+// rs.Read(f func()) bool -- call f once the state is up to date
+//
+// the application gives rsm its log (paxos, raft, or
+// anything else behind paxos.Interface), and its state,
+// behind App. rsm applies the log, batches and all, calls
+// Done() as it goes, and hands paxos a snapshot now and
+// then (see Snapshots()).
+//
+// an op submitted with a client and a sequence number is
+// applied at most once: a client makes one request at a
+// time, numbered from 1, and rsm remembers the last it
+// applied for each client, with its result, for retries.
+// once a client has been idle for sessionIdle, the
+// replicas forget it, all at the same point in the log.
+// a request numbered above 1 from a client with no session
+// can only be a retry from before then, which may have
+// been applied; Submit() refuses it with ErrSessionExpired,
+// and the client should start a new session, under a new
+// id, from 1. client 0 has no session, so its ops, and those given to
+// Propose(), may (rarely) be applied twice; see
+// paxos/batch.go.
+//
+// the results that sessions hold end up in snapshots, so
+// the application has to gob.Register() their types.
+//
+
+import "paxos"
+import "sync"
+import "time"
+import "errors"
+import "bytes"
+import "log"
+import "encoding/gob"
+import "strconv"
+import crand "crypto/rand"
+import "math/big"
+
+//
+// how long Submit() waits for its op to show up in the log
+// before it gives up, and the client retries.
+//
+const submitWait = 2 * time.Second
+
+//
+// a replica proposes to forget the session of a client it
+// has applied nothing from in sessionIdle, and looks for
+// such sessions every expireEvery.
+//
+const sessionIdle = time.Minute
+const expireEvery = time.Second
+
+var ErrTimeout = errors.New("rsm: op not applied in time")
+var ErrKilled = errors.New("rsm: killed")
+var ErrSessionExpired = errors.New("rsm: session expired")
+
+//
+// the application's state: ops, in the order of the log,
+// and snapshots of the result. rsm calls these with the
+// application's lock held.
+//
+type App interface {
+	Apply(op interface{}) interface{}
+	Snapshot() []byte
+	Restore(data []byte)
+}
+
+//
+// what rsm puts in the log: an op, or the expiry of
+// Client's session if the last op rsm applied from Client
+// is still Seq.
+//
+type Request struct {
+	Id     int64 // tells Submit() calls apart
+	Client int64
+	Seq    int
+	Op     interface{}
+	Expire bool
+}
+
+//
+// what the replicas remember of a client: the last of its
+// requests they applied, and the result, for retries. a
+// client waits for each request before it makes the next,
+// so an older request is a retry nobody waits for.
+//
+type session struct {
+	Seq   int
+	Reply interface{}
+}
+
+//
+// what a request refused for want of a session gets, in
+// place of a result.
+//
+type expired struct{}
+
+//
+// what a snapshot holds.
+//
+type state struct {
+	Sessions map[int64]session
+	App      []byte
+}
+
+type RSM struct {
+	mu    sync.Locker // the application's
+	cond  *sync.Cond  // on mu, signalled as seq advances
+	px    paxos.Interface
+	app   App
+	every int // snapshot every this many instances, or never if 0
+	dead  bool
+
+	sessions map[int64]session   // by client
+	touched  map[int64]time.Time // by client, when last applied or proposed to expire
+	seq      int                 // next instance to apply
+	waiters  map[int64]chan interface{}
+	done     chan bool // closed once px is killed
+}
+
+//
+// Option configures an RSM; pass any number of them to
+// Make().
+//
+type Option func(rs *RSM)
+
+//
+// Snapshots hands paxos a snapshot every every instances,
+// so that it can forget the log even if some replica is
+// down.
+//
+func Snapshots(every int) Option {
+	return func(rs *RSM) {
+		rs.every = every
+	}
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := crand.Int(crand.Reader, max)
+	return bigx.Int64()
+}
+
+//
+// get op applied, at most once for this client and seq,
+// and return its result; or ErrTimeout if that takes
+// longer than submitWait, and the client should retry; or
+// ErrSessionExpired.
+//
+func (rs *RSM) Submit(client int64, seq int, op interface{}) (interface{}, error) {
+	id := nrand()
+	ch := make(chan interface{}, 1)
+	rs.mu.Lock()
+	rs.waiters[id] = ch
+	rs.mu.Unlock()
+
+	defer func() {
+		rs.mu.Lock()
+		delete(rs.waiters, id)
+		rs.mu.Unlock()
+	}()
+
+	rs.px.Submit(Request{Id: id, Client: client, Seq: seq, Op: op})
+	select {
+	case r := <-ch:
+		if _, ok := r.(expired); ok {
+			return nil, ErrSessionExpired
+		}
+		return r, nil
+	case <-rs.done:
+		return nil, ErrKilled
+	case <-time.After(submitWait):
+		return nil, ErrTimeout
+	}
+}
+
+//
+// get op applied, with no session, and without waiting.
+//
+func (rs *RSM) Propose(op interface{}) {
+	rs.px.Submit(Request{Op: op})
+}
+
+//
+// wait up to submitWait for this replica to apply the log
+// up to a read index, then call f, with the application's
+// lock held, to read the state. false if paxos cannot
+// vouch for a read index, or if that takes too long; the
+// read should then go through the log.
+//
+func (rs *RSM) Read(f func()) bool {
+	seq, ok := rs.px.ReadIndex()
+	if !ok {
+		return false
+	}
+
+	deadline := time.Now().Add(submitWait)
+	t := time.AfterFunc(submitWait, func() {
+		rs.mu.Lock()
+		rs.cond.Broadcast()
+		rs.mu.Unlock()
+	})
+	defer t.Stop()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for rs.seq <= seq {
+		if rs.dead || !time.Now().Before(deadline) {
+			return false
+		}
+		rs.cond.Wait()
+	}
+	f()
+	return true
+}
+
+//
+// apply decided instances in order, as paxos delivers
+// them, and answer the Submit()s waiting on their ops.
+//
+func (rs *RSM) applier() {
+	for d := range rs.px.Decisions() {
+		rs.mu.Lock()
+		if d.Snapshot != nil {
+			rs.restore(d.Seq, d.Snapshot)
+		} else {
+			switch v := d.Value.(type) {
+			case paxos.Batch:
+				for _, x := range v.Values {
+					rs.apply(x.(Request))
+				}
+			case Request:
+				// raft and epaxos do not batch.
+				rs.apply(v)
+			}
+			rs.seq = d.Seq + 1
+			rs.px.Done(d.Seq)
+			if rs.every > 0 && rs.seq%rs.every == 0 {
+				rs.px.Snapshot(d.Seq, rs.snapshot())
+			}
+		}
+		rs.cond.Broadcast()
+		rs.mu.Unlock()
+	}
+
+	rs.mu.Lock()
+	rs.dead = true
+	close(rs.done)
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+}
+
+func (rs *RSM) apply(req Request) {
+	if req.Expire {
+		// unless the client was heard from in the meantime.
+		if s, ok := rs.sessions[req.Client]; ok && s.Seq == req.Seq {
+			delete(rs.sessions, req.Client)
+			delete(rs.touched, req.Client)
+		}
+		return
+	}
+
+	var r interface{}
+	s, ok := rs.sessions[req.Client]
+	if req.Client == 0 {
+		r = rs.app.Apply(req.Op)
+	} else if !ok && req.Seq > 1 {
+		r = expired{}
+	} else if ok && req.Seq < s.Seq {
+		// nobody waits for it, and the client is not
+		// active because of it.
+		return
+	} else {
+		rs.touched[req.Client] = time.Now()
+		if ok && req.Seq == s.Seq {
+			r = s.Reply
+		} else {
+			r = rs.app.Apply(req.Op)
+			rs.sessions[req.Client] = session{req.Seq, r}
+		}
+	}
+	if ch, ok := rs.waiters[req.Id]; ok {
+		delete(rs.waiters, req.Id)
+		ch <- r
+	}
+}
+
+//
+// propose to forget the sessions of clients this replica
+// has not heard from in sessionIdle. the expiry goes
+// through the log like any request, so that every replica
+// forgets a session at the same point, and none does if
+// the client made a request in the meantime.
+//
+func (rs *RSM) expirer() {
+	for {
+		time.Sleep(expireEvery)
+
+		var reqs []Request
+		rs.mu.Lock()
+		if rs.dead {
+			rs.mu.Unlock()
+			return
+		}
+		for c, s := range rs.sessions {
+			if time.Since(rs.touched[c]) > sessionIdle {
+				reqs = append(reqs, Request{Client: c, Seq: s.Seq, Expire: true})
+				rs.touched[c] = time.Now()
+			}
+		}
+		rs.mu.Unlock()
+		for _, req := range reqs {
+			rs.px.Submit(req)
+		}
+	}
+}
+
+//
+// how many clients this replica holds sessions for; for
+// tests of the applications.
+//
+func (rs *RSM) Sessions() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.sessions)
+}
+
+//
+// make every session look as if its client has been idle
+// for longer than sessionIdle, so that the replica expires
+// them now; for tests of the applications.
+//
+func (rs *RSM) Idle() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for c := range rs.touched {
+		rs.touched[c] = time.Now().Add(-2 * sessionIdle)
+	}
+}
+
+func (rs *RSM) snapshot() []byte {
+	var b bytes.Buffer
+	st := state{rs.sessions, rs.app.Snapshot()}
+	if err := gob.NewEncoder(&b).Encode(st); err != nil {
+		log.Fatal("rsm snapshot: ", err)
+	}
+	return b.Bytes()
+}
+
+func (rs *RSM) restore(last int, data []byte) {
+	var st state
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		log.Fatal("rsm restore: ", err)
+	}
+	// gob leaves out empty maps.
+	if st.Sessions == nil {
+		st.Sessions = make(map[int64]session)
+	}
+	rs.sessions = st.Sessions
+	rs.touched = make(map[int64]time.Time)
+	for c := range rs.sessions {
+		rs.touched[c] = time.Now()
+	}
+	rs.app.Restore(st.App)
+	rs.seq = last + 1
+}
+
+//
+// the keys of a Request, for epaxos, given keys() for the
+// application's ops: requests from the same client
+// interfere, so that every replica applies them in the
+// order the client made them, and agrees on which are
+// retries.
+//
+func Keys(keys func(op interface{}) []string) func(interface{}) []string {
+	return func(v interface{}) []string {
+		req := v.(Request)
+		var ks []string
+		if req.Client != 0 {
+			ks = append(ks, "client "+strconv.FormatInt(req.Client, 10))
+		}
+		if !req.Expire {
+			ks = append(ks, keys(req.Op)...)
+		}
+		return ks
+	}
+}
+
+//
+// registered now rather than in Make(), since px is made
+// first, and a paxos peer with a DataDir reads Requests
+// back from its log as it starts.
+//
+func init() {
+	gob.Register(Request{})
+}
+
+//
+// start applying px's log to app. mu is the application's
+// lock, which rsm holds while it calls app.
+//
+func Make(px paxos.Interface, app App, mu sync.Locker, opts ...Option) *RSM {
+	rs := &RSM{px: px, app: app, mu: mu}
+	for _, opt := range opts {
+		opt(rs)
+	}
+	rs.cond = sync.NewCond(mu)
+	rs.sessions = make(map[int64]session)
+	rs.touched = make(map[int64]time.Time)
+	rs.waiters = make(map[int64]chan interface{})
+	rs.done = make(chan bool)
+
+	go rs.applier()
+	go rs.expirer()
+	return rs
+}
@@ -0,0 +1,326 @@
+package rsm
+
+import "testing"
+import "runtime"
+import "strconv"
+import "os"
+import "time"
+import "fmt"
+import "sync"
+import "bytes"
+import "reflect"
+import "encoding/gob"
+import "paxos"
+
+func port(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "rsm-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+//
+// an application that remembers every op it applies, in
+// order, and answers each with how many it has applied.
+//
+type list struct {
+  mu  sync.Mutex
+  ops []string
+}
+
+func (l *list) Apply(op interface{}) interface{} {
+  l.ops = append(l.ops, op.(string))
+  return len(l.ops)
+}
+
+func (l *list) Snapshot() []byte {
+  var b bytes.Buffer
+  gob.NewEncoder(&b).Encode(l.ops)
+  return b.Bytes()
+}
+
+func (l *list) Restore(data []byte) {
+  l.ops = nil
+  gob.NewDecoder(bytes.NewReader(data)).Decode(&l.ops)
+}
+
+func (l *list) get() []string {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return append([]string{}, l.ops...)
+}
+
+type replica struct {
+  px  *paxos.Paxos
+  app *list
+  rs  *RSM
+}
+
+func start(peers []string, me int, opts ...Option) *replica {
+  r := &replica{}
+  r.px = paxos.Make(peers, me, nil)
+  r.app = &list{}
+  r.rs = Make(r.px, r.app, &r.app.mu, opts...)
+  return r
+}
+
+func cleanup(ra []*replica) {
+  for i := 0; i < len(ra); i++ {
+    if ra[i] != nil {
+      ra[i].px.Kill()
+    }
+  }
+}
+
+//
+// wait for every replica to have applied the same ops,
+// and return them.
+//
+func agree(t *testing.T, ra []*replica) []string {
+  for iters := 0; ; iters++ {
+    ops := ra[0].app.get()
+    same := true
+    for i := 1; i < len(ra); i++ {
+      same = same && reflect.DeepEqual(ops, ra[i].app.get())
+    }
+    if same {
+      return ops
+    }
+    if iters == 50 {
+      t.Fatalf("replicas applied different ops")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
+
+func submit(t *testing.T, r *replica, client int64, seq int, op string) int {
+  v, err := r.rs.Submit(client, seq, op)
+  if err != nil {
+    t.Fatalf("Submit(%v, %v, %v): %v", client, seq, op, err)
+  }
+  return v.(int)
+}
+
+func TestBasic(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var ra []*replica = make([]*replica, nservers)
+  var peers []string = make([]string, nservers)
+  defer cleanup(ra)
+
+  for i := 0; i < nservers; i++ {
+    peers[i] = port("basic", i)
+  }
+  for i := 0; i < nservers; i++ {
+    ra[i] = start(peers, i)
+  }
+
+  fmt.Printf("Test: Submit applies ops in the same order everywhere ...\n")
+
+  for i := 0; i < 10; i++ {
+    if n := submit(t, ra[i%nservers], 1, i+1, "x"+strconv.Itoa(i)); n != i+1 {
+      t.Fatalf("op %v applied as number %v", i, n)
+    }
+  }
+  ops := agree(t, ra)
+  for i := 0; i < 10; i++ {
+    if ops[i] != "x"+strconv.Itoa(i) {
+      t.Fatalf("ops applied out of order: %v", ops)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent clients ...\n")
+
+  const nclients = 5
+  var wg sync.WaitGroup
+  for c := 0; c < nclients; c++ {
+    wg.Add(1)
+    go func(c int) {
+      defer wg.Done()
+      for seq := 1; seq <= 10; seq++ {
+        op := "c" + strconv.Itoa(c) + " " + strconv.Itoa(seq)
+        for {
+          if _, err := ra[(c+seq)%nservers].rs.Submit(int64(c+10), seq, op); err == nil {
+            break
+          }
+        }
+      }
+    }(c)
+  }
+  wg.Wait()
+  ops = agree(t, ra)
+  if len(ops) != 10+nclients*10 {
+    t.Fatalf("applied %v ops, expected %v", len(ops), 10+nclients*10)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Propose and Read ...\n")
+
+  ra[0].rs.Propose("p")
+  for iters := 0; ; iters++ {
+    var last string
+    if !ra[1].rs.Read(func() {
+      last = ra[1].app.ops[len(ra[1].app.ops)-1]
+    }) {
+      t.Fatalf("Read failed with all replicas up")
+    }
+    if last == "p" {
+      break
+    }
+    if iters == 50 {
+      t.Fatalf("Proposed op was not applied")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  // a Read sees every op applied anywhere before it began.
+  n := submit(t, ra[0], 1, 11, "y")
+  var seen int
+  ra[2].rs.Read(func() {
+    seen = len(ra[2].app.ops)
+  })
+  if seen < n {
+    t.Fatalf("Read saw %v ops, expected at least %v", seen, n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestAtMostOnce(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var ra []*replica = make([]*replica, nservers)
+  var peers []string = make([]string, nservers)
+  defer cleanup(ra)
+
+  for i := 0; i < nservers; i++ {
+    peers[i] = port("once", i)
+  }
+  for i := 0; i < nservers; i++ {
+    ra[i] = start(peers, i)
+  }
+
+  fmt.Printf("Test: Retries are applied once ...\n")
+
+  n1 := submit(t, ra[0], 5, 1, "a")
+  n2 := submit(t, ra[1], 5, 1, "a")
+  if n1 != n2 {
+    t.Fatalf("retry answered %v, first attempt %v", n2, n1)
+  }
+  submit(t, ra[2], 5, 2, "b")
+  // a retry of an older request is not applied, or
+  // answered: the client has moved on.
+  if _, err := ra[0].rs.Submit(5, 1, "a"); err != ErrTimeout {
+    t.Fatalf("stale retry returned %v, expected ErrTimeout", err)
+  }
+  if ops := agree(t, ra); !reflect.DeepEqual(ops, []string{"a", "b"}) {
+    t.Fatalf("applied %v, expected [a b]", ops)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Idle sessions are forgotten ...\n")
+
+  for i := 0; i < nservers; i++ {
+    ra[i].app.mu.Lock()
+    ra[i].rs.touched[5] = time.Now().Add(-2 * sessionIdle)
+    ra[i].app.mu.Unlock()
+  }
+  forgotten := false
+  for iters := 0; iters < 50 && !forgotten; iters++ {
+    time.Sleep(100 * time.Millisecond)
+    forgotten = true
+    for i := 0; i < nservers; i++ {
+      ra[i].app.mu.Lock()
+      if len(ra[i].rs.sessions) != 0 {
+        forgotten = false
+      }
+      ra[i].app.mu.Unlock()
+    }
+  }
+  if !forgotten {
+    t.Fatalf("idle sessions were not forgotten")
+  }
+  // a retry from before then is refused, not applied again,
+  // and does not bring the session back.
+  if _, err := ra[2].rs.Submit(5, 2, "b"); err != ErrSessionExpired {
+    t.Fatalf("retry after expiry returned %v, expected ErrSessionExpired", err)
+  }
+  if _, err := ra[0].rs.Submit(5, 3, "c"); err != ErrSessionExpired {
+    t.Fatalf("next request after expiry returned %v, expected ErrSessionExpired", err)
+  }
+  if n := ra[2].rs.Sessions(); n != 0 {
+    t.Fatalf("%v sessions after refused retries", n)
+  }
+  // a forgotten client starts afresh, under a new id.
+  submit(t, ra[1], 6, 1, "c")
+  if ops := agree(t, ra); !reflect.DeepEqual(ops, []string{"a", "b", "c"}) {
+    t.Fatalf("applied %v, expected [a b c]", ops)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Late replica catches up from a snapshot ...\n")
+
+  const nservers = 3
+  const every = 10
+  var ra []*replica = make([]*replica, nservers)
+  var peers []string = make([]string, nservers)
+  defer cleanup(ra)
+
+  for i := 0; i < nservers; i++ {
+    peers[i] = port("snapshot", i)
+  }
+  for i := 0; i < nservers-1; i++ {
+    ra[i] = start(peers, i, Snapshots(every))
+  }
+
+  const nops = every * 5
+  for i := 0; i < nops; i++ {
+    submit(t, ra[i%2], 1, i+1, strconv.Itoa(i))
+  }
+  if ra[0].px.Min() == 0 || ra[1].px.Min() == 0 {
+    t.Fatalf("paxos log was not compacted")
+  }
+
+  ra[2] = start(peers, 2, Snapshots(every))
+  var n int
+  for iters := 0; ; iters++ {
+    v, err := ra[2].rs.Submit(1, nops+1, "last")
+    if err == nil {
+      n = v.(int)
+      break
+    }
+    if iters == 10 {
+      t.Fatalf("late replica never applied an op: %v", err)
+    }
+  }
+  if n != nops+1 {
+    t.Fatalf("late replica answered %v, expected %v", n, nops+1)
+  }
+  ops := agree(t, ra)
+  for i := 0; i < nops; i++ {
+    if ops[i] != strconv.Itoa(i) {
+      t.Fatalf("late replica restored %v", ops)
+    }
+  }
+
+  // the session came with the snapshot.
+  if _, err := ra[2].rs.Submit(1, nops, "again"); err != ErrTimeout {
+    t.Fatalf("stale retry returned %v, expected ErrTimeout", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
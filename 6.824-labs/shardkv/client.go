@@ -1,7 +1,7 @@
 package shardkv
 
 import "shardmaster"
-import "net/rpc"
+import "transport"
 import "time"
 import "sync"
 // import "fmt"
@@ -39,7 +39,7 @@ func MakeClerk(shardmasters []string) *Clerk {
 //
 func call(srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
+  c, errx := transport.Dial(srv)
   if errx != nil {
     return false
   }
@@ -72,57 +72,65 @@ func key2shard(key string) int {
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
-  ck.mu.Lock()
-  defer ck.mu.Unlock()
+  for {
+    value, err := ck.TryGet(key)
+    if err != ErrWrongGroup {
+      return value
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
 
+func (ck *Clerk) Put(key string, value string) {
+  for ck.TryPut(key, value) == ErrWrongGroup {
+    time.Sleep(100 * time.Millisecond)
+  }
+}
 
-  // You'll have to modify Get().
+//
+// like Get, but says ErrNoKey if the key has no value, and
+// gives up with ErrWrongGroup if the latest configuration
+// has no group for the key's shard.
+//
+func (ck *Clerk) TryGet(key string) (string, Err) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
 
   for {
     shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
-
-    servers, ok := ck.config.Groups[gid]
-
+    servers, ok := ck.config.Groups[ck.config.Shards[shard]]
     if ok {
-      // try each server in the shard's replication group.
       for _, srv := range servers {
         args := &GetArgs{}
         args.Key = key
         var reply GetReply
         ok := call(srv, "ShardKV.Get", args, &reply)
         if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-          return reply.Value
+          return reply.Value, reply.Err
         }
       }
+      time.Sleep(100 * time.Millisecond)
     }
 
-    time.Sleep(100 * time.Millisecond)
-
-    // ask master for a new configuration.
     ck.config = ck.sm.Query(-1)
+    if _, ok := ck.config.Groups[ck.config.Shards[shard]]; !ok {
+      return "", ErrWrongGroup
+    }
   }
-  return ""
 }
 
-func (ck *Clerk) Put(key string, value string) {
+//
+// like Put, but gives up with ErrWrongGroup if the latest
+// configuration has no group for the key's shard.
+//
+func (ck *Clerk) TryPut(key string, value string) Err {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
-
-  // You'll have to modify Put().
-
   for {
     shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
-
-    servers, ok := ck.config.Groups[gid]
-
-
+    servers, ok := ck.config.Groups[ck.config.Shards[shard]]
     if ok {
-      // try each server in the shard's replication group.
       for _, srv := range servers {
         args := &PutArgs{}
         args.Key = key
@@ -130,14 +138,15 @@ func (ck *Clerk) Put(key string, value string) {
         var reply PutReply
         ok := call(srv, "ShardKV.Put", args, &reply)
         if ok && reply.Err == OK {
-          return
+          return OK
         }
       }
+      time.Sleep(100 * time.Millisecond)
     }
 
-    time.Sleep(100 * time.Millisecond)
-
-    // ask master for a new configuration.
     ck.config = ck.sm.Query(-1)
+    if _, ok := ck.config.Groups[ck.config.Shards[shard]]; !ok {
+      return ErrWrongGroup
+    }
   }
 }
@@ -3,12 +3,12 @@ package shardkv
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
 import "log"
 import "time"
 import "paxos"
+import "raft"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "shardmaster"
@@ -25,7 +25,9 @@ type ShardKV struct {
   dead bool // for testing
   unreliable bool // for testing
   sm *shardmaster.Clerk
-  px *paxos.Paxos
+  px paxos.Interface
+  useRaft bool // see Raft()
+  dir string // see DataDir()
 
   gid int64 // my replica group ID
 
@@ -46,6 +48,15 @@ func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
   return nil
 }
 
+//
+// how far this replica's log reaches; see kvctl.
+//
+func (kv *ShardKV) Status(args *paxos.StatusArgs, reply *paxos.StatusReply) error {
+  reply.Min = kv.px.Min()
+  reply.Max = kv.px.Max()
+  return nil
+}
+
 //
 // Ask the shardmaster if there's a new configuration;
 // if so, re-configure.
@@ -61,6 +72,34 @@ func (kv *ShardKV) kill() {
   kv.px.Kill()
 }
 
+//
+// Option configures a shardkv server; pass any number of
+// them to StartServer().
+//
+type Option func(kv *ShardKV)
+
+//
+// Raft makes the servers of a replica group agree on their
+// log with raft instead of paxos. every server in the
+// group has to be given the same option.
+//
+func Raft() Option {
+  return func(kv *ShardKV) {
+    kv.useRaft = true
+  }
+}
+
+//
+// DataDir keeps the server's paxos log in dir, so it can
+// crash and be started again with the same dir. raft keeps
+// nothing on disk, and ignores it.
+//
+func DataDir(dir string) Option {
+  return func(kv *ShardKV) {
+    kv.dir = dir
+  }
+}
+
 //
 // Start a shardkv server.
 // gid is the ID of the server's replica group.
@@ -71,12 +110,15 @@ func (kv *ShardKV) kill() {
 // me is the index of this server in servers[].
 //
 func StartServer(gid int64, shardmasters []string,
-                 servers []string, me int) *ShardKV {
+                 servers []string, me int, opts ...Option) *ShardKV {
   gob.Register(Op{})
 
   kv := new(ShardKV)
   kv.me = me
   kv.gid = gid
+  for _, opt := range opts {
+    opt(kv)
+  }
   kv.sm = shardmaster.MakeClerk(shardmasters)
 
   // Your initialization code here.
@@ -85,10 +127,15 @@ func StartServer(gid int64, shardmasters []string,
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  if kv.useRaft {
+    kv.px = raft.Make(servers, me, rpcs)
+  } else if kv.dir != "" {
+    kv.px = paxos.Make(servers, me, rpcs, paxos.DataDir(kv.dir))
+  } else {
+    kv.px = paxos.Make(servers, me, rpcs)
+  }
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := transport.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -106,12 +153,7 @@ func StartServer(gid int64, shardmasters []string,
           conn.Close()
         } else if kv.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
+          conn = transport.DiscardReply(conn)
           go rpcs.ServeConn(conn)
         } else {
           go rpcs.ServeConn(conn)
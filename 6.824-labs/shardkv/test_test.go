@@ -9,6 +9,28 @@ import "time"
 import "fmt"
 import "sync"
 import "math/rand"
+import "linearizability"
+
+//
+// StartServer() options for the run in progress, for the
+// replica groups and for the shardmasters.
+//
+var opts []Option
+var smopts []shardmaster.Option
+
+//
+// run every test on paxos, then again on raft.
+//
+func TestMain(m *testing.M) {
+  code := m.Run()
+  if code == 0 {
+    fmt.Printf("Running the tests again on raft ...\n")
+    opts = []Option{Raft()}
+    smopts = []shardmaster.Option{shardmaster.Raft()}
+    code = m.Run()
+  }
+  os.Exit(code)
+}
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -48,7 +70,7 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
     smh[i] = port(tag+"m", i)
   }
   for i := 0; i < nmasters; i++ {
-    sma[i] = shardmaster.StartServer(smh, i)
+    sma[i] = shardmaster.StartServer(smh, i, smopts...)
   }
 
   const ngroups = 3   // replica groups
@@ -65,7 +87,7 @@ func setup(tag string, unreliable bool) ([]string, []int64, [][]string, [][]*Sha
       ha[i][j] = port(tag+"s", (i*nreplicas)+j)
     }
     for j := 0; j < nreplicas; j++ {
-      sa[i][j] = StartServer(gids[i], smh, ha[i], j)
+      sa[i][j] = StartServer(gids[i], smh, ha[i], j, opts...)
       sa[i][j].unreliable = unreliable
     }
   }
@@ -262,6 +284,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
     mck.Join(gids[i], ha[i])
   }
 
+  h := linearizability.MakeHistory()
   const npara = 11
   var ca [npara]chan bool
   for i := 0; i < npara; i++ {
@@ -269,7 +292,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
     go func(me int) {
       ok := true
       defer func() { ca[me] <- ok }()
-      ck := MakeClerk(smh)
+      ck := h.Client(MakeClerk(smh))
       mymck := shardmaster.MakeClerk(smh)
       key := strconv.Itoa(me)
       last := ""
@@ -296,6 +319,9 @@ func doConcurrent(t *testing.T, unreliable bool) {
       t.Fatalf("something is wrong")
     }
   }
+  if err := h.Check(); err != nil {
+    t.Fatalf("%v", err)
+  }
 }
 
 func TestConcurrent(t *testing.T) {
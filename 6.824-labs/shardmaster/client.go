@@ -5,19 +5,43 @@ package shardmaster
 // Please don't change this file.
 //
 
-import "net/rpc"
+import "transport"
 import "time"
+import "sync"
+import "crypto/rand"
+import "math/big"
 
 type Clerk struct {
+  mu sync.Mutex // one request at a time
   servers []string // shardmaster replicas
+  id int64 // the servers know this clerk's requests by it
+  seq int // Joins, Leaves and Moves made so far
 }
 
 func MakeClerk(servers []string) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
+  ck.id = nrand()
   return ck
 }
 
+//
+// the servers have forgotten this clerk's session; start a
+// new one, and make the request again. see renew() in
+// kvpaxos/client.go.
+//
+func (ck *Clerk) renew() {
+  ck.id = nrand()
+  ck.seq = 1
+}
+
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  x := bigx.Int64()
+  return x
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -36,7 +60,7 @@ func MakeClerk(servers []string) *Clerk {
 //
 func call(srv string, rpcname string,
           args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
+  c, errx := transport.Dial(srv)
   if errx != nil {
     return false
   }
@@ -67,15 +91,23 @@ func (ck *Clerk) Query(num int) Config {
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+
+  ck.seq++
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &JoinArgs{}
       args.GID = gid
       args.Servers = servers
+      args.Client = ck.id
+      args.Seq = ck.seq
       var reply JoinReply
       ok := call(srv, "ShardMaster.Join", args, &reply)
-      if ok {
+      if ok && reply.Err == ErrSessionExpired {
+        ck.renew()
+      } else if ok {
         return
       }
     }
@@ -84,14 +116,22 @@ func (ck *Clerk) Join(gid int64, servers []string) {
 }
 
 func (ck *Clerk) Leave(gid int64) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+
+  ck.seq++
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &LeaveArgs{}
       args.GID = gid
+      args.Client = ck.id
+      args.Seq = ck.seq
       var reply LeaveReply
       ok := call(srv, "ShardMaster.Leave", args, &reply)
-      if ok {
+      if ok && reply.Err == ErrSessionExpired {
+        ck.renew()
+      } else if ok {
         return
       }
     }
@@ -100,15 +140,23 @@ func (ck *Clerk) Leave(gid int64) {
 }
 
 func (ck *Clerk) Move(shard int, gid int64) {
+  ck.mu.Lock()
+  defer ck.mu.Unlock()
+
+  ck.seq++
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &MoveArgs{}
       args.Shard = shard
       args.GID = gid
-      var reply LeaveReply
+      args.Client = ck.id
+      args.Seq = ck.seq
+      var reply MoveReply
       ok := call(srv, "ShardMaster.Move", args, &reply)
-      if ok {
+      if ok && reply.Err == ErrSessionExpired {
+        ck.renew()
+      } else if ok {
         return
       }
     }
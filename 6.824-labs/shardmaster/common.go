@@ -7,6 +7,8 @@ package shardmaster
 // Join(gid, servers) -- replica group gid is joining, give it some shards.
 // Leave(gid) -- replica group gid is retiring, hand off all its shards.
 // Move(shard, gid) -- hand off one shard from current owner to gid.
+//   a Move to a shard out of range, or to a gid that has not
+//   joined, is ignored.
 // Query(num) -> fetch Config # num, or latest config if num==-1.
 //
 // A Config (configuration) describes a set of replica groups, and the
@@ -17,11 +19,23 @@ package shardmaster
 // A GID is a replica group ID. GIDs must be uniqe and > 0.
 // Once a GID joins, and leaves, it should never join again.
 //
+// Join, Leave and Move carry the clerk's id and the number
+// of the request, so that a retry is applied at most once.
+// once the servers have forgotten an idle clerk, they
+// refuse its requests with ErrSessionExpired.
+//
 // Please don't change this file.
 //
 
 const NShards = 10
 
+const (
+  OK = "OK"
+  ErrSessionExpired = "ErrSessionExpired"
+)
+
+type Err string
+
 type Config struct {
   Num int // config number
   Shards [NShards]int64 // gid
@@ -31,24 +45,33 @@ type Config struct {
 type JoinArgs struct {
   GID int64       // unique replica group ID
   Servers []string // group server ports
+  Client int64
+  Seq int
 }
 
 type JoinReply struct {
+  Err Err
 }
 
 type LeaveArgs struct {
   GID int64
+  Client int64
+  Seq int
 }
 
 type LeaveReply struct {
+  Err Err
 }
 
 type MoveArgs struct {
   Shard int
   GID int64
+  Client int64
+  Seq int
 }
 
 type MoveReply struct {
+  Err Err
 }
 
 type QueryArgs struct {
@@ -3,13 +3,22 @@ package shardmaster
 import "net"
 import "fmt"
 import "net/rpc"
+import "transport"
 import "log"
 import "paxos"
+import "rsm"
+import "raft"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "bytes"
+import "sort"
+
+//
+// hand paxos a snapshot of the configurations every
+// snapshotEvery instances.
+//
+const snapshotEvery = 100
 
 type ShardMaster struct {
   mu sync.Mutex
@@ -17,41 +26,282 @@ type ShardMaster struct {
   me int
   dead bool // for testing
   unreliable bool // for testing
-  px *paxos.Paxos
+  px paxos.Interface
+  rs *rsm.RSM
+  useRaft bool // see Raft()
+  dir string // see DataDir()
 
   configs []Config // indexed by config num
+  pins map[int]int64 // shard -> gid, by Move, until the group leaves
 }
 
+const (
+  Join = "Join"
+  Leave = "Leave"
+  Move = "Move"
+  Query = "Query"
+)
 
 type Op struct {
-  // Your data here.
+  Kind string
+  GID int64
+  Servers []string
+  Shard int
+  Num int // for a Query
 }
 
-
+//
+// Join, Leave and Move go through the clerk's session, so
+// that a late retry, say of a Join after the Leave that
+// followed it, is not applied again. an expired session is
+// for the clerk to deal with; any other error fails the
+// RPC, and the clerk retries.
+//
 func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
-  // Your code here.
-
-  return nil
+  _, err := sm.rs.Submit(args.Client, args.Seq, Op{Kind: Join, GID: args.GID, Servers: args.Servers})
+  reply.Err, err = outcome(err)
+  return err
 }
 
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
-  // Your code here.
-
-  return nil
+  _, err := sm.rs.Submit(args.Client, args.Seq, Op{Kind: Leave, GID: args.GID})
+  reply.Err, err = outcome(err)
+  return err
 }
 
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
-  // Your code here.
+  _, err := sm.rs.Submit(args.Client, args.Seq, Op{Kind: Move, GID: args.GID, Shard: args.Shard})
+  reply.Err, err = outcome(err)
+  return err
+}
 
-  return nil
+func outcome(err error) (Err, error) {
+  if err == rsm.ErrSessionExpired {
+    return ErrSessionExpired, nil
+  }
+  return OK, err
 }
 
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
-  // Your code here.
+  // through the log, so that the answer is never stale. a
+  // Query changes nothing, so it needs no session.
+  c, err := sm.rs.Submit(0, 0, Op{Kind: Query, Num: args.Num})
+  if err != nil {
+    return err
+  }
+  reply.Config = c.(Config)
+  return nil
+}
+
+//
+// how far this replica's log reaches; see kvctl.
+//
+func (sm *ShardMaster) Status(args *paxos.StatusArgs, reply *paxos.StatusReply) error {
+  reply.Min = sm.px.Min()
+  reply.Max = sm.px.Max()
+  return nil
+}
+
+//
+// the configurations, as rsm applies ops to them, with
+// sm.mu held.
+//
+type machine struct {
+  sm *ShardMaster
+}
 
+func (m machine) Apply(v interface{}) interface{} {
+  sm := m.sm
+  op := v.(Op)
+  if op.Kind == Query {
+    if op.Num < 0 || op.Num >= len(sm.configs) {
+      return sm.configs[len(sm.configs) - 1]
+    }
+    return sm.configs[op.Num]
+  }
+  if op.Kind == Move && !sm.movable(op.Shard, op.GID) {
+    return nil
+  }
+
+  c := sm.next()
+  switch op.Kind {
+  case Join:
+    c.Groups[op.GID] = op.Servers
+    rebalance(&c, sm.pins)
+  case Leave:
+    delete(c.Groups, op.GID)
+    for shard, gid := range sm.pins {
+      if gid == op.GID {
+        delete(sm.pins, shard)
+      }
+    }
+    rebalance(&c, sm.pins)
+  case Move:
+    c.Shards[op.Shard] = op.GID
+    sm.pins[op.Shard] = op.GID
+  }
+  sm.configs = append(sm.configs, c)
   return nil
 }
 
+func (m machine) Snapshot() []byte {
+  return m.sm.snapshot()
+}
+
+func (m machine) Restore(data []byte) {
+  m.sm.restore(data)
+}
+
+//
+// whether shard can be moved to gid: a Move to a shard
+// that does not exist, or to a group that has not joined
+// (or has left), is ignored, and makes no new config.
+//
+func (sm *ShardMaster) movable(shard int, gid int64) bool {
+  _, ok := sm.configs[len(sm.configs) - 1].Groups[gid]
+  return ok && shard >= 0 && shard < NShards
+}
+
+//
+// a copy of the latest configuration, numbered one higher.
+//
+func (sm *ShardMaster) next() Config {
+  old := sm.configs[len(sm.configs) - 1]
+  c := Config{Num: old.Num + 1, Shards: old.Shards}
+  c.Groups = map[int64][]string{}
+  for gid, servers := range old.Groups {
+    c.Groups[gid] = servers
+  }
+  return c
+}
+
+//
+// spread the shards evenly over the groups in c, moving
+// as few as possible, and leaving each shard in pins with
+// its group. every replica must come up with the same
+// answer, so never depend on map order.
+//
+// pins can make an even spread impossible: a group keeps
+// the shards pinned to it however many there are, and the
+// others share the rest as evenly as they can. so the
+// groups fill up to a common level, those with more pins
+// than that stay where they are, and the few shards left
+// over go one each to groups at the level, those that hold
+// the most shards already first.
+//
+func rebalance(c *Config, pins map[int]int64) {
+  if len(c.Groups) == 0 {
+    for i := range c.Shards {
+      c.Shards[i] = 0
+    }
+    return
+  }
+
+  gids := make([]int64, 0, len(c.Groups))
+  for gid := range c.Groups {
+    gids = append(gids, gid)
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+  pinned := map[int64]int{}
+  owned := map[int64][]int{} // the unpinned shards each group holds
+  var free []int
+  for i, gid := range c.Shards {
+    p, pin := pins[i]
+    if _, ok := c.Groups[p]; pin && ok {
+      c.Shards[i] = p
+      pinned[p]++
+    } else if _, ok := c.Groups[gid]; ok {
+      owned[gid] = append(owned[gid], i)
+    } else {
+      free = append(free, i)
+    }
+  }
+
+  // how many shards the groups hold if they fill up to
+  // level.
+  fill := func(level int) int {
+    n := 0
+    for _, gid := range gids {
+      if pinned[gid] > level {
+        n += pinned[gid]
+      } else {
+        n += level
+      }
+    }
+    return n
+  }
+  level := 0
+  for level < NShards && fill(level + 1) <= NShards {
+    level++
+  }
+
+  want := map[int64]int{}
+  var at []int64 // the groups at the level, which may take one more
+  for _, gid := range gids {
+    if pinned[gid] > level {
+      want[gid] = pinned[gid]
+    } else {
+      want[gid] = level
+      at = append(at, gid)
+    }
+  }
+  sort.SliceStable(at, func(i, j int) bool {
+    return len(owned[at[i]]) + pinned[at[i]] > len(owned[at[j]]) + pinned[at[j]]
+  })
+  for _, gid := range at[:NShards - fill(level)] {
+    want[gid]++
+  }
+
+  for _, gid := range gids {
+    if keep := want[gid] - pinned[gid]; len(owned[gid]) > keep {
+      free = append(free, owned[gid][keep:]...)
+      owned[gid] = owned[gid][:keep]
+    }
+  }
+  sort.Ints(free)
+  for _, gid := range gids {
+    for n := len(owned[gid]) + pinned[gid]; n < want[gid]; n++ {
+      c.Shards[free[0]] = gid
+      free = free[1:]
+    }
+  }
+}
+
+//
+// what a snapshot holds.
+//
+type state struct {
+  Configs []Config
+  Pins map[int]int64
+}
+
+func (sm *ShardMaster) snapshot() []byte {
+  var b bytes.Buffer
+  if err := gob.NewEncoder(&b).Encode(state{sm.configs, sm.pins}); err != nil {
+    log.Fatal("shardmaster snapshot: ", err)
+  }
+  return b.Bytes()
+}
+
+func (sm *ShardMaster) restore(data []byte) {
+  var st state
+  if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+    log.Fatal("shardmaster restore: ", err)
+  }
+  // gob leaves out empty maps.
+  for i := range st.Configs {
+    if st.Configs[i].Groups == nil {
+      st.Configs[i].Groups = map[int64][]string{}
+    }
+  }
+  if st.Pins == nil {
+    st.Pins = map[int]int64{}
+  }
+  sm.configs = st.Configs
+  sm.pins = st.Pins
+}
+
 // please don't change this function.
 func (sm *ShardMaster) Kill() {
   sm.dead = true
@@ -59,28 +309,66 @@ func (sm *ShardMaster) Kill() {
   sm.px.Kill()
 }
 
+//
+// Option configures a shardmaster server; pass any number
+// of them to StartServer().
+//
+type Option func(sm *ShardMaster)
+
+//
+// Raft makes the servers agree on their log with raft
+// instead of paxos. every server has to be given the
+// same option.
+//
+func Raft() Option {
+  return func(sm *ShardMaster) {
+    sm.useRaft = true
+  }
+}
+
+//
+// DataDir keeps the server's paxos log in dir, so it can
+// crash and be started again with the same dir. raft keeps
+// nothing on disk, and ignores it.
+//
+func DataDir(dir string) Option {
+  return func(sm *ShardMaster) {
+    sm.dir = dir
+  }
+}
+
 //
 // servers[] contains the ports of the set of
 // servers that will cooperate via Paxos to
 // form the fault-tolerant shardmaster service.
 // me is the index of the current server in servers[].
 // 
-func StartServer(servers []string, me int) *ShardMaster {
+func StartServer(servers []string, me int, opts ...Option) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
   sm.me = me
+  for _, opt := range opts {
+    opt(sm)
+  }
 
   sm.configs = make([]Config, 1)
   sm.configs[0].Groups = map[int64][]string{}
+  sm.pins = map[int]int64{}
 
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
 
-  sm.px = paxos.Make(servers, me, rpcs)
+  if sm.useRaft {
+    sm.px = raft.Make(servers, me, rpcs)
+  } else if sm.dir != "" {
+    sm.px = paxos.Make(servers, me, rpcs, paxos.DataDir(sm.dir))
+  } else {
+    sm.px = paxos.Make(servers, me, rpcs)
+  }
+  sm.rs = rsm.Make(sm.px, machine{sm}, &sm.mu, rsm.Snapshots(snapshotEvery))
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := transport.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -98,12 +386,7 @@ func StartServer(servers []string, me int) *ShardMaster {
           conn.Close()
         } else if sm.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-          if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
-          }
+          conn = transport.DiscardReply(conn)
           go rpcs.ServeConn(conn)
         } else {
           go rpcs.ServeConn(conn)
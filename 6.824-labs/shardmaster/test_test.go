@@ -4,9 +4,10 @@ import "testing"
 import "runtime"
 import "strconv"
 import "os"
-// import "time"
+import "time"
 import "fmt"
 import "math/rand"
+import "reflect"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -19,6 +20,24 @@ func port(tag string, host int) string {
   return s
 }
 
+//
+// StartServer() options for the run in progress.
+//
+var opts []Option
+
+//
+// run every test on paxos, then again on raft.
+//
+func TestMain(m *testing.M) {
+  code := m.Run()
+  if code == 0 {
+    fmt.Printf("Running the tests again on raft ...\n")
+    opts = []Option{Raft()}
+    code = m.Run()
+  }
+  os.Exit(code)
+}
+
 func cleanup(sma []*ShardMaster) {
   for i := 0; i < len(sma); i++ {
     if sma[i] != nil {
@@ -87,7 +106,7 @@ func TestBasic(t *testing.T) {
     kvh[i] = port("basic", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, opts...)
   }
 
   ck := MakeClerk(kvh)
@@ -285,7 +304,7 @@ func TestUnreliable(t *testing.T) {
     kvh[i] = port("unrel", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, opts...)
     // don't turn on unreliable because the assignment
     // doesn't require the shardmaster to detect duplicate
     // client requests.
@@ -336,7 +355,7 @@ func TestFreshQuery(t *testing.T) {
     kvh[i] = port("fresh", i)
   }
   for i := 0; i < nservers; i++ {
-    sma[i] = StartServer(kvh, i)
+    sma[i] = StartServer(kvh, i, opts...)
   }
 
   ck1 := MakeClerk([]string{kvh[1]})
@@ -359,3 +378,383 @@ func TestFreshQuery(t *testing.T) {
   fmt.Printf("  ... Passed\n")
   os.Remove(portx)
 }
+
+func TestAtMostOnce(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("once", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i, opts...)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: A late Join is not applied after the Leave ...\n")
+
+  ck.Join(1, []string{"x", "y", "z"})
+  ck.Join(2, []string{"a", "b", "c"})
+  // the clerk's last request, as a retry would send it.
+  join := &JoinArgs{GID: 2, Servers: []string{"a", "b", "c"}, Client: ck.id, Seq: ck.seq}
+  ck.Leave(2)
+  var jr JoinReply
+  call(kvh[1], "ShardMaster.Join", join, &jr)
+  check(t, []int64{1}, ck)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A late Move does not pin the shard again ...\n")
+
+  ck.Join(3, []string{"d", "e", "f"})
+  ck.Move(0, 3)
+  move := &MoveArgs{Shard: 0, GID: 3, Client: ck.id, Seq: ck.seq}
+  ck.Move(0, 1)
+  var mr MoveReply
+  call(kvh[2], "ShardMaster.Move", move, &mr)
+  if c := ck.Query(-1); c.Shards[0] != 1 {
+    t.Fatalf("shard 0 went back to group %v", c.Shards[0])
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A forgotten clerk starts a new session ...\n")
+
+  for i := 0; i < len(sma); i++ {
+    sma[i].rs.Idle()
+  }
+  for iters := 0; sma[0].rs.Sessions() != 0 || sma[2].rs.Sessions() != 0; iters++ {
+    if iters == 50 {
+      t.Fatalf("idle sessions were not forgotten")
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  mr = MoveReply{}
+  if !call(kvh[2], "ShardMaster.Move", move, &mr) || mr.Err != ErrSessionExpired {
+    t.Fatalf("late Move after expiry: %v, expected %v", mr.Err, ErrSessionExpired)
+  }
+  ck.Leave(3)
+  check(t, []int64{1}, ck)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("snap", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i, opts...)
+  }
+
+  ck1 := MakeClerk([]string{kvh[1]})
+
+  fmt.Printf("Test: Lagging replica catches up from a snapshot ...\n")
+
+  // server 0 can't hear anything for a while.
+  portx := kvh[0] + strconv.Itoa(rand.Int())
+  if os.Rename(kvh[0], portx) != nil {
+    t.Fatalf("os.Rename() failed")
+  }
+
+  for i := 0; i < snapshotEvery; i++ {
+    ck1.Join(int64(i + 1), []string{"a", "b", "c"})
+  }
+  for i := 0; i < snapshotEvery / 2; i++ {
+    ck1.Leave(int64(i + 1))
+  }
+  c1 := ck1.Query(-1)
+  if sma[1].px.Min() == 0 {
+    t.Fatalf("paxos log was not compacted")
+  }
+
+  if os.Rename(portx, kvh[0]) != nil {
+    t.Fatalf("os.Rename() failed")
+  }
+  ck0 := MakeClerk([]string{kvh[0]})
+  c0 := ck0.Query(-1)
+  if c0.Num < c1.Num || len(c0.Groups) != len(c1.Groups) {
+    t.Fatalf("lagging replica returned config %v, expected %v", c0.Num, c1.Num)
+  }
+  c := ck0.Query(1)
+  if c.Num != 1 || len(c.Groups) != 1 {
+    t.Fatalf("historical config lost in the snapshot")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPins(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("pins", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServer(kvh, i, opts...)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Moved shards stay put across joins and leaves ...\n")
+
+  ck.Join(1, []string{"a"})
+  ck.Join(2, []string{"b"})
+  ck.Move(0, 2)
+  ck.Move(1, 2)
+  ck.Move(2, 2)
+  ck.Join(3, []string{"c"})
+  ck.Join(4, []string{"d"})
+  c := ck.Query(-1)
+  for shard := 0; shard < 3; shard++ {
+    if c.Shards[shard] != 2 {
+      t.Fatalf("Join moved pinned shard %v to %v", shard, c.Shards[shard])
+    }
+  }
+  ck.Leave(1)
+  c = ck.Query(-1)
+  for shard := 0; shard < 3; shard++ {
+    if c.Shards[shard] != 2 {
+      t.Fatalf("Leave moved pinned shard %v to %v", shard, c.Shards[shard])
+    }
+  }
+  // the pins go with their group.
+  ck.Leave(2)
+  check(t, []int64{3, 4}, ck)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// the shards of c per group, and those pinned there.
+//
+func counts(c Config, pins map[int]int64) (map[int64]int, map[int64]int) {
+  n := map[int64]int{}
+  pinned := map[int64]int{}
+  for gid := range c.Groups {
+    n[gid] = 0
+  }
+  for shard, gid := range c.Shards {
+    n[gid]++
+    if pins[shard] == gid {
+      pinned[gid]++
+    }
+  }
+  return n, pinned
+}
+
+//
+// check that a Join or Leave took old to c: as evenly as
+// the pins allow, by as few moves as possible, and the
+// same way however the maps are ordered.
+//
+func checkRebalance(t *testing.T, seed int64, old Config, c Config, pins map[int]int64) {
+  for shard, gid := range c.Shards {
+    if _, ok := c.Groups[gid]; !ok && (len(c.Groups) > 0 || gid != 0) {
+      t.Fatalf("seed %v: shard %v -> invalid group %v", seed, shard, gid)
+    }
+  }
+  for shard, gid := range pins {
+    if _, ok := c.Groups[gid]; ok && c.Shards[shard] != gid {
+      t.Fatalf("seed %v: shard %v pinned to %v is on %v", seed, shard, gid, c.Shards[shard])
+    }
+  }
+
+  // as even as possible: a group more than one shard
+  // ahead of another holds only pinned shards.
+  n, pinned := counts(c, pins)
+  for g := range c.Groups {
+    for h := range c.Groups {
+      if n[g] > n[h] + 1 && n[g] != pinned[g] {
+        t.Fatalf("seed %v: group %v has %v shards, %v has %v", seed, g, n[g], h, n[h])
+      }
+    }
+  }
+
+  // as few moves as possible: no group both gives up and
+  // takes unpinned shards, and none that gives some up
+  // ends with fewer than one that takes some.
+  gave := map[int64]bool{}
+  took := map[int64]bool{}
+  for shard := range c.Shards {
+    from, to := old.Shards[shard], c.Shards[shard]
+    if from == to {
+      continue
+    }
+    took[to] = true
+    if _, ok := c.Groups[from]; ok && pins[shard] != to {
+      gave[from] = true
+    }
+  }
+  for g := range gave {
+    for h := range took {
+      if g == h {
+        t.Fatalf("seed %v: group %v both gave up and took shards", seed, g)
+      }
+      if n[g] < n[h] {
+        t.Fatalf("seed %v: group %v gave up shards to end with %v, while %v took some to %v",
+                 seed, g, n[g], h, n[h])
+      }
+    }
+  }
+
+  // the same answer from maps built in another order.
+  x := Config{Num: c.Num, Shards: old.Shards, Groups: map[int64][]string{}}
+  gids := []int64{}
+  for gid := range c.Groups {
+    gids = append(gids, gid)
+  }
+  for _, i := range rand.Perm(len(gids)) {
+    x.Groups[gids[i]] = c.Groups[gids[i]]
+  }
+  xpins := map[int]int64{}
+  for _, shard := range rand.Perm(NShards) {
+    if gid, ok := pins[shard]; ok {
+      xpins[shard] = gid
+    }
+  }
+  rebalance(&x, xpins)
+  if x.Shards != c.Shards {
+    t.Fatalf("seed %v: rebalance gave %v, and then %v", seed, c.Shards, x.Shards)
+  }
+}
+
+func TestRebalance(t *testing.T) {
+  fmt.Printf("Test: Random joins, leaves and moves rebalance well ...\n")
+
+  const nseqs = 300
+  const nops = 50
+  const ngids = 15
+  for seed := int64(0); seed < nseqs; seed++ {
+    r := rand.New(rand.NewSource(seed))
+    sm := &ShardMaster{}
+    sm.configs = []Config{{Groups: map[int64][]string{}}}
+    sm.pins = map[int]int64{}
+    m := machine{sm}
+
+    for i := 0; i < nops; i++ {
+      old := sm.configs[len(sm.configs) - 1]
+      var joined []int64
+      for gid := int64(1); gid <= ngids; gid++ {
+        if _, ok := old.Groups[gid]; ok {
+          joined = append(joined, gid)
+        }
+      }
+
+      x := r.Intn(10)
+      if len(joined) > 0 && x < 3 {
+        shard := r.Intn(NShards)
+        gid := joined[r.Intn(len(joined))]
+        m.Apply(Op{Kind: Move, Shard: shard, GID: gid})
+        c := sm.configs[len(sm.configs) - 1]
+        want := old.Shards
+        want[shard] = gid
+        if c.Shards != want {
+          t.Fatalf("seed %v: Move(%v, %v) took %v to %v", seed, shard, gid, old.Shards, c.Shards)
+        }
+        continue
+      }
+      if x == 3 {
+        // a Move to a shard that does not exist, or to a group
+        // that is not in the config, changes nothing.
+        shard := r.Intn(NShards)
+        gid := int64(1 + r.Intn(ngids))
+        if y := r.Intn(3); y == 0 {
+          shard = -1
+        } else if y == 1 {
+          shard = NShards
+        } else if len(joined) < ngids {
+          for old.Groups[gid] != nil {
+            gid = int64(1 + r.Intn(ngids))
+          }
+        } else {
+          gid = ngids + 1
+        }
+        pins := map[int]int64{}
+        for k, v := range sm.pins {
+          pins[k] = v
+        }
+        m.Apply(Op{Kind: Move, Shard: shard, GID: gid})
+        if c := sm.configs[len(sm.configs) - 1]; c.Num != old.Num {
+          t.Fatalf("seed %v: Move(%v, %v) made config %v", seed, shard, gid, c.Num)
+        }
+        if !reflect.DeepEqual(sm.pins, pins) {
+          t.Fatalf("seed %v: Move(%v, %v) took pins %v to %v", seed, shard, gid, pins, sm.pins)
+        }
+        continue
+      }
+      if len(joined) > 0 && (x < 6 || len(joined) == ngids) {
+        m.Apply(Op{Kind: Leave, GID: joined[r.Intn(len(joined))]})
+      } else {
+        gid := int64(1 + r.Intn(ngids))
+        for old.Groups[gid] != nil {
+          gid = int64(1 + r.Intn(ngids))
+        }
+        m.Apply(Op{Kind: Join, GID: gid, Servers: []string{strconv.FormatInt(gid, 10)}})
+      }
+      c := sm.configs[len(sm.configs) - 1]
+      if c.Num != old.Num + 1 {
+        t.Fatalf("seed %v: config %v follows %v", seed, c.Num, old.Num)
+      }
+      checkRebalance(t, seed, old, c, sm.pins)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Moves to absent groups or shards are ignored ...\n")
+
+  sm := &ShardMaster{}
+  sm.configs = []Config{{Groups: map[int64][]string{}}}
+  sm.pins = map[int]int64{}
+  m := machine{sm}
+  m.Apply(Op{Kind: Move, Shard: 3, GID: 1})
+  m.Apply(Op{Kind: Join, GID: 1, Servers: []string{"a"}})
+  m.Apply(Op{Kind: Join, GID: 2, Servers: []string{"b"}})
+  m.Apply(Op{Kind: Leave, GID: 2})
+  want := sm.configs[len(sm.configs) - 1]
+  moves := []Op{
+    {Kind: Move, Shard: -1, GID: 1},
+    {Kind: Move, Shard: NShards, GID: 1},
+    {Kind: Move, Shard: 3, GID: 2}, // left
+    {Kind: Move, Shard: 3, GID: 3}, // never joined
+    {Kind: Move, Shard: 3, GID: 0},
+  }
+  for _, op := range moves {
+    if r := m.Apply(op); r != nil {
+      t.Fatalf("Move(%v, %v) -> %v", op.Shard, op.GID, r)
+    }
+  }
+  if c := sm.configs[len(sm.configs) - 1]; !reflect.DeepEqual(c, want) {
+    t.Fatalf("ignored Moves took config %v to %v", want, c)
+  }
+  if len(sm.pins) != 0 {
+    t.Fatalf("ignored Moves pinned %v", sm.pins)
+  }
+  m.Apply(Op{Kind: Join, GID: 3, Servers: []string{"c"}})
+  n, _ := counts(sm.configs[len(sm.configs) - 1], sm.pins)
+  for gid, k := range n {
+    if k != NShards / 2 {
+      t.Fatalf("group %v has %v shards after joins", gid, k)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,109 @@
+package transport
+
+//
+// an in-memory transport: listeners live in a table in
+// this process and every Dial() is a net.Pipe(). useful
+// for tests that want many servers without touching the
+// file system or the network.
+//
+
+import "net"
+import "errors"
+import "sync"
+
+var ErrNoListener = errors.New("transport: no listener at address")
+
+type memTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+var Mem Transport = &memTransport{listeners: make(map[string]*memListener)}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	addr   string
+	conns  chan net.Conn
+	done   chan bool
+	once   sync.Once
+	closed func() // called once, by Close()
+}
+
+func makeMemListener(addr string, closed func()) *memListener {
+	l := &memListener{addr: addr, closed: closed}
+	l.conns = make(chan net.Conn)
+	l.done = make(chan bool)
+	return l
+}
+
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, errors.New("transport: address in use: " + addr)
+	}
+	var l *memListener
+	l = makeMemListener(addr, func() {
+		t.mu.Lock()
+		if t.listeners[addr] == l {
+			delete(t.listeners, addr)
+		}
+		t.mu.Unlock()
+	})
+	t.listeners[addr] = l
+	return l, nil
+}
+
+func (t *memTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[addr]
+	t.mu.Unlock()
+	if !ok {
+		return nil, ErrNoListener
+	}
+	client, server := net.Pipe()
+	if l.deliver(server) == false {
+		client.Close()
+		return nil, ErrNoListener
+	}
+	return client, nil
+}
+
+//
+// hand conn to Accept(); false, with conn closed, if the
+// listener is closed first.
+//
+func (l *memListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("transport: listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.closed()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
@@ -0,0 +1,576 @@
+package transport
+
+//
+// many streams over one connection, so that the unix and
+// tcp transports can keep their connections open across
+// RPCs (see pool.go).
+//
+// the server's listener takes each pooled connection apart
+// again, and hands every stream to Accept() as if it were
+// a connection of its own. so the accept loops, and their
+// unreliable modes that drop or DiscardReply() a whole
+// connection, still drop one RPC at a time.
+//
+// a pooled connection starts with a preamble. without one,
+// the listener serves it as a plain connection, so clients
+// that dial the socket themselves still work.
+//
+// after the preamble, frames: a 9-byte header (type, stream
+// id, length) and then the data.
+//
+// a connection can die without either end hearing of it,
+// and an RPC on it would then wait forever. so while a
+// client has streams open it pings the server, and gives
+// up on the connection if pingTimeout passes without a
+// frame from the other end; and a call fails if its reply
+// does not start within callTimeout. a stream holds at most
+// maxBuffered bytes that its reader has not yet taken.
+//
+
+import "net"
+import "io"
+import "errors"
+import "sync"
+import "time"
+import "encoding/binary"
+
+const preamble = "\x00mux"
+
+const (
+	frameOpen  = 1
+	frameData  = 2
+	frameFin   = 3 // the sender will write no more
+	frameClose = 4 // the sender is done with the stream
+	framePing  = 5 // the receiver should answer with a pong
+	framePong  = 6
+)
+
+const headerLen = 9
+const maxFrame = 64 * 1024
+const maxBuffered = 64 * 1024 * 1024
+
+const pingEvery = time.Second
+const pingTimeout = 5 * time.Second
+
+//
+// no RPC handler waits this long before it replies.
+//
+const callTimeout = 10 * time.Second
+
+var errLost = errors.New("transport: connection lost")
+var errOverflow = errors.New("transport: stream buffer full")
+
+//
+// a net.Error, so that callers can tell a timeout apart.
+//
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "transport: call timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+//
+// one connection carrying many streams.
+//
+type session struct {
+	conn    net.Conn
+	wmu     sync.Mutex // one frame at a time
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	next    uint32
+	dead    bool
+	retired bool          // close once the last stream closes
+	accept  func(*stream) // on the server, gets each new stream
+	closed  func()        // called once, by close()
+	pinged  time.Time     // when the unanswered ping was sent
+}
+
+func makeSession(conn net.Conn, accept func(*stream), closed func()) *session {
+	s := &session{conn: conn, accept: accept, closed: closed}
+	s.streams = make(map[uint32]*stream)
+	go s.reader()
+	if accept == nil {
+		go s.pinger()
+	}
+	return s
+}
+
+func (s *session) write(typ byte, id uint32, data []byte) error {
+	frame := make([]byte, headerLen+len(data))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(data)))
+	copy(frame[headerLen:], data)
+
+	s.wmu.Lock()
+	_, err := s.conn.Write(frame)
+	s.wmu.Unlock()
+	if err != nil {
+		s.close()
+	}
+	return err
+}
+
+//
+// a new stream, on the client.
+//
+func (s *session) open() (*stream, error) {
+	s.mu.Lock()
+	if s.dead {
+		s.mu.Unlock()
+		return nil, errLost
+	}
+	s.next++
+	st := makeStream(s, s.next)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.write(frameOpen, st.id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *session) reader() {
+	var h [headerLen]byte
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			break
+		}
+		typ := h[0]
+		id := binary.BigEndian.Uint32(h[1:5])
+		n := binary.BigEndian.Uint32(h[5:9])
+		if n > maxFrame {
+			break
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			break
+		}
+		if typ == framePing {
+			// not from the reader, which must keep reading.
+			go s.write(framePong, 0, nil)
+			continue
+		}
+
+		s.mu.Lock()
+		s.pinged = time.Time{}
+		st := s.streams[id]
+		if typ == frameOpen && st == nil && s.accept != nil && s.dead == false {
+			st = makeStream(s, id)
+			s.streams[id] = st
+			s.mu.Unlock()
+			s.accept(st)
+			continue
+		}
+		s.mu.Unlock()
+		if st != nil {
+			st.receive(typ, data)
+		}
+	}
+	s.close()
+}
+
+//
+// on the client, ping the server while streams are open,
+// and close the connection if it stops answering.
+//
+func (s *session) pinger() {
+	for {
+		time.Sleep(pingEvery)
+		s.mu.Lock()
+		if s.dead {
+			s.mu.Unlock()
+			return
+		}
+		ping, stuck := false, false
+		if len(s.streams) == 0 {
+			s.pinged = time.Time{}
+		} else if s.pinged.IsZero() {
+			s.pinged = time.Now()
+			ping = true
+		} else if time.Since(s.pinged) > pingTimeout {
+			stuck = true
+		}
+		s.mu.Unlock()
+
+		if stuck {
+			s.close()
+			return
+		}
+		if ping {
+			s.write(framePing, 0, nil)
+		}
+	}
+}
+
+func (s *session) alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dead == false
+}
+
+//
+// close the connection, and fail every stream on it.
+//
+func (s *session) close() {
+	s.mu.Lock()
+	if s.dead {
+		s.mu.Unlock()
+		return
+	}
+	s.dead = true
+	streams := s.streams
+	s.streams = make(map[uint32]*stream)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.lost()
+	}
+	if s.closed != nil {
+		s.closed()
+	}
+}
+
+//
+// no new streams will be opened; let the ones in flight
+// finish, and then close.
+//
+func (s *session) retire() {
+	s.mu.Lock()
+	s.retired = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+func (s *session) forget(st *stream) {
+	s.mu.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+	idle := s.retired && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.close()
+	}
+}
+
+//
+// one stream of a session, as a net.Conn.
+//
+type stream struct {
+	s      *session
+	id     uint32
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	eof    bool  // the other end will write no more
+	gone   bool  // the other end closed the stream
+	shut   bool  // CloseWrite() was called
+	closed bool  // Close() was called
+	err    error // the session was lost
+}
+
+func makeStream(s *session, id uint32) *stream {
+	st := &stream{s: s, id: id}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+//
+// a frame for this stream; never blocks, since it is
+// called by the session's reader.
+//
+func (st *stream) receive(typ byte, data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch typ {
+	case frameData:
+		if len(st.buf)+len(data) > maxBuffered {
+			// the reader has stopped taking what arrives.
+			st.buf = nil
+			st.err = errOverflow
+			break
+		}
+		if st.err == nil {
+			st.buf = append(st.buf, data...)
+		}
+	case frameFin:
+		st.eof = true
+	case frameClose:
+		st.eof = true
+		st.gone = true
+	}
+	st.cond.Broadcast()
+}
+
+func (st *stream) lost() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.err = errLost
+	st.cond.Broadcast()
+}
+
+//
+// on the client, a Read fails if nothing arrives within
+// callTimeout.
+//
+func (st *stream) Read(b []byte) (int, error) {
+	var deadline time.Time
+	if st.s.accept == nil {
+		deadline = time.Now().Add(callTimeout)
+		t := time.AfterFunc(callTimeout, func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for len(st.buf) == 0 && st.eof == false && st.err == nil && st.closed == false {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, timeoutError{}
+		}
+		st.cond.Wait()
+	}
+	if st.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(st.buf) > 0 {
+		n := copy(b, st.buf)
+		st.buf = st.buf[n:]
+		if len(st.buf) == 0 {
+			st.buf = nil
+		}
+		return n, nil
+	}
+	if st.err != nil {
+		return 0, st.err
+	}
+	return 0, io.EOF
+}
+
+func (st *stream) Write(b []byte) (int, error) {
+	st.mu.Lock()
+	err := st.err
+	if st.closed || st.shut || st.gone {
+		err = io.ErrClosedPipe
+	}
+	st.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(b) {
+		m := len(b) - n
+		if m > maxFrame {
+			m = maxFrame
+		}
+		if err := st.s.write(frameData, st.id, b[n:n+m]); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+//
+// the half-close that DiscardReply() uses.
+//
+func (st *stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.shut {
+		st.mu.Unlock()
+		return nil
+	}
+	st.shut = true
+	st.mu.Unlock()
+	return st.s.write(frameFin, st.id, nil)
+}
+
+func (st *stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if st.s.alive() {
+		st.s.write(frameClose, st.id, nil)
+	}
+	st.s.forget(st)
+	return nil
+}
+
+func (st *stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+//
+// RPCs do not use deadlines.
+//
+func (st *stream) SetDeadline(t time.Time) error {
+	return errors.New("transport: deadlines not supported")
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	return st.SetDeadline(t)
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	return st.SetDeadline(t)
+}
+
+//
+// a plain connection whose first bytes were read while
+// looking for the preamble.
+//
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+//
+// a listener that accepts both pooled and plain
+// connections, and delivers streams and plain connections
+// alike from Accept().
+//
+type muxListener struct {
+	inner    net.Listener
+	conns    chan net.Conn
+	done     chan bool
+	once     sync.Once
+	mu       sync.Mutex
+	sessions map[*session]bool
+	err      error
+}
+
+func mux(inner net.Listener) net.Listener {
+	l := &muxListener{inner: inner}
+	l.conns = make(chan net.Conn)
+	l.done = make(chan bool)
+	l.sessions = make(map[*session]bool)
+	go l.acceptor()
+	return l
+}
+
+func (l *muxListener) acceptor() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+func (l *muxListener) serve(conn net.Conn) {
+	p := make([]byte, len(preamble))
+	n, err := io.ReadFull(conn, p)
+	if err != nil || string(p) != preamble {
+		l.deliver(&prefixConn{conn, p[:n]})
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions == nil {
+		conn.Close()
+		return
+	}
+	var s *session
+	s = makeSession(conn, func(st *stream) {
+		go l.deliver(st)
+	}, func() {
+		l.mu.Lock()
+		delete(l.sessions, s)
+		l.mu.Unlock()
+	})
+	l.sessions[s] = true
+}
+
+//
+// hand conn to Accept(); closes it if the listener is
+// closed first.
+//
+func (l *muxListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, errors.New("transport: listener closed")
+	}
+}
+
+//
+// stop listening, and close the pooled connections, which
+// fails the RPCs still in flight on them.
+//
+func (l *muxListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.inner.Close()
+		close(l.done)
+		l.mu.Lock()
+		sessions := l.sessions
+		l.sessions = nil
+		l.mu.Unlock()
+		for s := range sessions {
+			s.close()
+		}
+	})
+	return err
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
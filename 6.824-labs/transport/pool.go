@@ -0,0 +1,120 @@
+package transport
+
+//
+// the client side of connection pooling: one connection
+// per server address, shared by every Dial() in the
+// process, with each rpc.Client getting a stream of its
+// own (see mux.go). closing the client closes just the
+// stream; a call() still fails if anything goes wrong.
+//
+// a cached connection is used only while it is healthy:
+// not if the server closed it or it failed, and, for a
+// unix socket, not if the path no longer names the socket
+// it was dialed through. the tests partition servers by
+// removing links, and restart them at the same path, and
+// a Dial() must notice. an unhealthy connection is dropped
+// from the cache, and closed once its streams are done.
+//
+
+import "net"
+import "os"
+import "io"
+import "sync"
+
+// the benchmarks turn pooling off to compare.
+var pooling = true
+
+type pooled struct {
+	s  *session
+	fi os.FileInfo // of the unix socket; nil for tcp
+}
+
+type pool struct {
+	mu    sync.Mutex
+	conns map[string]*pooled
+}
+
+var conns = &pool{conns: make(map[string]*pooled)}
+
+func poolable(t Transport) bool {
+	switch t.(type) {
+	case Unix, TCP:
+		return pooling
+	}
+	return false
+}
+
+//
+// a stream to a, the address addr without its scheme.
+//
+func (p *pool) dial(t Transport, addr string, a string) (net.Conn, error) {
+	var fi os.FileInfo
+	if _, ok := t.(Unix); ok {
+		var err error
+		if fi, err = os.Stat(a); err != nil {
+			// let Dial() say why.
+			p.drop(addr)
+			return t.Dial(a)
+		}
+	}
+
+	for tries := 0; ; tries++ {
+		c := p.get(addr, fi)
+		if c == nil {
+			conn, err := t.Dial(a)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.WriteString(conn, preamble); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c = &pooled{makeSession(conn, nil, nil), fi}
+			p.put(addr, c)
+		}
+		st, err := c.s.open()
+		if err == nil {
+			return st, nil
+		}
+		// the connection failed since it was last used.
+		if tries > 0 {
+			return nil, err
+		}
+	}
+}
+
+//
+// the healthy cached connection to addr, if any.
+//
+func (p *pool) get(addr string, fi os.FileInfo) *pooled {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.conns[addr]
+	if c == nil {
+		return nil
+	}
+	if c.s.alive() && (fi == nil || os.SameFile(fi, c.fi)) {
+		return c
+	}
+	delete(p.conns, addr)
+	c.s.retire()
+	return nil
+}
+
+func (p *pool) put(addr string, c *pooled) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old := p.conns[addr]; old != nil {
+		old.s.retire()
+	}
+	p.conns[addr] = c
+}
+
+func (p *pool) drop(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.conns[addr]; c != nil {
+		delete(p.conns, addr)
+		c.s.retire()
+	}
+}
@@ -0,0 +1,351 @@
+package transport
+
+//
+// a simulated network for tests. like mem:// it lives in
+// the process, but it can also be partitioned, and it can
+// lose, delay (and so reorder) or duplicate requests, or
+// lose their replies.
+//
+// every node has a name. a node listens at Addr(name), and
+// its peers reach it at Link(peer, name), so the network
+// knows who is calling, as it did from the per-peer hard
+// links of the old part(). a call to Addr(name) comes from
+// nobody in particular (a clerk, say) and no partition
+// cuts it off.
+//
+// every link has its own random generator, seeded from the
+// network's seed and the link's name, and each RPC over the
+// link draws its fate from it in the same way whatever the
+// faults are. so the n'th RPC over a link meets the same
+// fate in every run with a given seed.
+//
+// replaying a seed is best-effort, not exact. which RPC is
+// the n'th depends on how the goroutines are scheduled when
+// a node has several calls to the same peer under way at
+// once, and on timeouts and retries, which depend on the
+// clock. a test prints the seed when it fails; setting
+// TRANSPORT_SEED to it runs the test again with the same
+// faults, and, if the test draws its workload and
+// partitions from the seed as well, the same schedule of
+// them, which makes the failure likely but not certain to
+// come back.
+//
+
+import "errors"
+import "hash/fnv"
+import "io"
+import "math/rand"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+//
+// what may happen to each RPC on a link. the first three
+// are probabilities; an RPC is held up for a random time
+// of up to Delay before the server gets it, so RPCs can
+// overtake each other.
+//
+type Faults struct {
+	Loss      float64 // the request is lost
+	LoseReply float64 // the server gets the request, the client no reply
+	Duplicate float64 // the server gets the request twice
+	Delay     time.Duration
+}
+
+type Network struct {
+	mu        sync.Mutex
+	scheme    string
+	seed      int64
+	faults    Faults
+	links     map[string]*simLink // by from + ">" + to
+	listeners map[string]*memListener
+	groups    map[string]int // each node's side of a partition
+}
+
+type simLink struct {
+	rng    *rand.Rand
+	faults *Faults // if not nil, instead of the network's
+}
+
+//
+// what happens to one RPC.
+//
+type fate struct {
+	lose      bool
+	loseReply bool
+	duplicate bool
+	delay     time.Duration
+	dupDelay  time.Duration
+}
+
+var networks int32
+
+//
+// a new network, with no faults, reached through addresses
+// of a scheme of its own.
+//
+func MakeNetwork(seed int64) *Network {
+	n := &Network{seed: seed}
+	n.scheme = "sim" + strconv.Itoa(int(atomic.AddInt32(&networks, 1)))
+	n.links = make(map[string]*simLink)
+	n.listeners = make(map[string]*memListener)
+	Register(n.scheme, n)
+	return n
+}
+
+//
+// a seed for MakeNetwork(): $TRANSPORT_SEED if it is set,
+// else the time.
+//
+func Seed() int64 {
+	if s, err := strconv.ParseInt(os.Getenv("TRANSPORT_SEED"), 10, 64); err == nil {
+		return s
+	}
+	return time.Now().UnixNano()
+}
+
+func (n *Network) Seed() int64 {
+	return n.seed
+}
+
+//
+// where node listens, and where anybody outside the
+// network reaches it.
+//
+func (n *Network) Addr(node string) string {
+	return n.scheme + "://" + node
+}
+
+//
+// where node from reaches node to.
+//
+func (n *Network) Link(from string, to string) string {
+	return n.scheme + "://" + from + ">" + to
+}
+
+//
+// the faults of every link that has none of its own.
+//
+func (n *Network) SetFaults(f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults = f
+}
+
+//
+// the faults of the link from node from to node to.
+//
+func (n *Network) SetLinkFaults(from string, to string, f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.link(from, to).faults = &f
+}
+
+//
+// cut the network: nodes in different groups cannot reach
+// each other, and a node in none of them cannot reach
+// anybody. RPCs under way across a cut lose their replies.
+// with no groups, the network is whole again.
+//
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(groups) == 0 {
+		n.groups = nil
+		return
+	}
+	n.groups = make(map[string]int)
+	for g, nodes := range groups {
+		for _, node := range nodes {
+			n.groups[node] = g
+		}
+	}
+}
+
+//
+// n.mu must be held.
+//
+func (n *Network) reachable(from string, to string) bool {
+	if n.groups == nil || from == "" || from == to {
+		return true
+	}
+	g1, ok1 := n.groups[from]
+	g2, ok2 := n.groups[to]
+	return ok1 && ok2 && g1 == g2
+}
+
+//
+// n.mu must be held.
+//
+func (n *Network) link(from string, to string) *simLink {
+	name := from + ">" + to
+	lk, ok := n.links[name]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		lk = &simLink{rng: rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))}
+		n.links[name] = lk
+	}
+	return lk
+}
+
+//
+// the fate of the next RPC from node from to node to.
+// n.mu must be held.
+//
+func (n *Network) draw(from string, to string) fate {
+	lk := n.link(from, to)
+	fs := n.faults
+	if lk.faults != nil {
+		fs = *lk.faults
+	}
+	var f fate
+	f.lose = lk.rng.Float64() < fs.Loss
+	f.loseReply = lk.rng.Float64() < fs.LoseReply
+	f.duplicate = lk.rng.Float64() < fs.Duplicate
+	f.delay = time.Duration(lk.rng.Float64() * float64(fs.Delay))
+	f.dupDelay = time.Duration(lk.rng.Float64() * float64(fs.Delay))
+	return f
+}
+
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	if strings.Contains(addr, ">") {
+		return nil, errors.New("transport: listen on a link: " + addr)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, errors.New("transport: address in use: " + addr)
+	}
+	var l *memListener
+	l = makeMemListener(addr, func() {
+		n.mu.Lock()
+		if n.listeners[addr] == l {
+			delete(n.listeners, addr)
+		}
+		n.mu.Unlock()
+	})
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (n *Network) Dial(addr string) (net.Conn, error) {
+	from, to := "", addr
+	if i := strings.Index(addr, ">"); i >= 0 {
+		from, to = addr[:i], addr[i+1:]
+	}
+
+	n.mu.Lock()
+	l, ok := n.listeners[to]
+	if !ok || !n.reachable(from, to) {
+		n.mu.Unlock()
+		return nil, ErrNoListener
+	}
+	f := n.draw(from, to)
+	n.mu.Unlock()
+
+	client, server := net.Pipe()
+	go n.deliver(l, server, from, to, f.delay, f.lose, f.loseReply)
+	if f.duplicate == false {
+		return client, nil
+	}
+
+	// the copy's reply is thrown away.
+	dupc, dups := net.Pipe()
+	go io.Copy(io.Discard, dupc)
+	go n.deliver(l, dups, from, to, f.dupDelay, false, false)
+	t := &teeConn{Conn: client, dup: dupc}
+	t.ch = make(chan []byte, 16)
+	go t.copier()
+	return t, nil
+}
+
+//
+// after delay, hand the server's end of an RPC to the
+// listener, unless the request is lost.
+//
+func (n *Network) deliver(l *memListener, conn net.Conn, from string, to string,
+	delay time.Duration, lose bool, loseReply bool) {
+	time.Sleep(delay)
+	n.mu.Lock()
+	ok := n.reachable(from, to)
+	n.mu.Unlock()
+	if lose || !ok {
+		conn.Close()
+		return
+	}
+	conn = &simConn{conn, n, from, to}
+	if loseReply {
+		conn = &discardConn{conn}
+	}
+	l.deliver(conn)
+}
+
+//
+// the server's end of an RPC; a partition between the
+// nodes cuts it.
+//
+type simConn struct {
+	net.Conn
+	n    *Network
+	from string
+	to   string
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	c.n.mu.Lock()
+	ok := c.n.reachable(c.from, c.to)
+	c.n.mu.Unlock()
+	if !ok {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(b)
+}
+
+//
+// the client's end of a duplicated RPC: what the client
+// writes goes to the copy too, without waiting for it.
+//
+type teeConn struct {
+	net.Conn
+	dup    net.Conn
+	mu     sync.Mutex
+	ch     chan []byte // to copier()
+	closed bool
+}
+
+func (c *teeConn) Write(b []byte) (int, error) {
+	nw, err := c.Conn.Write(b)
+	c.mu.Lock()
+	if nw > 0 && c.closed == false {
+		c.ch <- append([]byte(nil), b[:nw]...)
+	}
+	c.mu.Unlock()
+	return nw, err
+}
+
+func (c *teeConn) Close() error {
+	c.mu.Lock()
+	if c.closed == false {
+		c.closed = true
+		close(c.ch)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *teeConn) copier() {
+	defer c.dup.Close()
+	for b := range c.ch {
+		if _, err := c.dup.Write(b); err != nil {
+			break
+		}
+	}
+	for range c.ch {
+	}
+}
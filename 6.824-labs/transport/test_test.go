@@ -0,0 +1,461 @@
+package transport
+
+import "testing"
+import "net"
+import "net/rpc"
+import "os"
+import "strconv"
+import "fmt"
+import "sync"
+import "time"
+
+type Echo struct {
+  mu sync.Mutex
+  n int
+}
+
+func (e *Echo) Echo(args *string, reply *string) error {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  e.n++
+  *reply = *args
+  return nil
+}
+
+func port(tag string) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "tr-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag
+  return s
+}
+
+func serve(l net.Listener, rpcs *rpc.Server, discard bool) {
+  for {
+    conn, err := l.Accept()
+    if err != nil {
+      return
+    }
+    if discard {
+      conn = DiscardReply(conn)
+    }
+    go rpcs.ServeConn(conn)
+  }
+}
+
+func echo(addr string, s string) (string, error) {
+  c, err := Dial(addr)
+  if err != nil {
+    return "", err
+  }
+  defer c.Close()
+  var reply string
+  err = c.Call("Echo.Echo", &s, &reply)
+  return reply, err
+}
+
+func TestTransports(t *testing.T) {
+  for _, addr := range []string{port("unix"), "mem://" + port("mem"), "tcp://127.0.0.1:0"} {
+    fmt.Printf("Test: RPC over %v ...\n", addr)
+
+    l, err := Listen(addr)
+    if err != nil {
+      t.Fatalf("Listen(%v): %v", addr, err)
+    }
+    if l.Addr().Network() == "tcp" {
+      addr = "tcp://" + l.Addr().String()
+    }
+    rpcs := rpc.NewServer()
+    rpcs.Register(&Echo{})
+    go serve(l, rpcs, false)
+
+    if reply, err := echo(addr, "hello"); err != nil || reply != "hello" {
+      t.Fatalf("echo over %v: %v %v", addr, reply, err)
+    }
+
+    l.Close()
+    if _, err := echo(addr, "hello"); err == nil {
+      t.Fatalf("echo over %v worked after Close()", addr)
+    }
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func TestDiscardReply(t *testing.T) {
+  for _, addr := range []string{port("unix-d"), "mem://" + port("mem-d")} {
+    fmt.Printf("Test: DiscardReply over %v ...\n", addr)
+
+    l, err := Listen(addr)
+    if err != nil {
+      t.Fatalf("Listen(%v): %v", addr, err)
+    }
+    e := &Echo{}
+    rpcs := rpc.NewServer()
+    rpcs.Register(e)
+    go serve(l, rpcs, true)
+
+    if _, err := echo(addr, "hello"); err == nil {
+      t.Fatalf("reply over %v was not discarded", addr)
+    }
+    l.Close()
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func TestUnreachable(t *testing.T) {
+  fmt.Printf("Test: Dial with no listener ...\n")
+
+  for _, addr := range []string{port("none"), "mem://" + port("none")} {
+    _, err := Dial(addr)
+    if err == nil || IsUnreachable(err) == false {
+      t.Fatalf("Dial(%v) = %v; expected unreachable", addr, err)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPool(t *testing.T) {
+  fmt.Printf("Test: RPCs share a pooled connection ...\n")
+
+  addr := port("pool")
+  link := port("pool-link")
+  os.Remove(link)
+  defer os.Remove(link)
+
+  l, err := Listen(addr)
+  if err != nil {
+    t.Fatalf("Listen: %v", err)
+  }
+  e := &Echo{}
+  rpcs := rpc.NewServer()
+  rpcs.Register(e)
+  go serve(l, rpcs, false)
+  if err := os.Link(addr, link); err != nil {
+    t.Fatalf("os.Link: %v", err)
+  }
+
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < 10; j++ {
+        s := strconv.Itoa(i * 10 + j)
+        if reply, err := echo(link, s); err != nil || reply != s {
+          t.Errorf("echo %v: %v %v", s, reply, err)
+        }
+      }
+    }(i)
+  }
+  wg.Wait()
+  e.mu.Lock()
+  n := e.n
+  e.mu.Unlock()
+  if n != 100 {
+    t.Fatalf("server saw %v requests, expected 100", n)
+  }
+  ml := l.(*muxListener)
+  ml.mu.Lock()
+  n = len(ml.sessions)
+  ml.mu.Unlock()
+  if n < 1 || n > 10 {
+    t.Fatalf("100 RPCs used %v connections", n)
+  }
+
+  // a plain connection, without the pool.
+  c, err := rpc.Dial("unix", link)
+  if err != nil {
+    t.Fatalf("rpc.Dial: %v", err)
+  }
+  var reply string
+  if err := c.Call("Echo.Echo", "plain", &reply); err != nil || reply != "plain" {
+    t.Fatalf("plain echo: %v %v", reply, err)
+  }
+  c.Close()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A pooled connection notices partitions and restarts ...\n")
+
+  os.Remove(link)
+  if _, err := echo(link, "x"); err == nil || IsUnreachable(err) == false {
+    t.Fatalf("echo over a removed link: %v", err)
+  }
+  if err := os.Link(addr, link); err != nil {
+    t.Fatalf("os.Link: %v", err)
+  }
+  if _, err := echo(link, "x"); err != nil {
+    t.Fatalf("echo after healing: %v", err)
+  }
+
+  l.Close()
+  if _, err := echo(addr, "x"); err == nil {
+    t.Fatalf("echo worked after Close()")
+  }
+  l, err = Listen(addr)
+  if err != nil {
+    t.Fatalf("Listen: %v", err)
+  }
+  defer l.Close()
+  go serve(l, rpcs, false)
+  if _, err := echo(addr, "x"); err != nil {
+    t.Fatalf("echo to the restarted server: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSilentServer(t *testing.T) {
+  fmt.Printf("Test: A pooled connection to a silent server fails ...\n")
+
+  // takes the connection, and then never answers, like a
+  // server that went away without closing it.
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen: %v", err)
+  }
+  defer l.Close()
+  var mu sync.Mutex
+  var held []net.Conn
+  defer func() {
+    mu.Lock()
+    defer mu.Unlock()
+    for _, c := range held {
+      c.Close()
+    }
+  }()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      mu.Lock()
+      held = append(held, c)
+      mu.Unlock()
+    }
+  }()
+
+  addr := "tcp://" + l.Addr().String()
+  start := time.Now()
+  if _, err := echo(addr, "x"); err == nil {
+    t.Fatalf("echo to a silent server worked")
+  }
+  if d := time.Since(start); d > pingTimeout + 2 * pingEvery {
+    t.Fatalf("echo to a silent server took %v", d)
+  }
+  conns.mu.Lock()
+  c := conns.conns[addr]
+  conns.mu.Unlock()
+  if c != nil && c.s.alive() {
+    t.Fatalf("the dead connection is still in the pool")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A stream buffers a bounded amount ...\n")
+
+  s := &session{streams: make(map[uint32]*stream)}
+  st := makeStream(s, 1)
+  chunk := make([]byte, maxFrame)
+  for n := 0; n <= maxBuffered; n += maxFrame {
+    st.receive(frameData, chunk)
+  }
+  if st.err != errOverflow || len(st.buf) != 0 {
+    t.Fatalf("stream took %v bytes unread", len(st.buf))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func benchmarkEcho(b *testing.B, addr string, pool bool) {
+  pooling = pool
+  defer func() { pooling = true }()
+
+  l, err := Listen(addr)
+  if err != nil {
+    b.Fatalf("Listen: %v", err)
+  }
+  defer l.Close()
+  if l.Addr().Network() == "tcp" {
+    addr = "tcp://" + l.Addr().String()
+  }
+  rpcs := rpc.NewServer()
+  rpcs.Register(&Echo{})
+  go serve(l, rpcs, false)
+
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    for pb.Next() {
+      if _, err := echo(addr, "x"); err != nil {
+        b.Fatalf("echo: %v", err)
+      }
+    }
+  })
+}
+
+//
+// go test -bench . transport compares the RPC rates.
+//
+func BenchmarkUnixPooled(b *testing.B) {
+  benchmarkEcho(b, port("bench"), true)
+}
+
+func BenchmarkUnixUnpooled(b *testing.B) {
+  benchmarkEcho(b, port("bench"), false)
+}
+
+func BenchmarkTCPPooled(b *testing.B) {
+  benchmarkEcho(b, "tcp://127.0.0.1:0", true)
+}
+
+func BenchmarkTCPUnpooled(b *testing.B) {
+  benchmarkEcho(b, "tcp://127.0.0.1:0", false)
+}
+
+//
+// the outcome of each of n echoes from node a to node b.
+//
+func echoes(nw *Network, n int) []bool {
+  var oks []bool
+  for i := 0; i < n; i++ {
+    reply, err := echo(nw.Link("a", "b"), "x")
+    oks = append(oks, err == nil && reply == "x")
+  }
+  return oks
+}
+
+func TestSimFaults(t *testing.T) {
+  fmt.Printf("Test: Simulated loss is replayed from the seed ...\n")
+
+  run := func(seed int64) []bool {
+    nw := MakeNetwork(seed)
+    nw.SetFaults(Faults{Loss: 0.3, LoseReply: 0.2})
+    l, err := nw.Listen("b")
+    if err != nil {
+      t.Fatalf("Listen: %v", err)
+    }
+    defer l.Close()
+    rpcs := rpc.NewServer()
+    rpcs.Register(&Echo{})
+    go serve(l, rpcs, false)
+    return echoes(nw, 100)
+  }
+
+  seed := Seed()
+  a := run(seed)
+  b := run(seed)
+  c := run(seed + 1)
+  nok := 0
+  for i := range a {
+    if a[i] != b[i] {
+      t.Fatalf("seed %v: echo %v came out differently", seed, i)
+    }
+    if a[i] {
+      nok++
+    }
+  }
+  if nok < 30 || nok > 80 {
+    t.Fatalf("seed %v: %v of 100 echoes got through", seed, nok)
+  }
+  same := true
+  for i := range a {
+    same = same && a[i] == c[i]
+  }
+  if same {
+    t.Fatalf("seeds %v and %v lost the same echoes", seed, seed+1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimPartition(t *testing.T) {
+  fmt.Printf("Test: Simulated partitions ...\n")
+
+  nw := MakeNetwork(Seed())
+  for _, node := range []string{"a", "b", "c"} {
+    l, err := nw.Listen(node)
+    if err != nil {
+      t.Fatalf("Listen: %v", err)
+    }
+    defer l.Close()
+    rpcs := rpc.NewServer()
+    rpcs.Register(&Echo{})
+    go serve(l, rpcs, false)
+  }
+
+  reach := func(from string, to string, expect bool) {
+    _, err := echo(nw.Link(from, to), "x")
+    if (err == nil) != expect {
+      t.Fatalf("%v -> %v: %v, expected reachable=%v", from, to, err, expect)
+    }
+    if err != nil && IsUnreachable(err) == false {
+      t.Fatalf("%v -> %v: %v is not unreachable", from, to, err)
+    }
+  }
+
+  nw.Partition([]string{"a", "b"}, []string{"c"})
+  reach("a", "b", true)
+  reach("b", "a", true)
+  reach("a", "c", false)
+  reach("c", "b", false)
+  if _, err := echo(nw.Addr("c"), "x"); err != nil {
+    t.Fatalf("outside -> c: %v", err)
+  }
+
+  nw.Partition([]string{"a"})
+  reach("a", "b", false)
+  reach("b", "c", false)
+
+  nw.Partition()
+  reach("a", "c", true)
+  reach("c", "b", true)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSimDuplicate(t *testing.T) {
+  fmt.Printf("Test: Simulated duplicates and delays ...\n")
+
+  nw := MakeNetwork(Seed())
+  nw.SetLinkFaults("a", "b", Faults{Duplicate: 1, Delay: 20 * time.Millisecond})
+  l, err := nw.Listen("b")
+  if err != nil {
+    t.Fatalf("Listen: %v", err)
+  }
+  defer l.Close()
+  e := &Echo{}
+  rpcs := rpc.NewServer()
+  rpcs.Register(e)
+  go serve(l, rpcs, false)
+
+  start := time.Now()
+  for i, ok := range echoes(nw, 10) {
+    if !ok {
+      t.Fatalf("echo %v failed", i)
+    }
+  }
+  if d := time.Since(start); d > 10 * 20 * time.Millisecond + time.Second {
+    t.Fatalf("10 echoes took %v", d)
+  }
+
+  // only a -> b has faults.
+  if _, err := echo(nw.Addr("b"), "x"); err != nil {
+    t.Fatalf("echo from outside: %v", err)
+  }
+
+  time.Sleep(100 * time.Millisecond)
+  e.mu.Lock()
+  n := e.n
+  e.mu.Unlock()
+  if n != 21 {
+    t.Fatalf("server saw %v requests, expected 21", n)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,187 @@
+package transport
+
+//
+// the network underneath the RPCs of paxos and the 6.824
+// services.
+//
+// a server's address names its transport:
+//
+//   tcp://host:port   TCP, for running across machines
+//   mem://name        in-process pipes, for tests
+//   anything else     a unix socket at that path
+//
+// so the transport is picked by the addresses handed to
+// Make(), StartServer() and MakeClerk(), and a clerk and
+// its servers always agree on it.
+//
+// Listen(me) and Dial(srv) replace net.Listen("unix", me)
+// and rpc.Dial("unix", srv); DiscardReply() replaces the
+// shutdown(SHUT_WR) trick the unreliable accept loops use
+// to lose a reply.
+//
+// over unix sockets and tcp, Dial() reuses one connection
+// per server address (see pool.go and mux.go).
+//
+
+import "net"
+import "net/rpc"
+import "context"
+import "os"
+import "io"
+import "fmt"
+import "sync"
+import "strings"
+import "syscall"
+import "time"
+
+//
+// how often TCP checks that an idle connection's other
+// end is still there.
+//
+const keepAlive = 15 * time.Second
+
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+var (
+	mu         sync.Mutex
+	transports = map[string]Transport{
+		"unix": Unix{},
+		"tcp":  TCP{},
+		"mem":  Mem,
+	}
+)
+
+//
+// Register makes addresses of the form scheme://x use t.
+//
+func Register(scheme string, t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[scheme] = t
+}
+
+//
+// the transport for addr, and addr without its scheme.
+//
+func Lookup(addr string) (Transport, string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if i := strings.Index(addr, "://"); i >= 0 {
+		if t, ok := transports[addr[:i]]; ok {
+			return t, addr[i+3:]
+		}
+	}
+	return transports["unix"], addr
+}
+
+func Listen(addr string) (net.Listener, error) {
+	t, a := Lookup(addr)
+	return t.Listen(a)
+}
+
+//
+// connect an RPC client to the server at addr.
+//
+func Dial(addr string) (*rpc.Client, error) {
+	t, a := Lookup(addr)
+	var conn net.Conn
+	var err error
+	if poolable(t) {
+		conn, err = conns.dial(t, addr, a)
+	} else {
+		conn, err = t.Dial(a)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+//
+// let the server read and process the request on conn,
+// but make sure the client never sees the reply.
+//
+func DiscardReply(conn net.Conn) net.Conn {
+	if c, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		if err := c.CloseWrite(); err != nil {
+			fmt.Printf("shutdown: %v\n", err)
+		}
+		return conn
+	}
+	return &discardConn{conn}
+}
+
+//
+// closes the connection instead of writing the reply,
+// for transports without a half-close.
+//
+type discardConn struct {
+	net.Conn
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	c.Conn.Close()
+	return 0, io.ErrClosedPipe
+}
+
+//
+// Unix sockets in the file system; only works on
+// one machine.
+//
+type Unix struct{}
+
+func (Unix) Listen(addr string) (net.Listener, error) {
+	os.Remove(addr)
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	return mux(l), nil
+}
+
+func (Unix) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+type TCP struct{}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return mux(l), nil
+}
+
+func (TCP) Dial(addr string) (net.Conn, error) {
+	d := net.Dialer{KeepAlive: keepAlive}
+	return d.Dial("tcp", addr)
+}
+
+//
+// IsUnreachable reports whether err from Dial() just
+// means nobody is listening at the address, which the
+// call() helpers expect and do not print.
+//
+func IsUnreachable(err error) bool {
+	if err == ErrNoListener {
+		return true
+	}
+	if e, ok := err.(*net.OpError); ok {
+		if se, ok := e.Err.(*os.SyscallError); ok {
+			return isRefused(se.Err)
+		}
+		return isRefused(e.Err)
+	}
+	return false
+}
+
+func isRefused(err error) bool {
+	return err == syscall.ENOENT || err == syscall.ECONNREFUSED
+}
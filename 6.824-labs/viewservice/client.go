@@ -1,6 +1,6 @@
 package viewservice
 
-import "net/rpc"
+import "transport"
 import "fmt"
 
 //
@@ -37,7 +37,7 @@ func MakeClerk(me string, server string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	c, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
@@ -2,11 +2,11 @@ package viewservice
 
 import "net"
 import "net/rpc"
+import "transport"
 import "log"
 import "time"
 import "sync"
 import "fmt"
-import "os"
 
 type ViewServer struct {
 	mu   sync.Mutex
@@ -170,9 +170,8 @@ func StartServer(me string) *ViewServer {
 	rpcs.Register(vs)
 
 	// prepare to receive connections from clients.
-	// change "unix" to "tcp" to use over a network.
-	os.Remove(vs.me) // only needed for "unix"
-	l, e := net.Listen("unix", vs.me)
+	// the address says which transport to use.
+	l, e := transport.Listen(vs.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}